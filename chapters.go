@@ -0,0 +1,404 @@
+package main
+
+import (
+	p "Z0y6h0kS9X/libby-chapterizer/pkg"
+	prov "Z0y6h0kS9X/libby-chapterizer/provider"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var chaptersCmd = &cobra.Command{
+	Use:   "chapters",
+	Short: "Works with the chapters of a book without converting it",
+}
+
+var chaptersExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports the chapters of a book to standard chapter formats",
+	Long: "Resolves the chapters of a book the same way a conversion does, and writes them to one or more chapter formats " +
+		"(" + strings.Join(p.ChapterFormatNames(), ", ") + ").",
+	Run: func(cmd *cobra.Command, args []string) {
+		exportChapters(cmd.Context())
+	},
+}
+
+var exportFormats []string
+var exportStdout bool
+
+func init() {
+	chaptersExportCmd.Flags().StringSliceVar(&exportFormats, "to", []string{"mp4chaps"}, "The chapter formats to export ("+strings.Join(p.ChapterFormatNames(), "|")+")")
+	chaptersExportCmd.Flags().BoolVar(&exportStdout, "stdout", false, "Prints the chapters instead of writing them to --out")
+	chaptersCmd.AddCommand(chaptersExportCmd)
+	rootCmd.AddCommand(chaptersCmd)
+}
+
+// exportChapters resolves the chapters of the book, and writes them in each of the selected formats.
+func exportChapters(ctx context.Context) {
+
+	// Gets the directory of the openbook.json (which holds the mp3 files), or of the input file
+	inputDir := getInputDir()
+	if outPath == "" {
+		outPath = inputDir
+	}
+
+	// Checks the formats and the chapter settings are valid
+	var exporters []p.ChapterExporter
+	for _, name := range exportFormats {
+		exporter, err := p.GetChapterExporter(name)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		exporters = append(exporters, exporter)
+	}
+	titles, err := checkChapterFlags()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// Reads the book, its metadata and its audio files
+	book, asin, metadata, files := loadBook(ctx, inputDir)
+
+	chapters, err := resolveChapters(ctx, book, files, metadata, titles)
+	if err != nil {
+		fmt.Println("Error getting chapters:", err)
+		os.Exit(1)
+	}
+
+	// Writes each of the formats
+	for _, exporter := range exporters {
+		if exportStdout {
+			content, err := exporter.Export(chapters, metadata)
+			if err != nil {
+				fmt.Println("Error exporting chapters:", err)
+				os.Exit(1)
+			}
+			fmt.Print(content)
+			continue
+		}
+
+		if err := os.MkdirAll(outPath, os.ModePerm); err != nil {
+			fmt.Println("Error creating output path:", err)
+			os.Exit(1)
+		}
+		file := p.ChapterExportPath(outPath, metadata, asin, exporter)
+		if err := exporter.WriteChapters(chapters, metadata, file); err != nil {
+			fmt.Println("Error exporting chapters:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Wrote", exporter.Name, "chapters to", file)
+	}
+}
+
+// checkChapterFlags checks the chapter settings are valid, and builds the chapter title options.
+func checkChapterFlags() (p.TitleOptions, error) {
+
+	// Checks the drift action is valid
+	if audibleDriftAction != "fallback" && audibleDriftAction != "refuse" {
+		return p.TitleOptions{}, fmt.Errorf("audible drift action must be 'fallback' or 'refuse'")
+	}
+
+	// Silences shorter than --silence-min are never detected, so auto chapters could not find the shorter gaps
+	if (autoChapters || autoFallback) && silenceMin > autoGap {
+		return p.TitleOptions{}, fmt.Errorf("--silence-min (%s) must not be longer than --auto-gap (%s)", silenceMin, autoGap)
+	}
+
+	opts := p.TitleOptions{Cleaners: titleClean, Template: titleTemplate}
+	for _, rule := range titleRewrites {
+		rewrite, err := p.ParseTitleRewrite(rule)
+		if err != nil {
+			return opts, err
+		}
+		opts.Rewrites = append(opts.Rewrites, rewrite)
+	}
+
+	return opts, opts.Validate()
+}
+
+// resolveChapters gets the chapters from the selected source, and runs them through the rules,
+// the title cleanup and the silence snapping, so every command sees the same chapters.
+func resolveChapters(ctx context.Context, book p.Openbook, files []string, metadata p.Metadata, titles p.TitleOptions) ([]p.Chapter, error) {
+
+	// Gets the chapters from the selected source
+	chapters, err := getChapters(ctx, book, files, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// Applies the post-processing rules, whichever source the chapters came from
+	rules := p.ChapterRules{
+		MinLengthMs: int(mergeShort.Milliseconds()),
+		MaxLengthMs: int(splitLong.Milliseconds()),
+		DropCredits: dropCredits,
+		Renumber:    renumber,
+	}
+	if rules.IsEnabled() {
+		chapters, err = applyRules(ctx, rules, files, chapters)
+		if err != nil {
+			return nil, fmt.Errorf("error applying chapter rules: %w", err)
+		}
+	}
+
+	// Cleans up and formats the chapter titles, after the rules so the template sees the final chapters
+	if titles.IsEnabled() {
+		chapters, err = titles.Apply(chapters, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("error formatting chapter titles: %w", err)
+		}
+	}
+
+	// Moves the chapter boundaries onto the silences
+	if snapSilence {
+		chapters, err = snapChapters(ctx, files, chapters)
+		if err != nil {
+			return nil, fmt.Errorf("error snapping chapters to silence: %w", err)
+		}
+	}
+
+	return chapters, nil
+}
+
+// getChapters gets the chapters of the book, from the chapters file if there is one, from Audible if it was
+// requested and local otherwise. Audible chapters are aligned to the local audio, and if they drift too far the local chapters are used.
+func getChapters(ctx context.Context, book p.Openbook, files []string, metadata p.Metadata) ([]p.Chapter, error) {
+
+	// Uses the chapters file over any other source
+	if chaptersFile != "" {
+		totalMs, err := p.GetTotalDurationMS(ctx, files)
+		if err != nil {
+			return nil, err
+		}
+		return p.ImportChapters(chaptersFile, totalMs)
+	}
+
+	// Detects the chapters from the audio if it was requested
+	if autoChapters {
+		return getAutoChapters(ctx, files, metadata)
+	}
+
+	// Merges the local timings with the audible titles if it was requested
+	if hybridChapters {
+		return getHybridChapters(ctx, book, files, metadata)
+	}
+
+	// Uses the openbook chapters unless audible chapters were requested
+	if !audibleChapters {
+		return getLocalChapters(ctx, book, files, metadata)
+	}
+
+	// Gets the audible chapters, along with the information needed to align them
+	info, err := prov.GetAudibleChapterInfo(ctx, metadata.ASIN)
+	if err != nil {
+		return nil, fmt.Errorf("error getting audible chapters: %w", err)
+	}
+
+	if len(info.Chapters) == 0 {
+		fmt.Println("No audible chapters found, using local chapters")
+		return getLocalChapters(ctx, book, files, metadata)
+	}
+
+	// Measures the local audio the chapters are aligned to
+	localMs, err := p.GetTotalDurationMS(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aligns the chapters, and prints how far each was moved
+	chapters, report, err := p.AlignAudibleChapters(info, localMs, int(audibleMaxDrift.Milliseconds()))
+	if report != nil {
+		fmt.Println("================= Chapter Alignment =================")
+		fmt.Print(p.FormatAlignmentReport(report))
+		fmt.Println("=====================================================")
+	}
+	if err != nil {
+		if audibleDriftAction == "refuse" {
+			return nil, err
+		}
+		fmt.Println("Unable to align audible chapters (" + err.Error() + "), using local chapters")
+		return getLocalChapters(ctx, book, files, metadata)
+	}
+
+	return chapters, nil
+}
+
+// getHybridChapters gets the local chapters, and replaces their titles with the audible chapter titles.
+// The audible chapters are aligned to the local audio first, so they can be matched by offset.
+func getHybridChapters(ctx context.Context, book p.Openbook, files []string, metadata p.Metadata) ([]p.Chapter, error) {
+
+	local, err := getLocalChapters(ctx, book, files, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.ASIN == "" {
+		fmt.Println("Book does not have an ASIN, using local chapter titles")
+		return local, nil
+	}
+
+	// Gets the audible chapters, along with the information needed to align them
+	info, err := prov.GetAudibleChapterInfo(ctx, metadata.ASIN)
+	if err != nil {
+		return nil, fmt.Errorf("error getting audible chapters: %w", err)
+	}
+
+	if len(info.Chapters) == 0 {
+		fmt.Println("No audible chapters found, using local chapter titles")
+		return local, nil
+	}
+
+	localMs, err := p.GetTotalDurationMS(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the titles are used, so the chapters are still matched if they drift
+	aligned, _, err := p.AlignAudibleChapters(info, localMs, int(audibleMaxDrift.Milliseconds()))
+	if aligned == nil {
+		return nil, err
+	}
+	if err != nil {
+		fmt.Println("Warning:", err)
+	}
+
+	// Merges the chapters, and prints how each was matched
+	merged, report := p.MergeChapters(local, aligned)
+	fmt.Println("================== Chapter Matches ==================")
+	fmt.Print(p.FormatMatchReport(report))
+	fmt.Println("=====================================================")
+
+	return merged, nil
+}
+
+// getLocalChapters gets the chapters from the openbook (or the input file). If there are none usable, they are
+// detected from the audio when --auto-fallback is set.
+func getLocalChapters(ctx context.Context, book p.Openbook, files []string, metadata p.Metadata) ([]p.Chapter, error) {
+
+	// The chapters of an input file were read along with its tags
+	if inputFile != "" {
+		if len(metadata.Chapters) == 0 {
+			if !autoFallback {
+				fmt.Println("The input file has no chapters, it is kept as a single chapter (use --auto-fallback or --auto-chapters to detect chapters from the audio)")
+				totalMs, err := p.GetTotalDurationMS(ctx, files)
+				if err != nil {
+					return nil, err
+				}
+				return []p.Chapter{{Title: metadata.Title, LengthMs: totalMs}}, nil
+			}
+			fmt.Println("The input file has no chapters, detecting chapters from the audio")
+			return getAutoChapters(ctx, files, metadata)
+		}
+		return metadata.Chapters, nil
+	}
+
+	if !p.IsUsableTOC(book) {
+		if !autoFallback && len(book.Nav.Toc) == 0 {
+			return nil, fmt.Errorf("the openbook has no table of contents (use --auto-fallback or --auto-chapters to detect the chapters from the audio)")
+		} else if !autoFallback {
+			fmt.Println("The table of contents only lists the files (use --auto-fallback or --auto-chapters to detect chapters from the audio)")
+			return p.GetChaptersLocal(ctx, book, files)
+		}
+		fmt.Println("The table of contents only lists the files, detecting chapters from the audio")
+		return getAutoChapters(ctx, files, metadata)
+	}
+
+	return p.GetChaptersLocal(ctx, book, files)
+}
+
+// getAutoChapters detects the chapters from the silences in the audio.
+// The chapters are titled from Audible if the book has an ASIN and the number of chapters lines up.
+func getAutoChapters(ctx context.Context, files []string, metadata p.Metadata) ([]p.Chapter, error) {
+
+	found, err := getSilences(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	totalMs, err := p.GetTotalDurationMS(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := p.AutoChapterOptions{
+		MinLengthMs: int(autoMin.Milliseconds()),
+		MaxLengthMs: int(autoMax.Milliseconds()),
+		MinGapMs:    int(autoGap.Milliseconds()),
+	}
+	chapters, err := p.AutoChapters(found, totalMs, opts)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Detected %d chapters\n", len(chapters))
+
+	// Uses the audible titles if the chapters line up
+	if metadata.ASIN != "" {
+		info, err := prov.GetAudibleChapterInfo(ctx, metadata.ASIN)
+		if err != nil {
+			fmt.Println("Unable to get audible chapter titles:", err)
+		} else if p.ApplyChapterTitles(chapters, info.Chapters) {
+			fmt.Println("Using audible chapter titles")
+		} else {
+			fmt.Printf("Audible has %d chapters, using generated titles\n", len(info.Chapters))
+		}
+	}
+
+	return chapters, nil
+}
+
+// getSilences detects the silences in the audio, the first time it is called.
+func getSilences(ctx context.Context, files []string) ([]p.Silence, error) {
+
+	if silences != nil {
+		return silences, nil
+	}
+
+	// Detects the shortest silences any of the passes use
+	opts := p.SilenceOptions{NoiseDb: silenceNoise, MinDurationMs: int(silenceMin.Milliseconds())}
+	found, err := p.DetectSilences(ctx, files, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	silences = found
+	return silences, nil
+}
+
+// applyRules runs the post-processing rules over the chapters, and prints how many chapters are left.
+func applyRules(ctx context.Context, rules p.ChapterRules, files []string, chapters []p.Chapter) ([]p.Chapter, error) {
+
+	// The silences are only needed to split long chapters
+	var found []p.Silence
+	if rules.MaxLengthMs > 0 {
+		var err error
+		found, err = getSilences(ctx, files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := rules.Apply(chapters, found)
+	fmt.Printf("Chapter rules: %d chapters -> %d chapters\n", len(chapters), len(result))
+
+	return result, nil
+}
+
+// snapChapters detects the silences in the audio, and moves the chapter boundaries onto them.
+// A report of how far each boundary moved is printed.
+func snapChapters(ctx context.Context, files []string, chapters []p.Chapter) ([]p.Chapter, error) {
+
+	found, err := getSilences(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	snapped, report := p.SnapChapters(chapters, found, int(snapWindow.Milliseconds()))
+	fmt.Println("=================== Silence Snap ====================")
+	fmt.Print(p.FormatSnapReport(report))
+	fmt.Println("=====================================================")
+
+	return snapped, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	p "Z0y6h0kS9X/libby-chapterizer/pkg"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Checks ffmpeg, ffprobe, the metadata hosts and the output directory",
+	Long: "Finds ffmpeg and ffprobe (set their paths with --ffmpeg and --ffprobe), and checks their versions and the encoders and " +
+		"muxers the outputs need, that the Audible and Audnexus hosts can be reached, and that the output directory can be written to. " +
+		"Each problem is printed with how to fix it, and the exit code is 1 if any check failed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		doctor(cmd.Context())
+	},
+}
+
+// doctorEndpoints are the hosts the book metadata and chapters are fetched from, any response means they can be reached.
+var doctorEndpoints = []struct {
+	Name string
+	URL  string
+	Use  string
+}{
+	{Name: "Audible", URL: "https://api.audible.com/1.0/catalog/products?num_results=1", Use: "finding the ASIN of a book"},
+	{Name: "Audnexus", URL: "https://api.audnex.us/", Use: "the book metadata and Audible chapters"},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// doctorResults counts the checks that failed or warned, and collects how to fix them.
+type doctorResults struct {
+	failed int
+	warned int
+	fixes  []string
+}
+
+// ok prints a check that passed.
+func (d *doctorResults) ok(name, detail string) {
+	fmt.Println("[OK]   " + name + ": " + detail)
+}
+
+// warn prints a check that found a problem the tool can work around.
+func (d *doctorResults) warn(name, detail, fix string) {
+	fmt.Println("[WARN] " + name + ": " + detail)
+	d.warned++
+	d.fixes = append(d.fixes, fix)
+}
+
+// fail prints a check that found a problem the tool can't work around.
+func (d *doctorResults) fail(name, detail, fix string) {
+	fmt.Println("[FAIL] " + name + ": " + detail)
+	d.failed++
+	d.fixes = append(d.fixes, fix)
+}
+
+// doctor runs each of the checks, and prints the fixes for the problems found.
+func doctor(ctx context.Context) {
+
+	var results doctorResults
+
+	fmt.Println("====================== Doctor =======================")
+
+	// Checks ffmpeg and ffprobe are installed, and recent enough
+	ffmpeg := checkBinary(ctx, &results, "ffmpeg", p.FFmpegBinary)
+	checkBinary(ctx, &results, "ffprobe", p.FFprobeBinary)
+
+	// Checks ffmpeg was built with the encoders and muxers
+	if ffmpeg {
+		checkComponents(ctx, &results, "encoder", "-encoders", p.DoctorEncoders)
+		checkComponents(ctx, &results, "muxer", "-muxers", p.DoctorMuxers)
+	}
+
+	// Checks the metadata hosts can be reached
+	for _, endpoint := range doctorEndpoints {
+		status, err := p.CheckEndpoint(ctx, endpoint.URL)
+		if err != nil {
+			results.fail(endpoint.Name, "unreachable ("+err.Error()+")",
+				"Check the internet connection, proxy (HTTPS_PROXY) and firewall allow "+endpoint.URL+", it is used for "+endpoint.Use)
+			continue
+		}
+		results.ok(endpoint.Name, fmt.Sprintf("reachable (HTTP %d)", status))
+	}
+
+	// Checks the output directory can be written to, it defaults to the directory of the book
+	dir := outPath
+	if dir == "" && (jsonPath != "" || inputFile != "") {
+		dir = getInputDir()
+	} else if dir == "" {
+		dir = "."
+	}
+	dir = filepath.ToSlash(dir)
+	checked, err := p.CheckWritable(dir)
+	if err != nil {
+		results.fail("Output directory", checked+" is not writable ("+err.Error()+")",
+			"Fix the permissions of "+checked+", or use --out with a directory you can write to")
+	} else if checked != path.Clean(dir) {
+		results.ok("Output directory", dir+" will be created in "+checked)
+	} else {
+		results.ok("Output directory", dir+" is writable")
+	}
+
+	fmt.Println("=====================================================")
+
+	// Prints how to fix each of the problems
+	if len(results.fixes) > 0 {
+		fmt.Println("Fixes:")
+		for _, fix := range results.fixes {
+			fmt.Println("  - " + fix)
+		}
+	}
+	fmt.Printf("%d failed, %d warnings\n", results.failed, results.warned)
+
+	if results.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkBinary checks the binary can be found and run, and is at least the minimum version. It returns false if it
+// can't be run.
+func checkBinary(ctx context.Context, results *doctorResults, name, binary string) bool {
+
+	install := "Install ffmpeg (which includes ffprobe) from https://ffmpeg.org/download.html or your package manager " +
+		"(e.g. apt install ffmpeg, brew install ffmpeg, winget install ffmpeg)"
+
+	found, err := p.FindBinary(binary)
+	if err != nil {
+		results.fail(name, binary+" was not found ("+err.Error()+")", install+", or pass its path with --"+name)
+		return false
+	}
+
+	version, err := p.BinaryVersion(ctx, found)
+	if err != nil {
+		results.fail(name, found+" could not be run ("+err.Error()+")", "Reinstall "+name+", or pass the path of a working one with --"+name)
+		return false
+	}
+
+	major, ok := p.MajorVersion(version)
+	if ok && major < p.MinFFmpegVersion {
+		results.fail(name, fmt.Sprintf("%s is version %s, %d or later is needed", found, version, p.MinFFmpegVersion),
+			fmt.Sprintf("Update %s to version %d or later", name, p.MinFFmpegVersion))
+		return true
+	}
+
+	results.ok(name, found+" (version "+version+")")
+	return true
+}
+
+// checkComponents checks ffmpeg lists each of the encoders or muxers.
+func checkComponents(ctx context.Context, results *doctorResults, kind, list string, components []p.DoctorComponent) {
+
+	available, err := p.ListFFmpegComponents(ctx, list)
+	if err != nil {
+		results.fail("ffmpeg "+kind+"s", err.Error(), "Reinstall ffmpeg, or pass the path of a working one with --ffmpeg")
+		return
+	}
+
+	for _, component := range components {
+		name := kind + " " + component.Name
+		switch {
+		case available[component.Name]:
+			results.ok(name, "available")
+		case component.Fallback != "":
+			results.warn(name, "not available, "+component.Fallback,
+				"Use an ffmpeg built with the "+component.Name+" "+kind+" if you need "+component.Use)
+		default:
+			results.fail(name, "not available, needed for "+component.Use,
+				"Install a full ffmpeg build (with the "+component.Name+" "+kind+"), it is needed for "+component.Use)
+		}
+	}
+}
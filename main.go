@@ -3,75 +3,154 @@ package main
 import (
 	p "Z0y6h0kS9X/libby-chapterizer/pkg"
 	prov "Z0y6h0kS9X/libby-chapterizer/provider"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var rootCmd = &cobra.Command{
-	Use:   "libby-chapterizer",
-	Short: "A brief description of your application",
-	Long:  "A longer description of your application",
+	Use:     "libby-chapterizer",
+	Short:   "A brief description of your application",
+	Long:    "A longer description of your application",
+	Version: version,
 	Run: func(cmd *cobra.Command, args []string) {
-		// This function will be executed when your application is run
-		// fmt.Println("Hello, World!")
+		run(cmd.Context())
 	},
 }
 
+// version is the version of the tool, it is set when building a release with -ldflags "-X main.version=..."
+var version = "dev"
+
 var jsonPath string
+var inputFile string
 var outPath string
 var test bool
 var audibleChapters bool
+var chaptersFile string
 var single bool
 var format string
+var outputs []string
+var preset string
+var codec string
+var bitrate string
+var quality float64
+var sampleRate int
+var channels int
+var loudnorm string
+var loudnormTarget float64
+var loudnormPeak float64
+var audibleMaxDrift time.Duration
+var audibleDriftAction string
+var mergeShort time.Duration
+var splitLong time.Duration
+var dropCredits bool
+var renumber bool
+var titleClean []string
+var titleRewrites []string
+var titleTemplate string
+var snapSilence bool
+var snapWindow time.Duration
+var silenceNoise float64
+var silenceMin time.Duration
+var autoChapters bool
+var autoFallback bool
+var hybridChapters bool
+var autoMin time.Duration
+var autoMax time.Duration
+var autoGap time.Duration
+var force bool
+var overwrite string
+var checkTolerance time.Duration
+var noCheck bool
+
+// silences caches the silences detected in the audio, they are used by more than one chapter pass
+var silences []p.Silence
 
 func init() {
-	rootCmd.Flags().StringVarP(&jsonPath, "json", "j", "", "The path to the openbook.json file")
-	rootCmd.Flags().StringVarP(&outPath, "out", "o", "", "The path to the directory you want to output the files to")
+	rootCmd.PersistentFlags().StringVarP(&jsonPath, "json", "j", "", "The path to the openbook.json file")
+	rootCmd.PersistentFlags().StringVarP(&inputFile, "input", "i", "", "An existing audiobook file ("+strings.Join(p.InputExtensions, "|")+") to read the chapters and tags from, instead of an openbook.json")
+	rootCmd.PersistentFlags().StringVarP(&outPath, "out", "o", "", "The path to the directory you want to output the files to")
+	rootCmd.PersistentFlags().StringVar(&p.FFmpegBinary, "ffmpeg", "ffmpeg", "The path to the ffmpeg executable (looked up in the PATH by default)")
+	rootCmd.PersistentFlags().StringVar(&p.FFprobeBinary, "ffprobe", "ffprobe", "The path to the ffprobe executable (looked up in the PATH by default)")
 	rootCmd.Flags().BoolVarP(&test, "test", "t", false, "Test mode")
-	rootCmd.Flags().BoolVarP(&audibleChapters, "use-audible-chapters", "c", false, "Specifies to override default breaks and use audible markers instead")
+	rootCmd.PersistentFlags().BoolVarP(&audibleChapters, "use-audible-chapters", "c", false, "Specifies to override default breaks and use audible markers instead")
 	rootCmd.Flags().BoolVarP(&single, "single", "s", false, "Indicates if you want the output as a single file, or sepearate files for each chapter")
-	rootCmd.Flags().StringVarP(&format, "format", "f", "mp3", "What format you want the output in (mp3|m4b)")
+	rootCmd.Flags().StringVarP(&format, "format", "f", "mp3", "What format you want the output in (mp3|m4b|m4a|opus|flac|aac)")
+	rootCmd.Flags().StringArrayVar(&outputs, "output", nil, "An output to produce as format:layout[:template] (e.g. m4b:single), can be repeated and replaces --format/--single")
+	rootCmd.Flags().StringVarP(&preset, "preset", "p", "default", "The encoder preset to use for m4b output (default|archive|phone|speech-small|auto|lossless)")
+	rootCmd.Flags().StringVar(&codec, "codec", "", "Overrides the audio codec of the preset (aac|libfdk_aac|opus|copy)")
+	rootCmd.Flags().StringVar(&bitrate, "bitrate", "", "Overrides the bitrate of the preset in kbps, or 'auto' to match the source (e.g. auto:96k caps it at 96 kbps)")
+	rootCmd.Flags().Float64Var(&quality, "quality", 0, "Uses VBR with the given codec specific quality instead of a bitrate")
+	rootCmd.Flags().IntVar(&sampleRate, "sample-rate", 0, "Overrides the sample rate of the preset in Hz")
+	rootCmd.Flags().IntVar(&channels, "channels", 0, "Overrides the number of audio channels of the preset")
+	rootCmd.PersistentFlags().StringVar(&chaptersFile, "chapters-file", "", "Uses the chapters from a file instead of the openbook or Audible ("+strings.Join(p.ChapterImportFormats, "|")+")")
+	rootCmd.PersistentFlags().DurationVar(&audibleMaxDrift, "audible-max-drift", time.Minute, "The largest runtime difference between the Audible and local audio the Audible chapters are aligned for")
+	rootCmd.PersistentFlags().StringVar(&audibleDriftAction, "audible-drift-action", "fallback", "What to do when the Audible chapters drift too far (fallback|refuse), fallback uses the local chapters")
+	rootCmd.PersistentFlags().BoolVar(&hybridChapters, "hybrid-chapters", false, "Uses the local chapter timings with the Audible chapter titles")
+	rootCmd.PersistentFlags().BoolVar(&autoChapters, "auto-chapters", false, "Detects the chapters from the silences in the audio")
+	rootCmd.PersistentFlags().BoolVar(&autoFallback, "auto-fallback", false, "Detects the chapters from the silences in the audio when the table of contents only lists the files, or the input file has no chapters")
+	rootCmd.PersistentFlags().DurationVar(&autoMin, "auto-min", 3*time.Minute, "The shortest chapter auto chapters creates")
+	rootCmd.PersistentFlags().DurationVar(&autoMax, "auto-max", 45*time.Minute, "The longest chapter auto chapters creates before splitting it")
+	rootCmd.PersistentFlags().DurationVar(&autoGap, "auto-gap", 2*time.Second, "The shortest silence auto chapters treats as a chapter break, it can't be shorter than --silence-min")
+	rootCmd.PersistentFlags().DurationVar(&mergeShort, "merge-short", 0, "Merges chapters shorter than this into a neighbour (0 disables)")
+	rootCmd.PersistentFlags().DurationVar(&splitLong, "split-long", 0, "Splits chapters longer than this into parts at silences (0 disables)")
+	rootCmd.PersistentFlags().BoolVar(&dropCredits, "drop-credits", false, "Removes the opening and end credits chapters, their audio is kept in the neighbouring chapter")
+	rootCmd.PersistentFlags().BoolVar(&renumber, "renumber", false, "Renumbers the 'Chapter N' titles so they are sequential")
+	rootCmd.PersistentFlags().StringSliceVar(&titleClean, "title-clean", nil, "The chapter title cleaners to run (timestamp|dedupe|numbers|titlecase), none by default")
+	rootCmd.PersistentFlags().StringArrayVar(&titleRewrites, "title-rewrite", nil, "A regex rewrite of the chapter titles as pattern=>replacement, can be repeated")
+	rootCmd.PersistentFlags().StringVar(&titleTemplate, "title-template", "", "A template for the chapter titles (e.g. \"{{.Index | pad 2}} - {{.Title}}\")")
+	rootCmd.PersistentFlags().BoolVar(&snapSilence, "snap-silence", false, "Moves each chapter boundary to the nearest silence within --snap-window")
+	rootCmd.PersistentFlags().DurationVar(&snapWindow, "snap-window", 3*time.Second, "How far a chapter boundary can be moved to reach a silence")
+	rootCmd.PersistentFlags().Float64Var(&silenceNoise, "silence-noise", -30, "The volume in dB below which audio counts as silence")
+	rootCmd.PersistentFlags().DurationVar(&silenceMin, "silence-min", 500*time.Millisecond, "The shortest gap that counts as silence")
+	rootCmd.Flags().BoolVar(&force, "force", false, "Makes every output again, instead of skipping the files a previous run finished")
+	rootCmd.Flags().StringVar(&overwrite, "overwrite", "overwrite", "What to do when an output file already exists ("+strings.Join(p.OverwritePolicies, "|")+")")
+	rootCmd.Flags().DurationVar(&checkTolerance, "check-tolerance", time.Second, "The largest difference between an output file or chapter marker and its chapter before the file is moved into place")
+	rootCmd.Flags().BoolVar(&noCheck, "no-check", false, "Moves the output files into place without checking their length and chapter markers")
+	rootCmd.Flags().StringVar(&loudnorm, "loudnorm", "off", "EBU R128 loudness normalization (off|normalize|tag), tag only writes ReplayGain/iTunNORM tags")
+	rootCmd.Flags().Float64Var(&loudnormTarget, "loudnorm-target", -18, "The integrated loudness to normalize to in LUFS")
+	rootCmd.Flags().Float64Var(&loudnormPeak, "loudnorm-tp", -1.5, "The maximum true peak after normalization in dBTP")
 }
 
 func main() {
 
-	// Parses the flags
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
+	// Cancels the context on Ctrl-C or SIGTERM, which stops ffmpeg and the requests, a second signal exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	// Checks to see if the jsonPath was specified
-	if jsonPath == "" {
-		fmt.Println("Error: path to openbook.json was not specified")
+	// Parses the flags, and runs the command
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+}
 
-	// Checks to see if the jsonPath is valid
-	_, err := os.Stat(jsonPath)
-	if os.IsNotExist(err) {
-		fmt.Println("Error: path to openbook.json is not valid")
-		os.Exit(1)
-	} else if err != nil {
-		fmt.Println("Error!:", err)
-		os.Exit(1)
-	}
+// run converts the book to each of the outputs, it is the root command.
+func run(ctx context.Context) {
 
-	// Gets the directory path from the json path, converst to *nix path (if windows)
-	jsonPath = filepath.ToSlash(jsonPath)
-	jsonDir := path.Dir(jsonPath)
+	// Gets the directory of the openbook.json (which holds the mp3 files), or of the input file
+	inputDir := getInputDir()
 
 	// Checks to see if the outPath was specified
 	if outPath == "" {
-		outPath = jsonDir
+		outPath = inputDir
 	}
 
 	// Checks to see if the outPath is valid
-	_, err = os.Stat(outPath)
+	_, err := os.Stat(outPath)
 	if os.IsNotExist(err) {
 		// Create path if it doesn't exist
 		err = os.MkdirAll(outPath, os.ModePerm)
@@ -87,188 +166,589 @@ func main() {
 	// Gets the directory path from the json path, converst to *nix path (if windows)
 	outPath = filepath.ToSlash(outPath)
 
-	// Checks the output format specified is valid
-	if format != "mp3" && format != "m4b" {
-		fmt.Println("Error: output format must be 'mp3' or 'm4b'")
+	// Gets the outputs, --format and --single are used when no --output was specified
+	targets, err := getOutputTargets()
+	if err != nil {
+		fmt.Println("Error:", err)
 		os.Exit(1)
 	}
 
-	// Converts the JSON file to an Openbook
-	book, err := p.JSONFileToOpenBook(jsonPath)
+	// Checks the loudness settings are valid
+	loudness := p.LoudnessOptions{Mode: loudnorm, Target: loudnormTarget, TruePeak: loudnormPeak}
+	err = loudness.Validate()
 	if err != nil {
-		fmt.Println("Error: Unable to convert JSON file to Openbook!\n", err)
+		fmt.Println("Error:", err)
 		os.Exit(1)
 	}
 
-	// Gets the primary author and narrator
-	author := p.GetPrimaryAuthor(book)
-	narrator := p.GetPrimaryNarrator(book)
+	// Checks the overwrite policy is valid
+	err = p.OverwritePolicy(overwrite).Validate()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
 
-	// Gets the ASIN
-	asin, err := prov.GetBook(book.Title.Main, author, narrator, book.CalculateRuntime())
+	// Checks the chapter settings are valid
+	titles, err := checkChapterFlags()
 	if err != nil {
-		fmt.Println("Error getting book:", err)
+		fmt.Println("Error:", err)
 		os.Exit(1)
 	}
 
-	// var details p.BookDetails
-	var metadata p.Metadata
-	// If there is no ASIN, create details manually using openbook
-	if asin == "" {
+	// Reads the book, its metadata and its audio files
+	book, asin, metadata, files := loadBook(ctx, inputDir)
 
-		metadata, err = p.GetMetadataLocal(book)
+	// Gets the encoder settings for each of the outputs
+	source := p.SpineBitrate(book)
+	if inputFile != "" {
+		source = p.SourceBitrate(ctx, inputFile)
+	}
+	for i := range targets {
+		err = setEncoder(ctx, &targets[i], source)
 		if err != nil {
-			fmt.Println("Error getting metadata (No ASIN):", err)
+			fmt.Println("Error checking encoder for "+targets[i].ToString()+":", err)
 			os.Exit(1)
 		}
+	}
 
-	} else {
-		metadata, err = p.GetMetadataFromASIN(asin)
+	// Outputs that copy the audio need mp3 audio, which an input file might not have
+	if inputFile != "" {
+		err = checkInputCopy(ctx, targets)
 		if err != nil {
-			fmt.Println("Error getting metadata (ASIN):", err)
+			fmt.Println("Error:", err)
 			os.Exit(1)
 		}
 	}
 
-	outputPath, err := p.GetOutputDirPath(metadata, asin, outPath)
-	if err != nil {
-		fmt.Println("Error getting output dir path:", err)
-		return
+	// Gets the primary author and narrator
+	author, narrator := metadata.Author, metadata.Narrator
+	if inputFile == "" {
+		author = p.GetPrimaryAuthor(book)
+		narrator = p.GetPrimaryNarrator(book)
+	}
+
+	// Gets the directory of each of the outputs
+	outputPaths := make([]string, len(targets))
+	for i, target := range targets {
+		outputPaths[i], err = target.GetDirPath(metadata, asin, outPath)
+		if err != nil {
+			fmt.Println("Error getting output dir path:", err)
+			return
+		}
 	}
 
 	// Prints the book details
 	fmt.Println("=================== Book Details ====================")
 	fmt.Println("Author:", author)
 	fmt.Println("Narrator:", narrator)
-	fmt.Println("Directory:", jsonDir)
+	if inputFile != "" {
+		fmt.Println("Input File:", inputFile)
+	} else {
+		fmt.Println("Directory:", inputDir)
+	}
 	fmt.Println("Output Directory:", outPath)
-	fmt.Println("Output Path:", outputPath)
-	fmt.Println("Format:", format)
 	if asin != "" {
 		fmt.Println("ASIN:", asin)
 	} else {
 		fmt.Println("ASIN: Book does not have an ASIN")
 	}
-	if single {
-		fmt.Println("Output Type: Single File")
-	} else {
-		fmt.Println("Output Type: Multiple Files")
-	}
-	if audibleChapters {
+	if chaptersFile != "" {
+		fmt.Println("Chapters File:", chaptersFile)
+	} else if autoChapters {
+		fmt.Println("Auto Chapters: Enabled")
+	} else if hybridChapters {
+		fmt.Println("Audible Chapters: Titles Only")
+	} else if audibleChapters {
 		fmt.Println("Audible Chapters: Enabled")
 	} else {
 		fmt.Println("Audible Chapters: Disabled")
 	}
+	if snapSilence {
+		fmt.Println("Snap To Silence: Within", snapWindow)
+	} else {
+		fmt.Println("Snap To Silence: Disabled")
+	}
+	fmt.Println("Loudness:", loudness.Mode)
+	for i, target := range targets {
+		fmt.Println("---------------------- Output ----------------------")
+		fmt.Println("Output Path:", outputPaths[i])
+		fmt.Println("Format:", target.Format.Name)
+		if target.Format.IsTranscoded() {
+			fmt.Println("Encoder:", target.Encoder.ToString())
+		}
+		if target.Single {
+			fmt.Println("Output Type: Single File")
+		} else {
+			fmt.Println("Output Type: Multiple Files")
+		}
+	}
 	fmt.Println("=====================================================")
 
 	// ------------ Starts Destructive Code ------------
 
-	// Gets a list of all the .mp3 files in the jsonDir
-	files, err := p.GetAllMp3Files(jsonDir)
+	// Gets the chapters, and runs them through the rules, title cleanup and silence snapping
+	chapters, err := resolveChapters(ctx, book, files, metadata, titles)
 	if err != nil {
-		fmt.Println("Error getting list of .mp3 files:", err)
-		return
+		fmt.Println("Error getting chapters:", err)
+		os.Exit(1)
 	}
 
-	// Checks if the folder exists and creates it if it does not
-	if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-		err := os.MkdirAll(outputPath, 0755)
-		if err != nil {
-			fmt.Println("Error creating directory:", err)
-			return
-		}
-	}
+	metadata.Chapters = chapters
 
-	// Check if the user wants to use audible chapters or not
-	var chapters []p.Chapter
-	if audibleChapters {
-		chapters, err = prov.GetAudibleChapters(metadata.ASIN)
+	// Measures the loudness of the whole book once, it is used for every output
+	var stats p.LoudnessStats
+	if loudness.Mode != "off" {
+		stats, err = p.MeasureLoudness(ctx, files, loudness)
 		if err != nil {
-			fmt.Println("Error getting audible chapters:", err)
+			fmt.Println("Error measuring loudness:", err)
 			os.Exit(1)
 		}
+		fmt.Println("Loudness:", stats.ToString())
+	}
+
+	// Hashes the audio files, so a rerun notices if they changed
+	inputs, err := p.HashInputs(files)
+	if err != nil {
+		fmt.Println("Error hashing input files:", err)
+		os.Exit(1)
+	}
 
-		if chapters == nil {
-			fmt.Println("No audible chapters found, using local chapters")
-			chapters, err = p.GetChaptersLocal(book, files)
+	// Makes each of the outputs from the same metadata and chapters, each output directory has a manifest of what was finished
+	manifests := map[string]*p.Manifest{}
+	for i, target := range targets {
+		manifest, ok := manifests[outputPaths[i]]
+		if !ok {
+			manifest, err = p.ReadManifest(outputPaths[i])
 			if err != nil {
-				fmt.Println("Error getting local chapters:", err)
+				fmt.Println("Error:", err)
 				os.Exit(1)
 			}
+			manifest.Prepare("libby-chapterizer "+version, asin, metadata.Title, inputs, metadata.Chapters, force)
+			manifests[outputPaths[i]] = manifest
+		}
+
+		target, targetMeta := applyLoudness(target, metadata, loudness, stats)
+		err = makeOutput(ctx, target, files, targetMeta, asin, outputPaths[i], manifest)
+		if err != nil && ctx.Err() != nil {
+			fmt.Println("Stopped, the partial files were removed and the finished files are kept, run the same command again to resume")
+			os.Exit(130)
+		} else if err != nil {
+			fmt.Println("Error making "+target.ToString()+" output:\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// getInputDir checks the path to the openbook.json, or to the input file, and returns the directory it is in.
+func getInputDir() string {
+
+	// Checks the input file, which is used instead of an openbook.json
+	if inputFile != "" {
+		if _, err := os.Stat(inputFile); err != nil {
+			fmt.Println("Error: input file is not valid:", err)
+			os.Exit(1)
+		}
+		inputFile = filepath.ToSlash(inputFile)
+		return path.Dir(inputFile)
+	}
+
+	// Checks to see if the jsonPath was specified
+	if jsonPath == "" {
+		fmt.Println("Error: path to openbook.json (or --input) was not specified")
+		os.Exit(1)
+	}
+
+	// Checks to see if the jsonPath is valid
+	_, err := os.Stat(jsonPath)
+	if os.IsNotExist(err) {
+		fmt.Println("Error: path to openbook.json is not valid")
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Println("Error!:", err)
+		os.Exit(1)
+	}
+
+	// Gets the directory path from the json path, converst to *nix path (if windows)
+	jsonPath = filepath.ToSlash(jsonPath)
+	return path.Dir(jsonPath)
+}
+
+// loadBook reads the book from the openbook.json, or from the audiobook file given with --input.
+// It returns the openbook (empty with --input), the ASIN, the metadata and the audio files.
+func loadBook(ctx context.Context, inputDir string) (p.Openbook, string, p.Metadata, []string) {
+
+	var book p.Openbook
+
+	// Reads the tags and chapters of the input file
+	if inputFile != "" {
+		metadata, err := p.ReadAudiobookFile(ctx, inputFile)
+		if err != nil {
+			fmt.Println("Error reading input file:", err)
+			os.Exit(1)
+		}
+		return book, metadata.ASIN, metadata, []string{inputFile}
+	}
+
+	// Converts the JSON file to an Openbook
+	book, err := p.JSONFileToOpenBook(jsonPath)
+	if err != nil {
+		fmt.Println("Error: Unable to convert JSON file to Openbook!\n", err)
+		os.Exit(1)
+	}
+
+	// Gets a list of all the .mp3 files in the inputDir
+	files, err := p.GetAllMp3Files(inputDir)
+	if err != nil {
+		fmt.Println("Error getting list of .mp3 files:", err)
+		os.Exit(1)
+	}
+
+	// Reads the ID3 tags of the parts, and checks they match the openbook
+	tags, err := prov.ReadPartTags(files)
+	if err != nil {
+		fmt.Println("Warning: unable to read the ID3 tags of the parts:", err)
+	}
+	for _, warning := range prov.CheckCreators(book, tags) {
+		fmt.Println("Warning:", warning)
+	}
+
+	// Gets the ASIN and the metadata, the tags are used if the openbook has no author
+	author, narrator := p.GetPrimaryAuthor(book), p.GetPrimaryNarrator(book)
+	if author == "" {
+		author = tags.Artist
+	}
+	asin, metadata := getBookMetadata(ctx, book, author, narrator)
+
+	// Fills the gaps in the metadata from the tags
+	prov.FillMetadata(&metadata, tags)
+
+	return book, asin, metadata, files
+}
+
+// checkInputCopy checks the input file has mp3 audio if any of the outputs copy the audio.
+func checkInputCopy(ctx context.Context, targets []p.OutputTarget) error {
+
+	result, err := p.ProbeFile(ctx, inputFile)
+	if err != nil {
+		return err
+	}
+	info, err := result.AudioStream()
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		if !target.Format.IsTranscoded() && info.Codec != "mp3" {
+			return fmt.Errorf("the %s output copies the audio, but the input file is %s, not mp3", target.ToString(), info.Codec)
+		}
+	}
+
+	return nil
+}
+
+// getBookMetadata looks up the ASIN of the book, and gets the metadata from Audible (or the openbook without one).
+func getBookMetadata(ctx context.Context, book p.Openbook, author, narrator string) (string, p.Metadata) {
+
+	// Gets the ASIN
+	asin, err := prov.GetBook(ctx, book.Title.Main, author, narrator, book.CalculateRuntime())
+	if err != nil {
+		fmt.Println("Error getting book:", err)
+		os.Exit(1)
+	}
+
+	// var details p.BookDetails
+	var metadata p.Metadata
+	// If there is no ASIN, create details manually using openbook
+	if asin == "" {
+
+		metadata, err = p.GetMetadataLocal(book)
+		if err != nil {
+			fmt.Println("Error getting metadata (No ASIN):", err)
+			os.Exit(1)
 		}
+
 	} else {
-		chapters, err = p.GetChaptersLocal(book, files)
+		metadata, err = p.GetMetadataFromASIN(ctx, asin)
 		if err != nil {
-			fmt.Println("Error getting local chapters:", err)
+			fmt.Println("Error getting metadata (ASIN):", err)
 			os.Exit(1)
 		}
 	}
 
-	metadata.Chapters = chapters
+	return asin, metadata
+}
 
-	// Check if the output will be a single file or not
-	if single {
+// getOutputTargets parses the --output flags, or builds a single target from --format and --single.
+func getOutputTargets() ([]p.OutputTarget, error) {
 
-		var outputFile string
-		title := p.NormalizeName(metadata.Title)
-		if asin == "" {
-			outputFile = path.Join(outputPath, fmt.Sprintf("%s.%s", title, format))
-		} else {
-			outputFile = path.Join(outputPath, fmt.Sprintf("%s (%s).%s", title, asin, format))
+	// Uses the legacy flags if no outputs were specified
+	if len(outputs) == 0 {
+		layout := "split"
+		if single {
+			layout = "single"
+		}
+		target, err := p.ParseOutputTarget(format + ":" + layout)
+		if err != nil {
+			return nil, err
 		}
+		return []p.OutputTarget{target}, nil
+	}
 
-		if format == "mp3" {
+	// Parses each of the outputs
+	var targets []p.OutputTarget
+	for _, spec := range outputs {
+		target, err := p.ParseOutputTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
 
-			// Output single mp3, with limited metadata
-			p.MakeCombinedMP3(files, metadata, outputFile)
+	return targets, nil
+}
 
-		} else {
-			fmt.Println("Making single m4b file")
+// setEncoder builds the encoder settings of the output from the preset and any overrides.
+// The source bitrate (in kbps, 0 if unknown) is used by the auto bitrate.
+func setEncoder(ctx context.Context, target *p.OutputTarget, source int) error {
 
-			ffmetadata := metadata.ToFFMPEGMetadata()
+	// Gets the encoder settings from the preset and applies any overrides
+	enc, err := p.GetEncoderPreset(preset)
+	if err != nil {
+		return err
+	}
+	if codec != "" {
+		enc.Codec = codec
 
-			// Create the file
-			file, err := os.Create(outputPath + "/ffmetadata.txt")
+		// Lossless codecs have no bitrate or quality, so only the ones passed with the flags are checked
+		if codec == "copy" || codec == "flac" {
+			enc.Bitrate, enc.Quality, enc.Auto = 0, 0, false
+		}
+	}
+	if bitrate != "" {
+		enc.Bitrate, enc.Auto, err = p.ParseBitrate(bitrate)
+		if err != nil {
+			return err
+		}
+	}
+	if quality > 0 {
+		// VBR replaces the bitrate of the preset
+		enc.Quality = quality
+		enc.Bitrate = 0
+		enc.Auto = false
+	}
+	if sampleRate > 0 {
+		enc.SampleRate = sampleRate
+	}
+	if channels > 0 {
+		enc.Channels = channels
+	}
+
+	// Adjusts the codec to one the output format supports
+	enc, err = target.Format.AdaptEncoder(enc, codec != "")
+	if err != nil {
+		return err
+	}
+
+	// Picks the bitrate from the source if auto is enabled
+	enc = enc.ResolveAutoBitrate(source)
+
+	// Checks the encoder is valid and supported by ffmpeg (mp3 output is not transcoded)
+	if target.Format.IsTranscoded() {
+		enc, err = p.CheckEncoder(ctx, enc)
+		if err != nil {
+			return err
+		}
+
+		// Lossless output falls back to transcoding at the source bitrate if the audio can't be copied
+		if enc.IsLossless() {
+			target.Fallback, err = p.CheckEncoder(ctx, p.EncoderPresets["auto"].ResolveAutoBitrate(source))
 			if err != nil {
-				fmt.Println("Error creating ffmetadata file:", err)
-				os.Exit(1)
+				return fmt.Errorf("error checking fallback encoder: %w", err)
 			}
-			defer file.Close()
+		}
+	}
+
+	target.Encoder = enc
+	return nil
+}
+
+// applyLoudness adds the loudness normalization filter, or the ReplayGain tags, to an output.
+// Outputs that copy the audio can't be normalized, so they are tagged instead.
+func applyLoudness(target p.OutputTarget, metadata p.Metadata, loudness p.LoudnessOptions, stats p.LoudnessStats) (p.OutputTarget, p.Metadata) {
 
-			// Writes the contents of ffmetadata out to the file
-			_, err = file.WriteString(ffmetadata)
+	if loudness.Mode == "off" {
+		return target, metadata
+	}
+
+	// Normalizes the audio if the output is transcoded
+	if loudness.Mode == "normalize" {
+		if target.Format.IsTranscoded() && !target.Encoder.IsLossless() {
+			target.Encoder.Filter = stats.Filter(loudness)
+			fmt.Printf("Normalizing %s with a gain of %.2f dB\n", target.ToString(), stats.Gain(loudness))
+			return target, metadata
+		}
+		fmt.Println("The audio of " + target.ToString() + " is copied and can't be normalized, writing ReplayGain tags instead")
+	}
+
+	// Copies the tags, so the other outputs are not changed
+	tags := map[string]string{}
+	for key, value := range metadata.Tags {
+		tags[key] = value
+	}
+	for key, value := range stats.ReplayGainTags() {
+		tags[key] = value
+	}
+	metadata.Tags = tags
+
+	return target, metadata
+}
+
+// makeOutput writes a single output of the book to its output directory, skipping the files the manifest
+// records as finished. The files are written to a staging directory, and each is moved into place under the
+// overwrite policy and recorded in the manifest once it passes the output check.
+func makeOutput(ctx context.Context, target p.OutputTarget, files []string, metadata p.Metadata, asin, outputPath string, manifest *p.Manifest) error {
+
+	// Checks if the folder exists and creates it if it does not
+	if _, err := os.Stat(outputPath); os.IsNotExist(err) {
+		err := os.MkdirAll(outputPath, 0755)
+		if err != nil {
+			return fmt.Errorf("error creating directory: %w", err)
+		}
+	}
+
+	// Plans the files of the output, and keeps the ones a previous run finished
+	opts := p.VerifyOptions{ToleranceMs: int(checkTolerance.Milliseconds())}
+	planned := manifest.PlanOutput(ctx, target, metadata, asin, outputPath, opts)
+	if planned.Complete {
+		fmt.Println("Skipping " + target.ToString() + ", it was finished by a previous run (use --force to make it again)")
+		return nil
+	}
+	if done := len(planned.Files) - planned.Remaining(); done > 0 {
+		fmt.Printf("Resuming %s, %d of %d files were finished by a previous run\n", target.ToString(), done, len(planned.Files))
+	}
+
+	// Applies the overwrite policy to the files that already exist, but were not finished by a previous run
+	policy := p.OverwritePolicy(overwrite)
+	skip := map[int]bool{}
+	for i, file := range planned.Files {
+		if file.Complete {
+			continue
+		}
+		ok, err := policy.CanWrite(path.Join(outputPath, file.Path))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("Skipping " + file.Path + ", it already exists")
+			skip[i] = true
+		}
+	}
+	if len(skip) == planned.Remaining() {
+		return nil
+	}
+
+	if err := manifest.Save(); err != nil {
+		return err
+	}
+
+	// Writes the files to a staging directory, which is removed with anything left in it once the output is done
+	// (unless a file failed the check, then it is kept so the file can be looked at)
+	staging, err := p.NewStaging(outputPath, policy)
+	if err != nil {
+		return err
+	}
+	defer staging.Remove()
+
+	enc := target.Encoder
+	lossless := enc.IsLossless() && target.Format.IsTranscoded()
+
+	// Check if the output will be a single file or not
+	if target.Single {
+
+		name := planned.Files[0].Path
+		outputFile := staging.Path(name)
+
+		fmt.Println("Making single " + target.Format.Name + " file")
+
+		// Writes the contents of ffmetadata out to the file
+		metadataFile := staging.Path("ffmetadata.txt")
+		err := os.WriteFile(metadataFile, []byte(metadata.ToFFMPEGMetadata()), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing ffmetadata file: %w", err)
+		}
+
+		// Output single file with metadata
+		if lossless {
+			err = p.MakeCombinedFileLossless(ctx, files, metadataFile, outputFile, len(metadata.Chapters), target.Format, target.Fallback)
+		} else {
+			err = p.MakeCombinedFile(ctx, files, metadataFile, outputFile, target.Format, enc)
+		}
+		if err != nil {
+			return fmt.Errorf("error making single %s file: %w", target.Format.Name, err)
+		}
+
+		// Rewrites the tags and chapters of mp4 files natively, so they don't depend on the version of ffmpeg
+		if target.Format.Muxer == "ipod" {
+			err = p.WriteMP4Metadata(outputFile, metadata, metadata.Chapters)
 			if err != nil {
-				fmt.Println("Error writing ffmetadata file:", err)
-				os.Exit(1)
+				return fmt.Errorf("error writing %s tags and chapters: %w", target.Format.Name, err)
 			}
+		}
 
-			// Output single m4b with metadata
-			err = p.MakeCombinedM4B(files, outputPath+"/ffmetadata.txt", outputFile)
+		// Writes the chapters to a separate file if the format can't hold them
+		var companions []string
+		if target.Format.ChapterSidecar {
+			err = p.WriteChapterSidecar(outputFile, metadata.Chapters)
 			if err != nil {
-				fmt.Println("Error making single m4b file:", err)
-				os.Exit(1)
+				return err
 			}
+			companions = append(companions, strings.TrimSuffix(name, path.Ext(name))+".chapters.txt")
+		}
 
+		// Checks the file, and moves it into place
+		if !noCheck {
+			err = staging.Check(ctx, name, target.Format, planned.Files[0].LengthMs, metadata.Chapters, opts)
+			if err != nil {
+				return err
+			}
+		}
+		placed, err := staging.Place(name, companions...)
+		if err != nil || placed == "" {
+			return err
+		}
+		err = manifest.Finish(planned, 0, placed)
+		if err != nil {
+			return err
 		}
 
 	} else {
 
-		//
-		if format == "mp3" {
-			// Output split mp3s
-			err = p.MakeSplitMP3Files(files, chapters, metadata, outputPath)
-			if err != nil {
-				fmt.Println("Error making split mp3 files:\n", err)
-				os.Exit(1)
+		// Checks each of the files, and moves it into place as soon as it is written
+		progress := manifest.Progress(planned, func(index int) (string, error) {
+			file := planned.Files[index]
+			if noCheck {
+				return staging.Place(file.Path)
 			}
-		} else {
-			// Output split m4bs
-			err = p.MakeSplitM4BFiles(files, chapters, metadata, outputPath)
-			if err != nil {
-				fmt.Println("Error making split m4b files:\n", err)
-				os.Exit(1)
+			if err := staging.Check(ctx, file.Path, target.Format, file.LengthMs, nil, opts); err != nil {
+				return "", err
 			}
+			return staging.Place(file.Path)
+		})
+		for i := range skip {
+			progress.Skip[i] = true
+		}
+
+		// Output split files
+		if lossless {
+			err = p.MakeSplitFilesLossless(ctx, files, metadata.Chapters, metadata, staging.Dir, target.Format, target.Fallback, progress)
+		} else {
+			err = p.MakeSplitFiles(ctx, files, metadata.Chapters, metadata, staging.Dir, target.Format, enc, progress)
+		}
+		if err != nil {
+			return fmt.Errorf("error making split %s files: %w", target.Format.Name, err)
 		}
 
 	}
+
+	return nil
 }
@@ -0,0 +1,148 @@
+// This file is responsible for aligning Audible chapter offsets to the timeline of the Libby audio.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ErrAlignmentDrift is returned when the Audible chapters can't be aligned to the local audio reliably.
+var ErrAlignmentDrift = errors.New("audible chapters drift too far from the local audio")
+
+// ChapterAlignment describes how a single Audible chapter was moved onto the local timeline.
+type ChapterAlignment struct {
+	Index      int
+	Title      string
+	OriginalMs int // Start offset from Audible
+	AlignedMs  int // Start offset on the local timeline
+	ErrorMs    int  // Estimated error of the aligned offset
+	Merged     bool // The chapter ended up with no length after scaling, and was merged into the one before it
+}
+
+// AlignAudibleChapters moves the Audible chapter offsets onto the timeline of the local audio.
+// The Audible edition starts with a brand intro and ends with a brand outro the Libby edition does
+// not have, so the intro is removed from every offset, and what is left is scaled by the ratio of the
+// local duration to the Audible duration (without intro and outro).
+//
+// The local audio can differ anywhere before a chapter, so its real start lies between the shifted offset
+// (the difference is all after it) and the shifted offset plus the runtime difference (all before it). The
+// estimated error of each chapter is the distance from the aligned offset to the furthest end of that range.
+// A chapter that is left with no length after scaling is merged into the one before it.
+// If the runtimes differ by more than maxDriftMs, or Audible does not mark the chapters as accurate,
+// the aligned chapters are still returned along with ErrAlignmentDrift.
+func AlignAudibleChapters(info Chapters, localMs int, maxDriftMs int) ([]Chapter, []ChapterAlignment, error) {
+
+	if len(info.Chapters) == 0 {
+		return nil, nil, fmt.Errorf("no audible chapters to align")
+	}
+	if localMs <= 0 {
+		return nil, nil, fmt.Errorf("local duration must be known to align chapters")
+	}
+
+	// Gets the Audible runtime, from the last chapter if it is not listed
+	audibleMs := info.RuntimeLengthMs
+	if audibleMs == 0 {
+		last := info.Chapters[len(info.Chapters)-1]
+		audibleMs = last.StartOffsetMs + last.LengthMs
+	}
+
+	// Gets the length of the content, without the brand intro and outro
+	intro := info.BrandIntroDurationMs
+	contentMs := audibleMs - intro - info.BrandOutroDurationMs
+	if contentMs <= 0 {
+		return nil, nil, fmt.Errorf("audible runtime is shorter than the brand intro and outro")
+	}
+
+	// Scales the offsets to the local duration
+	scale := float64(localMs) / float64(contentMs)
+	drift := localMs - contentMs
+
+	var chapters []Chapter
+	var report []ChapterAlignment
+	for i, chapter := range info.Chapters {
+
+		// Removes the brand intro, the first chapter starts at the beginning of the local audio
+		shifted := chapter.StartOffsetMs - intro
+		if shifted < 0 || i == 0 {
+			shifted = 0
+		}
+
+		aligned := int(math.Round(float64(shifted) * scale))
+		item := ChapterAlignment{
+			Index:      i + 1,
+			Title:      chapter.Title,
+			OriginalMs: chapter.StartOffsetMs,
+			AlignedMs:  aligned,
+		}
+
+		// Gets the range the real start is in, inside the local audio
+		if i > 0 {
+			lower := max(min(shifted, shifted+drift), 0)
+			upper := min(max(shifted, shifted+drift), localMs)
+			item.ErrorMs = max(int(math.Abs(float64(aligned-lower))), int(math.Abs(float64(aligned-upper))))
+		}
+
+		// Merges a chapter that doesn't start after the one before it, or starts at the end of the local audio
+		if len(chapters) > 0 && (aligned <= chapters[len(chapters)-1].StartOffsetMs || aligned >= localMs) {
+			item.Merged = true
+			report = append(report, item)
+			continue
+		}
+
+		chapters = append(chapters, Chapter{
+			StartOffsetMs:  aligned,
+			StartOffsetSec: aligned / 1000,
+			Title:          chapter.Title,
+		})
+		report = append(report, item)
+	}
+
+	// Calculates the length of each chapter from the start of the next one
+	for i := range chapters {
+		if i < len(chapters)-1 {
+			chapters[i].LengthMs = chapters[i+1].StartOffsetMs - chapters[i].StartOffsetMs
+		} else {
+			chapters[i].LengthMs = localMs - chapters[i].StartOffsetMs
+		}
+	}
+
+	// Checks the alignment can be trusted
+	if int(math.Abs(float64(drift))) > maxDriftMs {
+		return chapters, report, fmt.Errorf("%w: runtimes differ by %s (max %s)", ErrAlignmentDrift, formatOffset(drift), formatOffset(maxDriftMs))
+	}
+	if !info.IsAccurate {
+		return chapters, report, fmt.Errorf("%w: audible does not mark the chapters as accurate", ErrAlignmentDrift)
+	}
+
+	return chapters, report, nil
+}
+
+// FormatAlignmentReport returns a table of the chapter alignment, for printing.
+func FormatAlignmentReport(report []ChapterAlignment) string {
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%-4s %-13s %-13s %-10s %s\n", "#", "Audible", "Aligned", "Error", "Title"))
+	for _, item := range report {
+		aligned := CalculateDuration(item.AlignedMs).ToString()
+		if item.Merged {
+			aligned = "merged"
+		}
+		sb.WriteString(fmt.Sprintf("%-4d %-13s %-13s %-10s %s\n",
+			item.Index,
+			CalculateDuration(item.OriginalMs).ToString(),
+			aligned,
+			"±"+formatOffset(item.ErrorMs),
+			item.Title,
+		))
+	}
+
+	return sb.String()
+}
+
+// formatOffset formats a number of milliseconds as seconds, e.g. "-1.25s".
+func formatOffset(ms int) string {
+	return fmt.Sprintf("%.2fs", float64(ms)/1000)
+}
@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAlignAudibleChapters(t *testing.T) {
+
+	// The Audible edition has a 2s intro and a 1s outro, so it holds 100s of content
+	info := func(starts ...int) Chapters {
+		chapters := Chapters{BrandIntroDurationMs: 2000, BrandOutroDurationMs: 1000, RuntimeLengthMs: 103000, IsAccurate: true}
+		for i, start := range starts {
+			chapters.Chapters = append(chapters.Chapters, Chapter{Title: string(rune('A' + i)), StartOffsetMs: start})
+		}
+		return chapters
+	}
+
+	tests := []struct {
+		name    string
+		info    Chapters
+		localMs int
+		starts  []int // Aligned starts of the chapters that are kept
+		lengths []int
+		errors  []int // Estimated error of each Audible chapter
+		merged  []bool
+	}{
+		{
+			name:    "longer local audio",
+			info:    info(0, 52000, 102000),
+			localMs: 110000,
+			starts:  []int{0, 55000},
+			lengths: []int{55000, 55000},
+			errors:  []int{0, 5000, 10000},
+			merged:  []bool{false, false, true},
+		},
+		{
+			name:    "shorter local audio",
+			info:    info(0, 12000, 52000),
+			localMs: 90000,
+			starts:  []int{0, 9000, 45000},
+			lengths: []int{9000, 36000, 45000},
+			errors:  []int{0, 9000, 5000},
+			merged:  []bool{false, false, false},
+		},
+		{
+			name:    "chapters at the same start",
+			info:    info(0, 32000, 32000, 62000),
+			localMs: 100000,
+			starts:  []int{0, 30000, 60000},
+			lengths: []int{30000, 30000, 40000},
+			errors:  []int{0, 0, 0, 0},
+			merged:  []bool{false, false, true, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			chapters, report, err := AlignAudibleChapters(test.info, test.localMs, 20000)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var starts, lengths []int
+			for _, chapter := range chapters {
+				starts = append(starts, chapter.StartOffsetMs)
+				lengths = append(lengths, chapter.LengthMs)
+			}
+			if !reflect.DeepEqual(starts, test.starts) || !reflect.DeepEqual(lengths, test.lengths) {
+				t.Errorf("starts = %v lengths = %v, want %v and %v", starts, lengths, test.starts, test.lengths)
+			}
+
+			var errs []int
+			var merged []bool
+			for _, item := range report {
+				errs = append(errs, item.ErrorMs)
+				merged = append(merged, item.Merged)
+			}
+			if !reflect.DeepEqual(errs, test.errors) || !reflect.DeepEqual(merged, test.merged) {
+				t.Errorf("errors = %v merged = %v, want %v and %v", errs, merged, test.errors, test.merged)
+			}
+		})
+	}
+}
+
+func TestAlignAudibleChaptersDrift(t *testing.T) {
+
+	info := Chapters{RuntimeLengthMs: 100000, IsAccurate: true, Chapters: []Chapter{{Title: "A"}, {Title: "B", StartOffsetMs: 50000}}}
+	if _, _, err := AlignAudibleChapters(info, 130000, 20000); !errors.Is(err, ErrAlignmentDrift) {
+		t.Errorf("err = %v for a 30s difference, want ErrAlignmentDrift", err)
+	}
+
+	info.IsAccurate = false
+	if _, _, err := AlignAudibleChapters(info, 100000, 20000); !errors.Is(err, ErrAlignmentDrift) {
+		t.Errorf("err = %v for inaccurate chapters, want ErrAlignmentDrift", err)
+	}
+}
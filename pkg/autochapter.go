@@ -0,0 +1,129 @@
+// This file is responsible for detecting chapters from the silences in the audio, for books without a usable table of contents.
+
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// genericTitleRegex matches the titles of a table of contents that only lists the files, e.g. "Track 3".
+var genericTitleRegex = regexp.MustCompile(`(?i)^\s*(track|part|file|disc|mp3)?\s*[-#.]?\s*\d+\s*$`)
+
+// AutoChapterOptions describes the chapters that are detected from the silences.
+type AutoChapterOptions struct {
+	MinLengthMs int // Shortest chapter that is created
+	MaxLengthMs int // Longest chapter before it is split at the best silence available
+	MinGapMs    int // Shortest silence that is treated as a chapter break
+}
+
+// IsUsableTOC checks if the table of contents of the openbook has real chapters.
+// A table of contents is not usable when it is empty, or only lists the files with titles like "Track 1".
+func IsUsableTOC(book Openbook) bool {
+
+	if len(book.Nav.Toc) == 0 {
+		return false
+	}
+
+	for _, item := range book.Nav.Toc {
+		// An offset inside a file means the entry marks a real chapter
+		if strings.Contains(item.Path, "#") {
+			return true
+		}
+		if !genericTitleRegex.MatchString(strings.Replace(item.Title, `"`, "", -1)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AutoChapters proposes chapters from the silences in the audio.
+// Each chapter ends at the first silence of at least MinGapMs after MinLengthMs, and if there is none before
+// MaxLengthMs, at the longest silence of any length before then (or exactly at MaxLengthMs if there is none).
+// The chapters are titled "Chapter N".
+func AutoChapters(silences []Silence, totalMs int, opts AutoChapterOptions) ([]Chapter, error) {
+
+	if totalMs <= 0 {
+		return nil, fmt.Errorf("duration must be known to detect chapters")
+	}
+	if opts.MinLengthMs <= 0 || opts.MaxLengthMs <= opts.MinLengthMs {
+		return nil, fmt.Errorf("maximum chapter length must be longer than the minimum")
+	}
+
+	// Finds the start of each chapter
+	starts := []int{0}
+	start := 0
+	for {
+		// The last chapter can't be shorter than the minimum either
+		lower := start + opts.MinLengthMs
+		upper := min(start+opts.MaxLengthMs, totalMs-opts.MinLengthMs)
+		if lower > upper {
+			break
+		}
+
+		// Uses the first long silence
+		next := -1
+		for _, silence := range silences {
+			mid := silence.MidMs()
+			if mid >= lower && mid <= upper && silence.DurationMs() >= opts.MinGapMs {
+				next = mid
+				break
+			}
+		}
+
+		if next == -1 {
+			// The rest of the audio fits in a single chapter
+			if totalMs-start <= opts.MaxLengthMs {
+				break
+			}
+
+			// Uses the longest silence before the maximum length, or cuts at the maximum length
+			next = upper
+			longest := 0
+			for _, silence := range silences {
+				mid := silence.MidMs()
+				if mid >= lower && mid <= upper && silence.DurationMs() > longest {
+					next = mid
+					longest = silence.DurationMs()
+				}
+			}
+		}
+
+		starts = append(starts, next)
+		start = next
+	}
+
+	// Creates the chapters from the starts
+	var chapters []Chapter
+	for i, start := range starts {
+		end := totalMs
+		if i < len(starts)-1 {
+			end = starts[i+1]
+		}
+		chapters = append(chapters, Chapter{
+			LengthMs:       end - start,
+			StartOffsetMs:  start,
+			StartOffsetSec: start / 1000,
+			Title:          fmt.Sprintf("Chapter %d", i+1),
+		})
+	}
+
+	return chapters, nil
+}
+
+// ApplyChapterTitles copies the titles onto the chapters, if there are as many titles as chapters.
+// It returns false, and leaves the chapters unchanged, if the counts do not line up.
+func ApplyChapterTitles(chapters []Chapter, titled []Chapter) bool {
+
+	if len(chapters) != len(titled) {
+		return false
+	}
+
+	for i := range chapters {
+		chapters[i].Title = titled[i].Title
+	}
+
+	return true
+}
@@ -0,0 +1,166 @@
+// This file is responsible for checking the environment the tool runs in, ffmpeg and ffprobe, the metadata
+// hosts and the output directory, for the doctor command.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinFFmpegVersion is the oldest major version of ffmpeg (and ffprobe) the tool is known to work with.
+const MinFFmpegVersion = 4
+
+// DoctorEncoders are the ffmpeg encoders the outputs use, and what is used instead of the optional ones.
+var DoctorEncoders = []DoctorComponent{
+	{Name: "aac", Use: "m4b, m4a and aac outputs"},
+	{Name: "libfdk_aac", Use: "the libfdk_aac codec", Fallback: "the aac encoder is used instead"},
+	{Name: "libopus", Use: "opus outputs and the opus codec"},
+	{Name: "flac", Use: "flac outputs"},
+}
+
+// DoctorMuxers are the ffmpeg muxers the outputs are written with.
+var DoctorMuxers = []DoctorComponent{
+	{Name: "ipod", Use: "m4b and m4a outputs"},
+	{Name: "mp4", Use: "m4b and m4a outputs with opus audio"},
+	{Name: "mp3", Use: "single mp3 outputs"},
+	{Name: "ogg", Use: "opus outputs"},
+	{Name: "flac", Use: "flac outputs"},
+	{Name: "adts", Use: "aac outputs"},
+}
+
+// DoctorComponent is an ffmpeg encoder or muxer the doctor command checks for.
+type DoctorComponent struct {
+	Name     string // The name ffmpeg lists it by
+	Use      string // What it is used for
+	Fallback string // What is used instead if it is missing, empty if it is required
+}
+
+var versionRegex = regexp.MustCompile(`^\S+ version (\S+)`)
+var majorVersionRegex = regexp.MustCompile(`^n?(\d+)\.`)
+
+// FindBinary returns the path of the executable, looking up a name without a directory in the PATH.
+func FindBinary(binary string) (string, error) {
+	return exec.LookPath(binary)
+}
+
+// BinaryVersion returns the version ffmpeg or ffprobe reports in the first line of -version.
+func BinaryVersion(ctx context.Context, binary string) (string, error) {
+
+	cmd := newCommand(ctx, binary, "-hide_banner", "-version")
+	stdout, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %s: %w", path.Base(binary), err)
+	}
+
+	line, _, _ := strings.Cut(string(stdout), "\n")
+	match := versionRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return "", fmt.Errorf("unable to read the version from '%s'", strings.TrimSpace(line))
+	}
+
+	return match[1], nil
+}
+
+// MajorVersion returns the major version of an ffmpeg release (e.g. 6 for "6.1.1" or "n6.1"). Builds from git
+// (e.g. "N-113406-g...") have no release version, so false is returned for them.
+func MajorVersion(version string) (int, bool) {
+	match := majorVersionRegex.FindStringSubmatch(version)
+	if match == nil {
+		return 0, false
+	}
+	major, err := strconv.Atoi(match[1])
+	return major, err == nil
+}
+
+// ListFFmpegComponents lists the encoders, decoders or muxers (-encoders, -decoders, -muxers) ffmpeg was built with.
+func ListFFmpegComponents(ctx context.Context, list string) (map[string]bool, error) {
+
+	cmd := newCommand(ctx, FFmpegBinary, "-hide_banner", list)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running ffmpeg command: %w", err)
+	}
+
+	// Each line is formatted as " A....D name  Description", the header ends at the " --" line, and a muxer
+	// can be listed with several names separated by commas
+	components := map[string]bool{}
+	header := true
+	for _, line := range strings.Split(string(stdout), "\n") {
+		fields := strings.Fields(line)
+		if header {
+			header = len(fields) == 0 || !strings.HasPrefix(fields[0], "--")
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range strings.Split(fields[1], ",") {
+			components[name] = true
+		}
+	}
+
+	return components, nil
+}
+
+// CheckEndpoint sends a request to the URL, and returns the status code of the response. Any response means the
+// host is reachable, an error means it is not.
+func CheckEndpoint(ctx context.Context, url string) (int, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %w", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	return response.StatusCode, nil
+}
+
+// CheckWritable checks a file can be created in the directory. If the directory does not exist yet, the closest
+// directory above it that does is checked, as that is where it will be created.
+func CheckWritable(dir string) (string, error) {
+
+	dir = path.Clean(dir)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return dir, fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		} else if !os.IsNotExist(err) {
+			return dir, err
+		}
+		parent := path.Dir(dir)
+		if parent == dir {
+			return dir, err
+		}
+		dir = parent
+	}
+
+	file, err := os.CreateTemp(dir, ".libby-chapterizer-doctor-")
+	if err != nil {
+		return dir, err
+	}
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return dir, err
+	}
+
+	return dir, nil
+}
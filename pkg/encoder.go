@@ -0,0 +1,304 @@
+// This file is responsible for the audio encoder settings used when transcoding.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EncoderOptions describes how the audio stream of an output file is encoded by ffmpeg.
+type EncoderOptions struct {
+	Codec      string  // aac, libfdk_aac, opus, flac or copy (lossless)
+	Bitrate    int     // Constant/target bitrate in kbps, 0 uses Quality instead
+	Quality    float64 // VBR quality (codec specific), only used when Bitrate is 0
+	SampleRate int     // Output sample rate in Hz, 0 keeps the source rate
+	Channels   int     // Output channel count, 0 keeps the source layout
+	Auto       bool    // Picks the bitrate from the source so it is never upsampled
+	Filter     string  // Audio filter applied before encoding, e.g. loudness normalization
+}
+
+// EncoderPresets contains the named encoder settings that can be selected with --preset.
+var EncoderPresets = map[string]EncoderOptions{
+	"default":      {Codec: "aac", Bitrate: 64},
+	"archive":      {Codec: "aac", Bitrate: 128},
+	"phone":        {Codec: "aac", Bitrate: 64, SampleRate: 44100},
+	"speech-small": {Codec: "aac", Bitrate: 32, SampleRate: 22050, Channels: 1},
+	"auto":         {Codec: "aac", Auto: true},
+	"lossless":     {Codec: "copy"},
+}
+
+// opusSampleRates contains the sample rates supported by libopus.
+var opusSampleRates = []int{8000, 12000, 16000, 24000, 48000}
+
+// GetEncoderPreset returns the encoder options for the preset with the given name.
+func GetEncoderPreset(name string) (EncoderOptions, error) {
+
+	// Looks up the preset
+	preset, ok := EncoderPresets[strings.ToLower(name)]
+	if !ok {
+
+		// Builds a sorted list of the valid names for the error message
+		var names []string
+		for n := range EncoderPresets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return EncoderOptions{}, fmt.Errorf("unknown encoder preset '%s' (valid: %s)", name, strings.Join(names, ", "))
+	}
+
+	return preset, nil
+}
+
+// ParseBitrate parses a bitrate flag value such as "64", "64k", "auto" or "auto:96k".
+// It returns the bitrate in kbps, and whether the bitrate should be picked automatically.
+// With auto the bitrate is the cap of the automatic bitrate, 0 if there is none.
+func ParseBitrate(value string) (int, bool, error) {
+
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	// Auto picks the bitrate from the source, up to the optional cap
+	if value == "auto" {
+		return 0, true, nil
+	}
+	if limit, ok := strings.CutPrefix(value, "auto:"); ok {
+		bitrate, auto, err := ParseBitrate(limit)
+		if err != nil || auto {
+			return 0, false, fmt.Errorf("invalid bitrate '%s'", value)
+		}
+		return bitrate, true, nil
+	}
+
+	// Removes the optional unit
+	value = strings.TrimSuffix(value, "k")
+
+	bitrate, err := strconv.Atoi(value)
+	if err != nil || bitrate <= 0 {
+		return 0, false, fmt.Errorf("invalid bitrate '%s'", value)
+	}
+
+	return bitrate, false, nil
+}
+
+// Encoder returns the name of the ffmpeg encoder for the codec.
+func (e EncoderOptions) Encoder() string {
+	switch e.Codec {
+	case "opus":
+		return "libopus"
+	default:
+		return e.Codec
+	}
+}
+
+// IsLossless checks if the audio stream is copied instead of transcoded.
+func (e EncoderOptions) IsLossless() bool {
+	return e.Codec == "copy"
+}
+
+// SpineBitrate returns the highest bitrate of the files in the openbook spine in kbps, or 0 if none are listed.
+func SpineBitrate(book Openbook) int {
+	source := 0
+	for _, item := range book.Spine {
+		if item.AudioBitrate > source {
+			source = item.AudioBitrate
+		}
+	}
+	return source
+}
+
+// ResolveAutoBitrate picks the bitrate from the bitrate of the source in kbps, if auto is enabled.
+// The default bitrate is used if the source bitrate is not known (0).
+func (e EncoderOptions) ResolveAutoBitrate(source int) EncoderOptions {
+
+	if !e.Auto || e.IsLossless() {
+		return e
+	}
+
+	// Falls back to the default bitrate if the source does not list one
+	if source == 0 {
+		source = EncoderPresets["default"].Bitrate
+	}
+
+	// Caps the bitrate at the one that was requested
+	if e.Bitrate == 0 || source < e.Bitrate {
+		e.Bitrate = source
+	}
+
+	e.Auto = false
+	return e
+}
+
+// Validate checks that the encoder options are valid for the selected codec.
+func (e EncoderOptions) Validate() error {
+
+	switch e.Codec {
+	case "copy":
+		// The audio is not re-encoded, so none of the other options can be applied
+		if e.Bitrate != 0 || e.Quality != 0 || e.SampleRate != 0 || e.Channels != 0 || e.Auto {
+			return fmt.Errorf("lossless output does not support bitrate, quality, sample rate or channel options")
+		}
+		return nil
+	case "flac":
+		// FLAC is lossless, so only the sample rate and channels can be changed
+		if e.Bitrate != 0 || e.Quality != 0 || e.Auto {
+			return fmt.Errorf("flac does not support bitrate or quality options")
+		}
+		return nil
+	case "aac", "libfdk_aac":
+		// Both AAC encoders support any of the options
+	case "opus":
+		// Opus only supports a fixed set of sample rates
+		if e.SampleRate != 0 && !containsInt(opusSampleRates, e.SampleRate) {
+			return fmt.Errorf("opus does not support a sample rate of %d Hz", e.SampleRate)
+		}
+		if e.Bitrate == 0 && !e.Auto {
+			return fmt.Errorf("opus requires a bitrate, quality based VBR is not supported")
+		}
+	default:
+		return fmt.Errorf("unsupported codec '%s' (valid: aac, libfdk_aac, opus, flac, copy)", e.Codec)
+	}
+
+	if e.Bitrate == 0 && e.Quality <= 0 && !e.Auto {
+		return fmt.Errorf("either a bitrate or a VBR quality must be set")
+	}
+
+	if e.Channels < 0 || e.SampleRate < 0 {
+		return fmt.Errorf("channels and sample rate must not be negative")
+	}
+
+	return nil
+}
+
+// ToFFMPEGArgs converts the encoder options to the ffmpeg output arguments.
+func (e EncoderOptions) ToFFMPEGArgs() []string {
+
+	// Sets the encoder
+	args := []string{"-c:a", e.Encoder()}
+
+	// Sets either a bitrate or the codec specific VBR quality
+	if e.Bitrate > 0 {
+		args = append(args, "-b:a", fmt.Sprintf("%dk", e.Bitrate))
+	} else if e.Quality > 0 {
+		switch e.Codec {
+		case "libfdk_aac":
+			args = append(args, "-vbr", strconv.Itoa(int(e.Quality)))
+		default:
+			args = append(args, "-q:a", strconv.FormatFloat(e.Quality, 'f', -1, 64))
+		}
+	}
+
+	// Sets the sample rate and channels, if they were specified
+	if e.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(e.SampleRate))
+	}
+	if e.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(e.Channels))
+	}
+
+	// Sets the audio filter, a copied stream can't be filtered
+	if e.Filter != "" && !e.IsLossless() {
+		args = append(args, "-af", e.Filter)
+	}
+
+	return args
+}
+
+// ToString returns a string representation of the EncoderOptions struct.
+func (e EncoderOptions) ToString() string {
+
+	if e.IsLossless() {
+		return "copy (lossless)"
+	}
+
+	var quality string
+	if e.Codec == "flac" {
+		quality = "lossless"
+	} else if e.Auto {
+		quality = "auto"
+	} else if e.Bitrate > 0 {
+		quality = fmt.Sprintf("%dk", e.Bitrate)
+	} else {
+		quality = fmt.Sprintf("VBR %g", e.Quality)
+	}
+
+	sampleRate := "source"
+	if e.SampleRate > 0 {
+		sampleRate = fmt.Sprintf("%d Hz", e.SampleRate)
+	}
+
+	channels := "source"
+	if e.Channels > 0 {
+		channels = strconv.Itoa(e.Channels)
+	}
+
+	if e.Filter != "" {
+		return fmt.Sprintf("%s, %s, %s, %s channel(s), filter %s", e.Codec, quality, sampleRate, channels, e.Filter)
+	}
+
+	return fmt.Sprintf("%s, %s, %s, %s channel(s)", e.Codec, quality, sampleRate, channels)
+}
+
+// HasEncoder checks if the installed ffmpeg was built with the given encoder.
+func HasEncoder(ctx context.Context, encoder string) (bool, error) {
+
+	encoders, err := ListFFmpegComponents(ctx, "-encoders")
+	if err != nil {
+		return false, err
+	}
+
+	return encoders[encoder], nil
+}
+
+// CheckEncoder validates the encoder options and makes sure ffmpeg supports the encoder.
+// If libfdk_aac is not available, it falls back to the native aac encoder.
+func CheckEncoder(ctx context.Context, e EncoderOptions) (EncoderOptions, error) {
+
+	if err := e.Validate(); err != nil {
+		return e, err
+	}
+
+	// Copying the stream does not need an encoder
+	if e.IsLossless() {
+		return e, nil
+	}
+
+	// Checks that ffmpeg has the encoder
+	ok, err := HasEncoder(ctx, e.Encoder())
+	if err != nil {
+		return e, err
+	}
+
+	if !ok {
+		// libfdk_aac is an optional ffmpeg build dependency, so the native encoder is used instead
+		if e.Codec == "libfdk_aac" {
+			fmt.Println("libfdk_aac is not available in this ffmpeg build, falling back to aac")
+			e.Codec = "aac"
+
+			// The quality scales are different between the two encoders
+			if e.Bitrate == 0 {
+				e.Quality = 0
+				e.Bitrate = EncoderPresets["default"].Bitrate
+			}
+
+			return e, nil
+		}
+
+		return e, fmt.Errorf("ffmpeg was not built with the '%s' encoder", e.Encoder())
+	}
+
+	return e, nil
+}
+
+// containsInt checks if the slice contains the value.
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
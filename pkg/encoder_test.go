@@ -0,0 +1,53 @@
+package pkg
+
+import "testing"
+
+func TestParseBitrate(t *testing.T) {
+
+	tests := []struct {
+		value   string
+		bitrate int
+		auto    bool
+		ok      bool
+	}{
+		{"64", 64, false, true},
+		{" 128K ", 128, false, true},
+		{"auto", 0, true, true},
+		{"auto:96k", 96, true, true},
+		{"AUTO:48", 48, true, true},
+		{"auto:", 0, false, false},
+		{"auto:auto", 0, false, false},
+		{"auto:auto:96k", 0, false, false},
+		{"0", 0, false, false},
+		{"fast", 0, false, false},
+	}
+
+	for _, test := range tests {
+		bitrate, auto, err := ParseBitrate(test.value)
+		if (err == nil) != test.ok || bitrate != test.bitrate || auto != test.auto {
+			t.Errorf("ParseBitrate(%q) = %d, %v, %v, want %d, %v and ok %v", test.value, bitrate, auto, err, test.bitrate, test.auto, test.ok)
+		}
+	}
+}
+
+func TestResolveAutoBitrate(t *testing.T) {
+
+	tests := []struct {
+		options EncoderOptions
+		source  int
+		want    int
+	}{
+		{EncoderOptions{Codec: "aac", Auto: true}, 128, 128},
+		{EncoderOptions{Codec: "aac", Auto: true}, 0, 64},
+		{EncoderOptions{Codec: "aac", Auto: true, Bitrate: 96}, 128, 96},
+		{EncoderOptions{Codec: "aac", Auto: true, Bitrate: 96}, 64, 64},
+		{EncoderOptions{Codec: "aac", Bitrate: 32}, 128, 32},
+	}
+
+	for _, test := range tests {
+		got := test.options.ResolveAutoBitrate(test.source)
+		if got.Bitrate != test.want || got.Auto {
+			t.Errorf("%+v with a %d kbps source = %d kbps (auto %v), want %d", test.options, test.source, got.Bitrate, got.Auto, test.want)
+		}
+	}
+}
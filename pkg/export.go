@@ -0,0 +1,222 @@
+// This file is responsible for exporting the chapters to the chapter formats used by other players and editors.
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChapterExporter writes the chapters of a book in a chapter format.
+type ChapterExporter struct {
+	Name      string
+	Extension string
+	Export    func(chapters []Chapter, meta Metadata) (string, error)
+}
+
+// ChapterExporters contains the supported chapter formats, keyed by name.
+var ChapterExporters = map[string]ChapterExporter{
+	"cue":      {Name: "cue", Extension: "cue", Export: ExportCUE},
+	"mp4chaps": {Name: "mp4chaps", Extension: "chapters.txt", Export: ExportMP4Chaps},
+	"podlove":  {Name: "podlove", Extension: "chapters.json", Export: ExportPodlove},
+	"webvtt":   {Name: "webvtt", Extension: "vtt", Export: ExportWebVTT},
+	"ogm":      {Name: "ogm", Extension: "ogm.txt", Export: ExportOGM},
+	"audacity": {Name: "audacity", Extension: "labels.txt", Export: ExportAudacity},
+	"csv":      {Name: "csv", Extension: "csv", Export: ExportCSV},
+}
+
+// GetChapterExporter returns the exporter for the chapter format with the given name.
+func GetChapterExporter(name string) (ChapterExporter, error) {
+	exporter, ok := ChapterExporters[strings.ToLower(name)]
+	if !ok {
+		return exporter, fmt.Errorf("invalid chapter format '%s' (valid: %s)", name, strings.Join(ChapterFormatNames(), ", "))
+	}
+	return exporter, nil
+}
+
+// ChapterFormatNames returns the names of the supported chapter formats, sorted.
+func ChapterFormatNames() []string {
+	var names []string
+	for name := range ChapterExporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteChapters exports the chapters and writes them to the file.
+func (e ChapterExporter) WriteChapters(chapters []Chapter, meta Metadata, filepath string) error {
+
+	content, err := e.Export(chapters, meta)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing %s chapters: %w", e.Name, err)
+	}
+
+	return nil
+}
+
+// ExportCUE returns the chapters as a CUE sheet, with a track for each chapter of the single mp3 output file.
+// CUE sheets index in frames of 1/75 second.
+func ExportCUE(chapters []Chapter, meta Metadata) (string, error) {
+
+	file := NormalizeName(meta.Title) + ".mp3"
+	if meta.ASIN != "" {
+		file = fmt.Sprintf("%s (%s).mp3", NormalizeName(meta.Title), meta.ASIN)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("PERFORMER %s\n", cueQuote(meta.Author)))
+	sb.WriteString(fmt.Sprintf("TITLE %s\n", cueQuote(meta.Title)))
+	sb.WriteString(fmt.Sprintf("FILE %s MP3\n", cueQuote(file)))
+
+	for i, chapter := range chapters {
+		frames := chapter.StartOffsetMs * 75 / 1000
+		sb.WriteString(fmt.Sprintf("  TRACK %02d AUDIO\n", i+1))
+		sb.WriteString(fmt.Sprintf("    TITLE %s\n", cueQuote(chapter.Title)))
+		sb.WriteString(fmt.Sprintf("    PERFORMER %s\n", cueQuote(meta.Author)))
+		sb.WriteString(fmt.Sprintf("    INDEX 01 %02d:%02d:%02d\n", frames/75/60, frames/75%60, frames%75))
+	}
+
+	return sb.String(), nil
+}
+
+// ExportMP4Chaps returns the chapters in the mp4chaps (Nero) text format, "HH:MM:SS.mmm Title".
+func ExportMP4Chaps(chapters []Chapter, meta Metadata) (string, error) {
+
+	var sb strings.Builder
+	for _, chapter := range chapters {
+		sb.WriteString(CalculateDuration(chapter.StartOffsetMs).ToString() + " " + oneLine(chapter.Title) + "\n")
+	}
+
+	return sb.String(), nil
+}
+
+// ExportPodlove returns the chapters in the Podlove Simple Chapters JSON format.
+func ExportPodlove(chapters []Chapter, meta Metadata) (string, error) {
+
+	type podloveChapter struct {
+		Start string `json:"start"`
+		Title string `json:"title"`
+	}
+	doc := struct {
+		Version  string           `json:"version"`
+		Chapters []podloveChapter `json:"chapters"`
+	}{Version: "1.2"}
+
+	for _, chapter := range chapters {
+		doc.Chapters = append(doc.Chapters, podloveChapter{
+			Start: CalculateDuration(chapter.StartOffsetMs).ToString(),
+			Title: chapter.Title,
+		})
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error encoding podlove chapters: %w", err)
+	}
+
+	return string(data) + "\n", nil
+}
+
+// ExportWebVTT returns the chapters as WebVTT chapter cues.
+func ExportWebVTT(chapters []Chapter, meta Metadata) (string, error) {
+
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n")
+
+	for i, chapter := range chapters {
+		start := CalculateDuration(chapter.StartOffsetMs).ToString()
+		end := CalculateDuration(chapter.StartOffsetMs + chapter.LengthMs).ToString()
+		sb.WriteString(fmt.Sprintf("\n%d\n%s --> %s\n%s\n", i+1, start, end, vttEscape(chapter.Title)))
+	}
+
+	return sb.String(), nil
+}
+
+// ExportOGM returns the chapters in the OGM chapter text format used by Matroska and Ogg tools.
+func ExportOGM(chapters []Chapter, meta Metadata) (string, error) {
+
+	var sb strings.Builder
+	for i, chapter := range chapters {
+		sb.WriteString(fmt.Sprintf("CHAPTER%02d=%s\n", i+1, CalculateDuration(chapter.StartOffsetMs).ToString()))
+		sb.WriteString(fmt.Sprintf("CHAPTER%02dNAME=%s\n", i+1, oneLine(chapter.Title)))
+	}
+
+	return sb.String(), nil
+}
+
+// ExportAudacity returns the chapters as an Audacity label track, tab separated start, end and title in seconds.
+func ExportAudacity(chapters []Chapter, meta Metadata) (string, error) {
+
+	var sb strings.Builder
+	for _, chapter := range chapters {
+		start := float64(chapter.StartOffsetMs) / 1000
+		end := float64(chapter.StartOffsetMs+chapter.LengthMs) / 1000
+		sb.WriteString(fmt.Sprintf("%.6f\t%.6f\t%s\n", start, end, oneLine(chapter.Title)))
+	}
+
+	return sb.String(), nil
+}
+
+// ExportCSV returns the chapters as CSV, with a header row.
+func ExportCSV(chapters []Chapter, meta Metadata) (string, error) {
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	records := [][]string{{"index", "start", "end", "start_ms", "length_ms", "title"}}
+	for i, chapter := range chapters {
+		records = append(records, []string{
+			strconv.Itoa(i + 1),
+			CalculateDuration(chapter.StartOffsetMs).ToString(),
+			CalculateDuration(chapter.StartOffsetMs + chapter.LengthMs).ToString(),
+			strconv.Itoa(chapter.StartOffsetMs),
+			strconv.Itoa(chapter.LengthMs),
+			chapter.Title,
+		})
+	}
+
+	if err := w.WriteAll(records); err != nil {
+		return "", fmt.Errorf("error encoding csv chapters: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// ChapterExportPath returns the path of an exported chapter file, next to the output with the format's extension.
+func ChapterExportPath(outputDir string, meta Metadata, asin string, exporter ChapterExporter) string {
+	title := NormalizeName(meta.Title)
+	if asin == "" {
+		return path.Join(outputDir, title+"."+exporter.Extension)
+	}
+	return path.Join(outputDir, fmt.Sprintf("%s (%s).%s", title, asin, exporter.Extension))
+}
+
+// vttEscaper escapes the characters WebVTT cue text reserves, which also stops a title from holding "-->".
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// vttEscape escapes a title for WebVTT cue text, and puts it on one line, as a blank line would end the cue.
+func vttEscape(value string) string {
+	return vttEscaper.Replace(oneLine(value))
+}
+
+// oneLine puts a title on one line, for the formats that hold a chapter per line. Newlines and tabs become spaces.
+func oneLine(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// cueQuote quotes a value for a CUE sheet, CUE sheets have no escaping so double quotes are replaced.
+func cueQuote(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, "'") + `"`
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import "testing"
+
+func TestExportWebVTT(t *testing.T) {
+
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Chapter 1", "Chapter 1"},
+		{"Before --> After", "Before --&gt; After"},
+		{"Tom & Jerry <Live>", "Tom &amp; Jerry &lt;Live&gt;"},
+		{"Line one\n\nLine two\r\n", "Line one Line two"},
+	}
+
+	for _, test := range tests {
+		chapters := []Chapter{{Title: test.title, StartOffsetMs: 0, LengthMs: 61500}}
+		got, err := ExportWebVTT(chapters, Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "WEBVTT\n\n1\n" + CalculateDuration(0).ToString() + " --> " + CalculateDuration(61500).ToString() + "\n" + test.want + "\n"
+		if got != want {
+			t.Errorf("ExportWebVTT(%q) = %q, want %q", test.title, got, want)
+		}
+	}
+}
+
+func TestExportOneLineTitles(t *testing.T) {
+
+	chapters := []Chapter{{Title: "Part One:\n\tThe\tStart ", StartOffsetMs: 0, LengthMs: 1500}}
+	tests := []struct {
+		export func([]Chapter, Metadata) (string, error)
+		want   string
+	}{
+		{ExportMP4Chaps, CalculateDuration(0).ToString() + " Part One: The Start\n"},
+		{ExportOGM, "CHAPTER01=" + CalculateDuration(0).ToString() + "\nCHAPTER01NAME=Part One: The Start\n"},
+		{ExportAudacity, "0.000000\t1.500000\tPart One: The Start\n"},
+	}
+
+	for i, test := range tests {
+		got, err := test.export(chapters, Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("export %d = %q, want %q", i, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+// This file is responsible for writing and parsing ffmetadata (FFMETADATA1) files.
+
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ffmetadataHeader is the first line of every ffmetadata file.
+const ffmetadataHeader = ";FFMETADATA1"
+
+// MetadataTag is a single key and value in an ffmetadata file, they are kept in order.
+type MetadataTag struct {
+	Key   string
+	Value string
+}
+
+// FFMetadataChapter is a [CHAPTER] section of an ffmetadata file.
+type FFMetadataChapter struct {
+	TimebaseNum int64
+	TimebaseDen int64
+	Start       int64 // In timebase units
+	End         int64 // In timebase units
+	Tags        []MetadataTag
+}
+
+// FFMetadata is the contents of an ffmetadata file, the global tags followed by the chapters.
+type FFMetadata struct {
+	Tags     []MetadataTag
+	Chapters []FFMetadataChapter
+}
+
+// String writes the ffmetadata file. Keys and values are escaped, so they can contain any character.
+func (f FFMetadata) String() string {
+
+	var sb strings.Builder
+	sb.WriteString(ffmetadataHeader + "\n")
+
+	for _, tag := range f.Tags {
+		sb.WriteString(escapeFFMetadata(tag.Key) + "=" + escapeFFMetadata(tag.Value) + "\n")
+	}
+
+	for _, chapter := range f.Chapters {
+		sb.WriteString("\n[CHAPTER]\n")
+		sb.WriteString(fmt.Sprintf("TIMEBASE=%d/%d\n", chapter.TimebaseNum, chapter.TimebaseDen))
+		sb.WriteString(fmt.Sprintf("START=%d\n", chapter.Start))
+		sb.WriteString(fmt.Sprintf("END=%d\n", chapter.End))
+		for _, tag := range chapter.Tags {
+			sb.WriteString(escapeFFMetadata(tag.Key) + "=" + escapeFFMetadata(tag.Value) + "\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// Get returns the value of the first tag with the key, ignoring case.
+func (f FFMetadata) Get(key string) (string, bool) {
+	return getTag(f.Tags, key)
+}
+
+// StartMs returns the start of the chapter in milliseconds.
+func (c FFMetadataChapter) StartMs() int {
+	return timebaseToMs(c.Start, c.TimebaseNum, c.TimebaseDen)
+}
+
+// EndMs returns the end of the chapter in milliseconds.
+func (c FFMetadataChapter) EndMs() int {
+	return timebaseToMs(c.End, c.TimebaseNum, c.TimebaseDen)
+}
+
+// Title returns the title of the chapter.
+func (c FFMetadataChapter) Title() string {
+	title, _ := getTag(c.Tags, "title")
+	return title
+}
+
+// ParseFFMetadata parses an ffmetadata file. Comments are skipped, escaped characters are unescaped, and
+// sections other than [CHAPTER] (like [STREAM]) are skipped.
+func ParseFFMetadata(content string) (FFMetadata, error) {
+
+	var f FFMetadata
+
+	lines := splitFFMetadataLines(content)
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != ffmetadataHeader {
+		return f, fmt.Errorf("missing %s header", ffmetadataHeader)
+	}
+
+	section := ""
+	for i, line := range lines[1:] {
+
+		// Comments and empty lines are skipped
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		// Starts a new section
+		if line[0] == '[' {
+			section = strings.TrimSpace(line)
+			if section == "[CHAPTER]" {
+				// Without a TIMEBASE the times are in nanoseconds, as ffmpeg reads them
+				f.Chapters = append(f.Chapters, FFMetadataChapter{TimebaseNum: 1, TimebaseDen: 1000000000})
+			}
+			continue
+		}
+
+		key, value, ok := splitFFMetadataLine(line)
+		if !ok {
+			return f, fmt.Errorf("line %d: expected key=value", i+2)
+		}
+
+		switch section {
+		case "":
+			f.Tags = append(f.Tags, MetadataTag{Key: key, Value: value})
+		case "[CHAPTER]":
+			chapter := &f.Chapters[len(f.Chapters)-1]
+			var err error
+			switch strings.ToUpper(key) {
+			case "TIMEBASE":
+				num, den, found := strings.Cut(value, "/")
+				chapter.TimebaseNum, err = strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+				if err == nil && found {
+					chapter.TimebaseDen, err = strconv.ParseInt(strings.TrimSpace(den), 10, 64)
+				}
+				if err != nil || !found || chapter.TimebaseDen == 0 {
+					return f, fmt.Errorf("line %d: invalid timebase '%s'", i+2, value)
+				}
+			case "START":
+				chapter.Start, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			case "END":
+				chapter.End, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			default:
+				chapter.Tags = append(chapter.Tags, MetadataTag{Key: key, Value: value})
+			}
+			if err != nil {
+				return f, fmt.Errorf("line %d: invalid %s '%s'", i+2, key, value)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// ToFFMetadata converts the metadata, its extra tags and its chapters to an ffmetadata file.
+func (m Metadata) ToFFMetadata() FFMetadata {
+
+	var f FFMetadata
+	add := func(key, value string) {
+		f.Tags = append(f.Tags, MetadataTag{Key: key, Value: value})
+	}
+
+	add("title", m.Title)
+	add("series", m.Series.Name)
+	add("number", fmt.Sprintf("%f", m.Series.Position))
+
+	// Players read the author from artist and album_artist
+	add("author", m.Author)
+	add("artist", m.Author)
+	add("album_artist", m.Author)
+
+	// The album is the title of the book
+	add("album", m.Title)
+
+	// The narrator is the composer, which is where audiobook players look for it
+	if m.Narrator != "" {
+		add("composer", m.Narrator)
+	}
+
+	add("publisher", m.Publisher)
+
+	if m.Year != "" {
+		add("date", m.Year)
+	}
+
+	if m.Summary != "" {
+		add("description", m.Summary)
+	}
+	if m.ASIN != "" {
+		add("asin", m.ASIN)
+	}
+
+	// The extra tags are sorted so the output is stable
+	for _, key := range sortedKeys(m.Tags) {
+		add(key, m.Tags[key])
+	}
+
+	for _, chapter := range m.Chapters {
+		f.Chapters = append(f.Chapters, FFMetadataChapter{
+			TimebaseNum: 1,
+			TimebaseDen: 1000,
+			Start:       int64(chapter.StartOffsetMs),
+			End:         int64(chapter.StartOffsetMs + chapter.LengthMs),
+			Tags:        []MetadataTag{{Key: "title", Value: chapter.Title}},
+		})
+	}
+
+	return f
+}
+
+// MetadataFromFFMetadata converts an ffmetadata file back to metadata. The tags written by ToFFMetadata are
+// read back into their fields, and any other tags are kept in Tags.
+func MetadataFromFFMetadata(f FFMetadata) Metadata {
+
+	var m Metadata
+	for _, tag := range f.Tags {
+		switch strings.ToLower(tag.Key) {
+		case "title":
+			m.Title = tag.Value
+		case "series":
+			m.Series.Name = tag.Value
+		case "number":
+			m.Series.Position, _ = strconv.ParseFloat(tag.Value, 64)
+		case "author":
+			m.Author = tag.Value
+		case "artist", "album_artist", "album":
+			// Written from the author and title
+		case "composer":
+			m.Narrator = tag.Value
+		case "publisher":
+			m.Publisher = tag.Value
+		case "date":
+			m.Year = tag.Value
+		case "description":
+			m.Summary = tag.Value
+		case "asin":
+			m.ASIN = tag.Value
+		default:
+			if m.Tags == nil {
+				m.Tags = map[string]string{}
+			}
+			m.Tags[tag.Key] = tag.Value
+		}
+	}
+
+	// Files not written by ToFFMetadata may only have the artist
+	if m.Author == "" {
+		m.Author, _ = f.Get("artist")
+	}
+
+	m.Chapters = f.ToChapters()
+	return m
+}
+
+// ToChapters converts the chapters of the ffmetadata file to chapters in milliseconds.
+func (f FFMetadata) ToChapters() []Chapter {
+
+	var chapters []Chapter
+	for _, chapter := range f.Chapters {
+		start := chapter.StartMs()
+		chapters = append(chapters, Chapter{
+			LengthMs:       chapter.EndMs() - start,
+			StartOffsetMs:  start,
+			StartOffsetSec: start / 1000,
+			Title:          chapter.Title(),
+		})
+	}
+
+	return chapters
+}
+
+// escapeFFMetadata escapes the characters that have a meaning in an ffmetadata file with a backslash.
+func escapeFFMetadata(value string) string {
+
+	var sb strings.Builder
+	for _, r := range value {
+		switch r {
+		case '=', ';', '#', '\\', '\n':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+// splitFFMetadataLines splits the file into lines, an escaped newline does not end a line.
+// The escapes are kept, so the lines can be split into keys and values before they are unescaped.
+func splitFFMetadataLines(content string) []string {
+
+	var lines []string
+	var sb strings.Builder
+	escaped := false
+
+	for _, r := range content {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '\n':
+			lines = append(lines, strings.TrimSuffix(sb.String(), "\r"))
+			sb.Reset()
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() > 0 {
+		lines = append(lines, strings.TrimSuffix(sb.String(), "\r"))
+	}
+
+	return lines
+}
+
+// splitFFMetadataLine splits a line at the first unescaped '=', and unescapes the key and the value.
+func splitFFMetadataLine(line string) (string, string, bool) {
+
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '=':
+			return unescapeFFMetadata(line[:i]), unescapeFFMetadata(line[i+1:]), true
+		}
+	}
+
+	return "", "", false
+}
+
+// unescapeFFMetadata removes the backslashes that escape characters.
+func unescapeFFMetadata(value string) string {
+
+	var sb strings.Builder
+	escaped := false
+	for _, r := range value {
+		if !escaped && r == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+// getTag returns the value of the first tag with the key, ignoring case.
+func getTag(tags []MetadataTag, key string) (string, bool) {
+	for _, tag := range tags {
+		if strings.EqualFold(tag.Key, key) {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// timebaseToMs converts a time in timebase units to milliseconds.
+func timebaseToMs(value, num, den int64) int {
+	if den == 0 {
+		return 0
+	}
+	return int(math.Round(float64(value) * float64(num) * 1000 / float64(den)))
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFFMetadata(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		content  string
+		tags     []MetadataTag
+		chapters []Chapter
+		err      bool
+	}{
+		{
+			name:    "tags and chapters",
+			content: ";FFMETADATA1\ntitle=Book\nartist=Author\n\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=60000\ntitle=One\n",
+			tags:    []MetadataTag{{"title", "Book"}, {"artist", "Author"}},
+			chapters: []Chapter{
+				{Title: "One", StartOffsetMs: 0, LengthMs: 60000},
+			},
+		},
+		{
+			name:     "default timebase in nanoseconds",
+			content:  ";FFMETADATA1\n[CHAPTER]\nSTART=1500000000\nEND=3000000000\ntitle=One\n",
+			chapters: []Chapter{{Title: "One", StartOffsetMs: 1500, StartOffsetSec: 1, LengthMs: 1500}},
+		},
+		{
+			name:     "other timebase",
+			content:  ";FFMETADATA1\n[CHAPTER]\nTIMEBASE=1/44100\nSTART=44100\nEND=88200\ntitle=One\n",
+			chapters: []Chapter{{Title: "One", StartOffsetMs: 1000, StartOffsetSec: 1, LengthMs: 1000}},
+		},
+		{
+			name:    "escaped characters and comments",
+			content: ";FFMETADATA1\n; comment\n# comment\nti\\=tle=a\\;b\\#c\\\\d\\\ne\r\n",
+			tags:    []MetadataTag{{"ti=tle", "a;b#c\\d\ne"}},
+		},
+		{
+			name:     "other sections are skipped",
+			content:  ";FFMETADATA1\n[STREAM]\ntitle=Stream\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=1000\ntitle=One\n",
+			chapters: []Chapter{{Title: "One", LengthMs: 1000}},
+		},
+		{name: "missing header", content: "title=Book\n", err: true},
+		{name: "invalid timebase", content: ";FFMETADATA1\n[CHAPTER]\nTIMEBASE=1/0\n", err: true},
+		{name: "invalid start", content: ";FFMETADATA1\n[CHAPTER]\nSTART=one\n", err: true},
+		{name: "line without a value", content: ";FFMETADATA1\ntitle\n", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ParseFFMetadata(test.content)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.Tags, test.tags) {
+				t.Errorf("tags = %v, want %v", f.Tags, test.tags)
+			}
+			if chapters := f.ToChapters(); !reflect.DeepEqual(chapters, test.chapters) {
+				t.Errorf("chapters = %v, want %v", chapters, test.chapters)
+			}
+		})
+	}
+}
+
+func TestFFMetadataRoundTrip(t *testing.T) {
+
+	meta := Metadata{
+		Title:    "Book = Title; #1",
+		Author:   "Author",
+		Narrator: "Narrator",
+		Year:     "2020",
+		Summary:  "Line one\nLine two \\ end",
+		ASIN:     "B000000000",
+		Tags:     map[string]string{"custom": "value"},
+		Chapters: []Chapter{
+			{Title: "One", StartOffsetMs: 0, LengthMs: 1500},
+			{Title: "Two; =", StartOffsetMs: 1500, StartOffsetSec: 1, LengthMs: 2500},
+		},
+	}
+
+	f, err := ParseFFMetadata(meta.ToFFMetadata().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := MetadataFromFFMetadata(f)
+	if !reflect.DeepEqual(got, meta) {
+		t.Errorf("round trip = %+v, want %+v", got, meta)
+	}
+}
@@ -3,87 +3,89 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"path"
-	"strconv"
+	"sort"
 	"strings"
+	"time"
 )
 
+// FFmpegBinary and FFprobeBinary are the ffmpeg and ffprobe executables that are run, a name without a directory
+// is looked up in the PATH.
+var FFmpegBinary = "ffmpeg"
+var FFprobeBinary = "ffprobe"
+
 // GetFileDurationMS calculates the duration of a file in milliseconds.
 // It takes the filepath as input and returns the duration in milliseconds and any error encountered.
-func GetFileDurationMS(filepath string) (int, error) {
-
-	// Create a new exec.Command with the ffprobe command and arguments
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", filepath)
+// MP3 files are scanned natively, counting their frames, and MP4 files are read from their moov box, so ffprobe
+// is only needed for other files (or files that can't be read natively). The scans and probes are cached, and
+// the mp4 header is small, so calling this repeatedly for a file is cheap.
+func GetFileDurationMS(ctx context.Context, filepath string) (int, error) {
+
+	// Counts the frames of mp3 files
+	if strings.EqualFold(path.Ext(filepath), ".mp3") {
+		if info, err := ScanMP3(filepath); err == nil {
+			return info.DurationMS(), nil
+		}
+	}
 
-	// Run the command and capture the stdout
-	stdout, err := cmd.Output()
-	if err != nil {
-		return 0, fmt.Errorf("error running ffprobe command: %w", err)
+	// Reads the duration of mp4 files from their header
+	if containsString([]string{".m4b", ".m4a", ".mp4"}, strings.ToLower(path.Ext(filepath))) {
+		if f, err := ReadMP4(filepath); err == nil && f.DurationMS() > 0 {
+			return f.DurationMS(), nil
+		}
 	}
 
-	// Trim any leading or trailing whitespace from the stdout and convert it to a float
-	durationInSeconds, err := strconv.ParseFloat(strings.TrimSpace(string(stdout)), 64)
+	// Probes the file with ffprobe
+	result, err := ProbeFile(ctx, filepath)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing duration: %w", err)
+		return 0, err
 	}
 
 	// Converts the duration to milliseconds
-	durationInMilliseconds := int(durationInSeconds * 1000)
+	durationInMilliseconds := result.DurationMS()
+	if durationInMilliseconds == 0 {
+		return 0, fmt.Errorf("error parsing duration: '%s'", result.Format.Duration)
+	}
 
 	// Return the duration
 	return durationInMilliseconds, nil
 }
 
-// MakeCombinedMP3 concatenates multiple MP3 files into a single output file.
-// It takes a slice of file paths and the path of the output file as input.
-// It returns an error if the operation fails.
-func MakeCombinedMP3(files []string, meta Metadata, outputFile string) error {
-
-	fmt.Println("Making Combined MP3...")
-
-	// Create a slice to store the command line arguments
-	var args []string
-
-	// Append the input file paths to the arguments slice using the "concat" format
-	args = append(args, "-i", "concat:"+strings.Join(files, "|"))
-
-	// Adds simple metadata to the output file
-	args = append(args, "-metadata", "title="+meta.Title)
-	args = append(args, "-metadata", "artist="+meta.Author)
-	args = append(args, "-metadata", "album="+meta.Title)
-	args = append(args, "-metadata", "ASIN="+meta.ASIN)
-
-	// Set the audio codec to "copy" to preserve the original audio codecs
-	args = append(args, "-acodec", "copy", outputFile)
+// GetTotalDurationMS calculates the combined duration of the files in milliseconds.
+func GetTotalDurationMS(ctx context.Context, files []string) (int, error) {
 
-	// Create a new command using the "ffmpeg" executable and the arguments
-	cmd := exec.Command("ffmpeg", args...)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Println("Error:", err)
-		fmt.Println("Output:", string(output))
+	total := 0
+	for _, file := range files {
+		milli, err := GetFileDurationMS(ctx, file)
+		if err != nil {
+			return 0, fmt.Errorf("error getting duration of %s: %w", file, err)
+		}
+		total += milli
 	}
 
-	// Return nil if the operation is successful
-	return nil
+	return total, nil
 }
 
-// MakeCombinedM4B combines multiple audio files into a single M4B file
-// and adds metadata to it.
+// MakeCombinedFile combines multiple audio files into a single file in the given format,
+// and adds the metadata and chapters from the metadata file to it.
 //
 // Parameters:
 //   - files: a slice of input file paths
-//   - metadataFile: the path to the metadata file
+//   - metadataFile: the path to the ffmetadata file
 //   - outputFile: the path to the output file
+//   - format: the format of the output file
+//   - enc: the encoder settings for the audio stream
 //
 // Returns:
 //   - an error if the operation fails, or nil if successful
-func MakeCombinedM4B(files []string, metadataFile, outputFile string) error {
+func MakeCombinedFile(ctx context.Context, files []string, metadataFile, outputFile string, format OutputFormat, enc EncoderOptions) error {
 	// Print a message to indicate that the function is starting
-	fmt.Println("Making Combined M4B...")
+	fmt.Printf("Making Combined %s...\n", strings.ToUpper(format.Name))
 
 	// Create a slice to store the command line arguments
 	var args []string
@@ -94,107 +96,273 @@ func MakeCombinedM4B(files []string, metadataFile, outputFile string) error {
 	// Adds the metadata file to the output file
 	args = append(args, "-i", metadataFile)
 
-	// Sets the metadata map
-	args = append(args, "-map_metadata", "1")
-
-	// Set the audio codec to aac and bitrate to 64k
-	args = append(args, "-c:a", "aac", "-b:a", "64k")
-
-	// Set the output file path
-	args = append(args, outputFile)
-
-	// Create a new command using the "ffmpeg" executable and the arguments
-	cmd := exec.Command("ffmpeg", args...)
-
-	// Run the command and capture the output
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// Print the error and output if the command fails
-		fmt.Println("Error:", err)
-		fmt.Println("Output:", string(output))
+	// Sets the metadata and chapter map, and only keeps the audio (and the cover for mp3)
+	args = append(args, "-map", "0:a", "-map_metadata", "1", "-map_chapters", "1")
+	if format.Muxer == "mp3" {
+		args = append(args, "-map", "0:v?", "-c:v", "copy")
 	}
 
-	// Return nil if the operation is successful
-	return nil
-}
-
-// MakeSplitMP3Files splits an audiobook into MP3 files based on chapters.
-func MakeSplitMP3Files(files []string, chapters []Chapter, meta Metadata, outputDir string) error {
+	// Sets the audio codec, bitrate, sample rate and channels
+	args = append(args, enc.ToFFMPEGArgs()...)
 
-	// Print a message indicating that the audiobook is being split into MP3 files
-	fmt.Println("Splitting Audiobook into MP3 files based on chapters...")
+	// Adds the container specific options for writing the tags
+	args = append(args, format.TagArgs()...)
 
-	// Create a slice to store the command line arguments
-	var args []string
-
-	// Append the input file paths to the arguments slice using the "concat" format
-	args = append(args, "-i", "concat:"+strings.Join(files, "|"))
-
-	for i, chap := range chapters {
-		// Adds the ffmpeg arguments for each chapter
-		count := i + 1
-		args = append(args, "-ss", fmt.Sprintf("%dms", chap.StartOffsetMs), "-t", fmt.Sprintf("%dms", chap.LengthMs))
-		args = append(args, "-metadata", "title="+chap.Title, "-metadata", "artist="+meta.Author, "-metadata", "album="+meta.Title, "-metadata", fmt.Sprintf("track=%d", count))
-		args = append(args, "-acodec", "copy")
-		args = append(args, path.Join(outputDir, fmt.Sprintf("[%d]. ", count)+chap.Title+".mp3"))
-	}
+	// Set the muxer and the output file path
+	args = append(args, "-f", format.MuxerFor(enc), outputFile)
 
-	// Create a new command using the "ffmpeg" executable and the arguments
-	cmd := exec.Command("ffmpeg", args...)
+	// Create a new command using the ffmpeg executable and the arguments
+	cmd := newCommand(ctx, FFmpegBinary, args...)
 
+	// Run the command and capture the output
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		// Print the error and the command output if an error occurs
+		// Print the error and output if the command fails
 		fmt.Println("Error:", err)
 		fmt.Println("Output:", string(output))
+		return fmt.Errorf("error running ffmpeg command: %w", err)
 	}
 
 	// Return nil if the operation is successful
 	return nil
 }
 
-// MakeSplitM4BFiles splits an audiobook into M4B files based on chapters.
+// MakeSplitFiles splits an audiobook into files of the given format based on chapters.
+// Each file is tagged with the title of its chapter, and its position in the book.
 //
 // Parameters:
 // - files: a list of input file paths.
 // - chapters: a list of Chapter structs representing the chapters of the audiobook.
 // - meta: a Metadata struct containing metadata about the audiobook.
-// - outputDir: the directory where the output M4B files will be saved.
+// - outputDir: the directory where the output files will be saved.
+// - format: the format of the output files.
+// - enc: the encoder settings for the audio stream.
+// - progress: the chapters that are already written, and what to do as each is written (nil writes every chapter).
 //
 // Returns:
 // - error: an error if any occurred during the splitting process.
-func MakeSplitM4BFiles(files []string, chapters []Chapter, meta Metadata, outputDir string) error {
-	// Print a message indicating that the audiobook is being split into M4B files
-	fmt.Println("Splitting Audiobook into M4B files based on chapters...")
+func MakeSplitFiles(ctx context.Context, files []string, chapters []Chapter, meta Metadata, outputDir string, format OutputFormat, enc EncoderOptions, progress *SplitProgress) error {
+	// Print a message indicating that the audiobook is being split into files
+	fmt.Printf("Splitting Audiobook into %s files based on chapters...\n", strings.ToUpper(format.Name))
+
+	// MP3 files are copied natively, cut at the frame nearest to each chapter, unless the parts can't be read
+	if format.Muxer == "mp3" && enc.IsLossless() {
+		err := SplitMP3Files(ctx, files, chapters, meta, outputDir, progress)
+		if !errors.Is(err, ErrMP3Unsplittable) {
+			return err
+		}
+		fmt.Println("Native mp3 split is not possible (" + err.Error() + "), splitting with ffmpeg")
+	}
 
 	// Iterate over the chapters
 	for i, chap := range chapters {
 		// Calculate the chapter count
 		count := i + 1
 
+		// Skips the chapters that were written by an earlier run
+		if progress.skip(i) {
+			continue
+		}
+
+		// Stops before the next chapter if the run was cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Create a slice to store the command line arguments
 		var args []string
 
 		// Append the input file paths to the arguments slice using the "concat" format
 		args = append(args, "-i", "concat:"+strings.Join(files, "|"))
 
-		// Adds the ffmpeg arguments for each chapter
+		// Adds the ffmpeg arguments for each chapter, the source has no chapters of its own to copy
 		args = append(args, "-ss", fmt.Sprintf("%dms", chap.StartOffsetMs), "-t", fmt.Sprintf("%dms", chap.LengthMs))
-		args = append(args, "-metadata", "title="+chap.Title, "-metadata", "artist="+meta.Author, "-metadata", "album="+meta.Title, "-metadata", fmt.Sprintf("track=%d", count))
-		args = append(args, "-acodec", "aac")
-		args = append(args, path.Join(outputDir, fmt.Sprintf("[%d]. ", count)+chap.Title+".m4b"))
+		args = append(args, "-map", "0:a", "-map_chapters", "-1")
+		if format.Muxer == "mp3" {
+			args = append(args, "-map", "0:v?", "-c:v", "copy")
+		}
+		args = append(args, "-metadata", "title="+chap.Title, "-metadata", "artist="+meta.Author, "-metadata", "album="+meta.Title, "-metadata", fmt.Sprintf("track=%d/%d", count, len(chapters)))
+		if meta.ASIN != "" {
+			args = append(args, "-metadata", "ASIN="+meta.ASIN)
+		}
+		args = append(args, enc.ToFFMPEGArgs()...)
+
+		// Adds the extra tags, e.g. ReplayGain, and the container specific options for writing them
+		for _, key := range sortedKeys(meta.Tags) {
+			args = append(args, "-metadata", key+"="+meta.Tags[key])
+		}
+		args = append(args, format.TagArgs()...)
 
-		// Create a new command using the "ffmpeg" executable and the arguments
-		cmd := exec.Command("ffmpeg", args...)
+		args = append(args, "-f", format.MuxerFor(enc), path.Join(outputDir, SplitFileName(count, chap.Title, format.Extension)))
+
+		// Create a new command using the ffmpeg executable and the arguments
+		cmd := newCommand(ctx, FFmpegBinary, args...)
 
 		// Execute the command and capture the output
 		output, err := cmd.CombinedOutput()
 		if err != nil {
 			fmt.Println("Error:", err)
 			fmt.Println("Output:", string(output))
+			return fmt.Errorf("error running ffmpeg command for chapter %d: %w", count, err)
+		}
+
+		if err := progress.finish(i); err != nil {
+			return err
 		}
 	}
 
 	// Return nil if the operation is successful
 	return nil
 }
+
+// MakeCombinedFileLossless muxes the MP3 files into a single MP4 based file (m4b or m4a) without transcoding the audio.
+// If the files can not be stream copied, or the result is not playable by common players,
+// the file is transcoded with the fallback encoder settings instead.
+func MakeCombinedFileLossless(ctx context.Context, files []string, metadataFile, outputFile string, chapters int, format OutputFormat, fallback EncoderOptions) error {
+
+	// Checks the source files can be copied into the container
+	ok, reason, err := CanStreamCopyMP3(ctx, files)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Lossless output is not possible (" + reason + "), transcoding with " + fallback.ToString())
+		return MakeCombinedFile(ctx, files, metadataFile, outputFile, format, fallback)
+	}
+
+	// Copies the MP3 audio into the container
+	err = MakeCombinedFile(ctx, files, metadataFile, outputFile, format, EncoderPresets["lossless"])
+	if err == nil {
+		err = CheckM4BCompatible(ctx, outputFile, chapters)
+	}
+
+	// Stops if the run was cancelled, instead of transcoding
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	// Removes the output and transcodes it if the copy failed or is not compatible
+	if err != nil {
+		fmt.Println("Lossless output failed the compatibility check (" + err.Error() + "), transcoding with " + fallback.ToString())
+		if rmErr := os.Remove(outputFile); rmErr != nil && !os.IsNotExist(rmErr) {
+			return fmt.Errorf("error removing incompatible output: %w", rmErr)
+		}
+		return MakeCombinedFile(ctx, files, metadataFile, outputFile, format, fallback)
+	}
+
+	return nil
+}
+
+// MakeSplitFilesLossless splits an audiobook into MP4 based files (m4b or m4a) based on chapters without transcoding the audio.
+// If the files can not be stream copied, or any of the results are not playable by common players,
+// the files are transcoded with the fallback encoder settings instead.
+func MakeSplitFilesLossless(ctx context.Context, files []string, chapters []Chapter, meta Metadata, outputDir string, format OutputFormat, fallback EncoderOptions, progress *SplitProgress) error {
+
+	// Checks the source files can be copied into the container
+	ok, reason, err := CanStreamCopyMP3(ctx, files)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Lossless output is not possible (" + reason + "), transcoding with " + fallback.ToString())
+		return MakeSplitFiles(ctx, files, chapters, meta, outputDir, format, fallback, progress)
+	}
+
+	// Copies the MP3 audio into the containers, the chapters are only finished once all of them are checked
+	err = MakeSplitFiles(ctx, files, chapters, meta, outputDir, format, EncoderPresets["lossless"], progress.deferred())
+
+	// Checks each of the outputs, the chapter files do not contain chapter markers
+	var outputs []string
+	for i, chap := range chapters {
+		if progress.skip(i) {
+			continue
+		}
+		output := path.Join(outputDir, SplitFileName(i+1, chap.Title, format.Extension))
+		outputs = append(outputs, output)
+		if err == nil {
+			err = CheckM4BCompatible(ctx, output, 0)
+		}
+	}
+
+	// Stops if the run was cancelled, instead of transcoding
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	// Removes the outputs and transcodes them if the copy failed or is not compatible
+	if err != nil {
+		fmt.Println("Lossless output failed the compatibility check (" + err.Error() + "), transcoding with " + fallback.ToString())
+		for _, output := range outputs {
+			if rmErr := os.Remove(output); rmErr != nil && !os.IsNotExist(rmErr) {
+				return fmt.Errorf("error removing incompatible output: %w", rmErr)
+			}
+		}
+		return MakeSplitFiles(ctx, files, chapters, meta, outputDir, format, fallback, progress)
+	}
+
+	for i := range chapters {
+		if progress.skip(i) {
+			continue
+		}
+		if err := progress.finish(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newCommand creates a command that is stopped when the context is cancelled. It is asked to quit with an
+// interrupt first, so ffmpeg can close its files, and is killed if it has not quit after a few seconds.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// SplitProgress tracks the chapter files of a split output as they are written, so a run that stops part way
+// can be resumed without writing them again. A nil SplitProgress writes every chapter.
+type SplitProgress struct {
+	Skip     map[int]bool          // Chapters (by index) whose files were already written
+	Finished func(index int) error // Called after the file of each chapter is written
+}
+
+// skip checks if the file of the chapter was already written.
+func (p *SplitProgress) skip(index int) bool {
+	return p != nil && p.Skip[index]
+}
+
+// finish records that the file of the chapter was written.
+func (p *SplitProgress) finish(index int) error {
+	if p == nil || p.Finished == nil {
+		return nil
+	}
+	return p.Finished(index)
+}
+
+// deferred returns the progress without recording the chapters as they are written, for when they are checked first.
+func (p *SplitProgress) deferred() *SplitProgress {
+	if p == nil {
+		return nil
+	}
+	return &SplitProgress{Skip: p.Skip}
+}
+
+// SplitFileName returns the file name of a chapter when an audiobook is split into files.
+// The title is normalized, as titles (and title templates) can contain characters that are not valid in a path.
+func SplitFileName(count int, title, extension string) string {
+	return fmt.Sprintf("[%d]. %s.%s", count, NormalizeName(title), extension)
+}
+
+// sortedKeys returns the keys of the map in sorted order, so the generated commands are stable.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,154 @@
+// This file is responsible for the output formats the audiobook can be written in.
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// OutputFormat describes a container the audiobook can be written to.
+type OutputFormat struct {
+	Name           string   // Name used on the command line
+	Extension      string   // File extension of the output files
+	Muxer          string   // ffmpeg muxer used to write the container
+	Codecs         []string // Codecs the container supports, the first one is the default
+	ChapterSidecar bool     // The container can't hold chapters, so they are written to a separate file
+}
+
+// OutputFormats contains the formats that can be selected with --format.
+var OutputFormats = map[string]OutputFormat{
+	"mp3":  {Name: "mp3", Extension: "mp3", Muxer: "mp3", Codecs: []string{"copy"}},
+	"m4b":  {Name: "m4b", Extension: "m4b", Muxer: "ipod", Codecs: []string{"aac", "libfdk_aac", "opus", "copy"}},
+	"m4a":  {Name: "m4a", Extension: "m4a", Muxer: "ipod", Codecs: []string{"aac", "libfdk_aac", "opus", "copy"}},
+	"opus": {Name: "opus", Extension: "opus", Muxer: "ogg", Codecs: []string{"opus"}},
+	"flac": {Name: "flac", Extension: "flac", Muxer: "flac", Codecs: []string{"flac"}},
+	"aac":  {Name: "aac", Extension: "aac", Muxer: "adts", Codecs: []string{"aac", "libfdk_aac"}, ChapterSidecar: true},
+}
+
+// GetOutputFormat returns the output format with the given name.
+func GetOutputFormat(name string) (OutputFormat, error) {
+
+	// Looks up the format
+	format, ok := OutputFormats[strings.ToLower(name)]
+	if !ok {
+
+		// Builds a sorted list of the valid names for the error message
+		var names []string
+		for n := range OutputFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return OutputFormat{}, fmt.Errorf("unknown output format '%s' (valid: %s)", name, strings.Join(names, ", "))
+	}
+
+	return format, nil
+}
+
+// SupportsCodec checks if the format can hold audio encoded with the codec.
+func (f OutputFormat) SupportsCodec(codec string) bool {
+	for _, c := range f.Codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTranscoded checks if the audio has to be re-encoded for the format.
+func (f OutputFormat) IsTranscoded() bool {
+	return !(len(f.Codecs) == 1 && f.Codecs[0] == "copy")
+}
+
+// MuxerFor returns the ffmpeg muxer used to write the format with the encoder settings.
+// ffmpeg's ipod muxer (used for .m4b and .m4a) only accepts AAC, so any other codec uses the mp4 muxer.
+func (f OutputFormat) MuxerFor(enc EncoderOptions) string {
+	if f.Muxer == "ipod" && enc.Codec != "aac" && enc.Codec != "libfdk_aac" {
+		return "mp4"
+	}
+	return f.Muxer
+}
+
+// TagArgs returns the ffmpeg options needed to write the tags of the format.
+func (f OutputFormat) TagArgs() []string {
+	// ADTS streams have no metadata of their own, so the tags are written to an ID3v2 header
+	if f.Muxer == "adts" {
+		return []string{"-write_id3v2", "1"}
+	}
+	return nil
+}
+
+// AdaptEncoder adjusts the encoder settings so they can be used with the format.
+// If the codec was picked by a preset and the format does not support it, the format's default
+// codec is used instead. If the codec was set explicitly, an error is returned.
+func (f OutputFormat) AdaptEncoder(enc EncoderOptions, explicitCodec bool) (EncoderOptions, error) {
+
+	// Formats that are never transcoded always copy the stream
+	if !f.IsTranscoded() {
+		return EncoderOptions{Codec: "copy"}, nil
+	}
+
+	if f.SupportsCodec(enc.Codec) {
+		return enc, nil
+	}
+
+	// Lossless output only works when the container can hold the source MP3 audio
+	if explicitCodec || enc.IsLossless() {
+		return enc, fmt.Errorf("the %s format does not support the %s codec (valid: %s)", f.Name, enc.Codec, strings.Join(f.Codecs, ", "))
+	}
+
+	// Switches to the default codec of the format
+	enc.Codec = f.Codecs[0]
+
+	switch enc.Codec {
+	case "flac":
+		// FLAC is lossless, so the bitrate and quality do not apply
+		enc.Bitrate = 0
+		enc.Quality = 0
+		enc.Auto = false
+	case "opus":
+		// Opus needs a bitrate and only supports some sample rates
+		if enc.Bitrate == 0 && !enc.Auto {
+			enc.Bitrate = EncoderPresets["default"].Bitrate
+			enc.Quality = 0
+		}
+		if enc.SampleRate != 0 && !containsInt(opusSampleRates, enc.SampleRate) {
+			enc.SampleRate = nearestOpusSampleRate(enc.SampleRate)
+		}
+	}
+
+	return enc, nil
+}
+
+// WriteChapterSidecar writes the chapters next to an output file whose container can't hold them.
+// Each line holds the start time of a chapter and its title, in the format used by mp4chaps.
+func WriteChapterSidecar(outputFile string, chapters []Chapter) error {
+
+	// Builds the contents of the file
+	content, err := ExportMP4Chaps(chapters, Metadata{})
+	if err != nil {
+		return err
+	}
+
+	// Writes the file next to the output
+	sidecar := strings.TrimSuffix(outputFile, path.Ext(outputFile)) + ".chapters.txt"
+	if err := os.WriteFile(sidecar, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing chapter file: %w", err)
+	}
+
+	return nil
+}
+
+// nearestOpusSampleRate returns the lowest sample rate supported by opus that is at least the given rate.
+func nearestOpusSampleRate(rate int) int {
+	for _, r := range opusSampleRates {
+		if r >= rate {
+			return r
+		}
+	}
+	return opusSampleRates[len(opusSampleRates)-1]
+}
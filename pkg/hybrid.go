@@ -0,0 +1,104 @@
+// This file is responsible for merging the local chapter timings with the Audible chapter titles.
+
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ChapterMatch describes which Audible chapter a local chapter was paired with.
+type ChapterMatch struct {
+	Index        int
+	LocalTitle   string
+	AudibleTitle string // Empty if the chapter was not matched
+	LocalMs      int
+	AudibleMs    int
+	Method       string // order, offset or none
+}
+
+// MergeChapters keeps the timings of the local chapters, and takes the titles from the Audible chapters.
+// If there are as many Audible chapters as local chapters they are paired in order. Otherwise each local
+// chapter is paired with the Audible chapter closest to it, if they are the closest to each other, and
+// unpaired chapters keep their local title. The Audible offsets should already be aligned to the local audio.
+func MergeChapters(local, audible []Chapter) ([]Chapter, []ChapterMatch) {
+
+	// Copies the chapters so the originals are not changed
+	merged := make([]Chapter, len(local))
+	copy(merged, local)
+
+	var report []ChapterMatch
+	for i := range merged {
+		report = append(report, ChapterMatch{
+			Index:      i + 1,
+			LocalTitle: local[i].Title,
+			LocalMs:    local[i].StartOffsetMs,
+			Method:     "none",
+		})
+	}
+
+	// Pairs the chapters in order when the counts line up
+	if len(local) == len(audible) {
+		for i := range merged {
+			merged[i].Title = audible[i].Title
+			report[i].AudibleTitle = audible[i].Title
+			report[i].AudibleMs = audible[i].StartOffsetMs
+			report[i].Method = "order"
+		}
+		return merged, report
+	}
+
+	// Pairs the chapters that are the closest to each other
+	for i := range merged {
+		j := closestChapter(local[i].StartOffsetMs, audible)
+		if j == -1 || closestChapter(audible[j].StartOffsetMs, local) != i {
+			continue
+		}
+		merged[i].Title = audible[j].Title
+		report[i].AudibleTitle = audible[j].Title
+		report[i].AudibleMs = audible[j].StartOffsetMs
+		report[i].Method = "offset"
+	}
+
+	return merged, report
+}
+
+// FormatMatchReport returns a table of how each chapter was matched, for printing.
+func FormatMatchReport(report []ChapterMatch) string {
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%-4s %-13s %-10s %-7s %-30s %s\n", "#", "Local", "Offset", "Match", "Local Title", "Audible Title"))
+	for _, item := range report {
+		offset := ""
+		if item.Method != "none" {
+			offset = fmt.Sprintf("%+.2fs", float64(item.AudibleMs-item.LocalMs)/1000)
+		}
+		sb.WriteString(fmt.Sprintf("%-4d %-13s %-10s %-7s %-30s %s\n",
+			item.Index,
+			CalculateDuration(item.LocalMs).ToString(),
+			offset,
+			item.Method,
+			item.LocalTitle,
+			item.AudibleTitle,
+		))
+	}
+
+	return sb.String()
+}
+
+// closestChapter returns the index of the chapter that starts closest to the offset, or -1 if there are none.
+func closestChapter(offsetMs int, chapters []Chapter) int {
+
+	closest := -1
+	distance := math.MaxInt
+	for i, chapter := range chapters {
+		d := int(math.Abs(float64(chapter.StartOffsetMs - offsetMs)))
+		if d < distance {
+			closest = i
+			distance = d
+		}
+	}
+
+	return closest
+}
@@ -0,0 +1,441 @@
+// This file is responsible for reading and writing the frames of ID3v2 tags.
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3Padding is the padding written after a tag when the file is rewritten, so the next change to the tag
+// can be written in place.
+const id3Padding = 2048
+
+// id3TagNames are the common tag names of the ID3v2 text frames.
+var id3TagNames = map[string]string{
+	"TIT2": "title",
+	"TALB": "album",
+	"TPE1": "artist",
+	"TPE2": "album_artist",
+	"TCOM": "composer",
+	"TPUB": "publisher",
+	"TDRC": "date",
+	"TYER": "date",
+	"TRCK": "track",
+}
+
+// ID3Frame is a frame of an ID3v2 tag, its ID and its contents, which are not decoded.
+type ID3Frame struct {
+	ID   string
+	Data []byte
+}
+
+// ID3Tag is an ID3v2 tag, the frames are kept in the order they were read.
+type ID3Tag struct {
+	Version int // Major version, 3 or 4
+	Frames  []ID3Frame
+}
+
+// ReadID3v2 reads the frames of the ID3v2 tag at the start of the file. ID3v2.3 and ID3v2.4 tags are supported,
+// compressed and encrypted frames are skipped. It returns an empty tag if the file has none.
+func ReadID3v2(filepath string) (ID3Tag, error) {
+
+	var tag ID3Tag
+
+	file, err := os.Open(filepath)
+	if err != nil {
+		return tag, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(file, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return tag, nil
+		}
+		return tag, fmt.Errorf("error reading file: %w", err)
+	}
+	if !bytes.Equal(header[:3], []byte("ID3")) {
+		return tag, nil
+	}
+
+	tag.Version = int(header[3])
+	if tag.Version != 3 && tag.Version != 4 {
+		return tag, fmt.Errorf("unsupported ID3v2.%d tag", tag.Version)
+	}
+	flags := header[5]
+
+	body := make([]byte, syncsafe(header[6:10]))
+	if _, err := io.ReadFull(file, body); err != nil {
+		return tag, fmt.Errorf("error reading ID3v2 tag: %w", err)
+	}
+
+	// ID3v2.3 unsynchronises the whole tag, ID3v2.4 unsynchronises each frame
+	if flags&0x80 != 0 && tag.Version == 3 {
+		body = removeUnsync(body)
+	}
+
+	// Skips the extended header, its size only includes itself in ID3v2.4
+	pos := 0
+	if flags&0x40 != 0 && len(body) >= 4 {
+		if tag.Version == 4 {
+			pos = syncsafe(body[:4])
+		} else {
+			pos = 4 + int(binary.BigEndian.Uint32(body[:4]))
+		}
+	}
+
+	tag.Frames = parseID3Frames(body[min(pos, len(body)):], tag.Version, flags&0x80 != 0)
+
+	return tag, nil
+}
+
+// parseID3Frames parses the frames of a tag body, up to its padding. Unsync is set when the whole ID3v2.4 tag
+// is unsynchronised.
+func parseID3Frames(body []byte, version int, unsync bool) []ID3Frame {
+
+	var frames []ID3Frame
+	pos := 0
+	for pos+10 <= len(body) {
+
+		// The frames are followed by padding
+		if body[pos] == 0 {
+			break
+		}
+
+		id := string(body[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(body[pos+4 : pos+8]))
+		if version == 4 {
+			size = syncsafe(body[pos+4 : pos+8])
+		}
+		format := body[pos+9]
+		pos += 10
+		if size < 0 || pos+size > len(body) {
+			break
+		}
+		data := body[pos : pos+size]
+		pos += size
+
+		if version == 4 {
+			// Compressed or encrypted
+			if format&0x0C != 0 {
+				continue
+			}
+			// Group identifier, then the data length indicator
+			if format&0x40 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+			if format&0x01 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+			if format&0x02 != 0 || unsync {
+				data = removeUnsync(data)
+			}
+		} else {
+			// Compressed or encrypted
+			if format&0xC0 != 0 {
+				continue
+			}
+			// Group identifier
+			if format&0x20 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+		}
+
+		frames = append(frames, ID3Frame{ID: id, Data: append([]byte(nil), data...)})
+	}
+
+	return frames
+}
+
+// Get returns the first frame with the ID.
+func (t ID3Tag) Get(id string) (ID3Frame, bool) {
+	for _, frame := range t.Frames {
+		if frame.ID == id {
+			return frame, true
+		}
+	}
+	return ID3Frame{}, false
+}
+
+// Encode writes the frames as an ID3v2.4 tag. Frames read from ID3v2.3 tags can be written as they are.
+func (t ID3Tag) Encode() []byte {
+	return t.encodePadded(0)
+}
+
+// encodePadded writes the tag with the number of bytes of padding after the frames.
+func (t ID3Tag) encodePadded(padding int) []byte {
+
+	body := t.encodeFrames()
+
+	var out bytes.Buffer
+	out.Write([]byte{'I', 'D', '3', 4, 0, 0})
+	out.Write(toSyncsafe(len(body) + padding))
+	out.Write(body)
+	out.Write(make([]byte, padding))
+
+	return out.Bytes()
+}
+
+// encodeFrames writes the frames with ID3v2.4 headers.
+func (t ID3Tag) encodeFrames() []byte {
+	var body bytes.Buffer
+	for _, frame := range t.Frames {
+		body.WriteString(frame.ID)
+		body.Write(toSyncsafe(len(frame.Data)))
+		body.Write([]byte{0, 0})
+		body.Write(frame.Data)
+	}
+	return body.Bytes()
+}
+
+// WriteID3v2 replaces the ID3v2 tag at the start of the file, or adds one if it has none, and leaves the audio
+// after it as it is. The tag is written in place if it fits in the space of the old one, otherwise the file is
+// rewritten with some padding after the tag.
+func WriteID3v2(filepath string, tag ID3Tag) error {
+
+	file, err := os.OpenFile(filepath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	// Works out the space of the old tag, including its footer
+	space := 0
+	header := make([]byte, 10)
+	if n, _ := io.ReadFull(file, header); n == 10 && bytes.Equal(header[:3], []byte("ID3")) {
+		space = 10 + syncsafe(header[6:10])
+		if header[5]&0x10 != 0 {
+			space += 10
+		}
+	}
+
+	// Writes the tag in place, the rest of its space is padding
+	size := len(tag.Encode())
+	if size <= space {
+		if _, err := file.WriteAt(tag.encodePadded(space-size), 0); err != nil {
+			return fmt.Errorf("error writing ID3v2 tag: %w", err)
+		}
+		return file.Close()
+	}
+
+	temp, err := os.CreateTemp(path.Dir(filepath), ".id3-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	if _, err := temp.Write(tag.encodePadded(id3Padding)); err != nil {
+		return fmt.Errorf("error writing ID3v2 tag: %w", err)
+	}
+	if _, err := file.Seek(int64(space), io.SeekStart); err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	if _, err := io.Copy(temp, file); err != nil {
+		return fmt.Errorf("error copying audio: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	file.Close()
+
+	// Keeps the permissions of the original file
+	if stat, err := os.Stat(filepath); err == nil {
+		os.Chmod(temp.Name(), stat.Mode())
+	}
+
+	if err := os.Rename(temp.Name(), filepath); err != nil {
+		return fmt.Errorf("error replacing file: %w", err)
+	}
+
+	return nil
+}
+
+// Text decodes a text frame, several values are joined with a comma.
+func (f ID3Frame) Text() string {
+
+	if len(f.Data) == 0 {
+		return ""
+	}
+
+	var kept []string
+	for _, value := range strings.Split(DecodeID3String(f.Data[0], f.Data[1:]), "\x00") {
+		if value = strings.TrimSpace(value); value != "" {
+			kept = append(kept, value)
+		}
+	}
+
+	return strings.Join(kept, ", ")
+}
+
+// TextTags returns the text frames by the common tag name ffprobe gives them (e.g. TALB is album), and the TXXX
+// frames by their description. The names are lower case.
+func (t ID3Tag) TextTags() map[string]string {
+
+	tags := map[string]string{}
+	for _, frame := range t.Frames {
+		if name, ok := id3TagNames[frame.ID]; ok {
+			tags[name] = frame.Text()
+			continue
+		}
+		if frame.ID != "TXXX" || len(frame.Data) == 0 {
+			continue
+		}
+		values := strings.SplitN(DecodeID3String(frame.Data[0], frame.Data[1:]), "\x00", 2)
+		if len(values) == 2 {
+			tags[strings.ToLower(values[0])] = strings.TrimRight(values[1], "\x00")
+		}
+	}
+
+	return tags
+}
+
+// Chapters returns the chapters of the CHAP frames, in the order of their start times.
+func (t ID3Tag) Chapters() []Chapter {
+
+	var chapters []Chapter
+	for _, frame := range t.Frames {
+		if frame.ID != "CHAP" {
+			continue
+		}
+
+		// The element ID, then the start and end times in milliseconds and the byte offsets
+		end := bytes.IndexByte(frame.Data, 0)
+		if end == -1 || end+17 > len(frame.Data) {
+			continue
+		}
+		start := int(binary.BigEndian.Uint32(frame.Data[end+1:]))
+		stop := int(binary.BigEndian.Uint32(frame.Data[end+5:]))
+
+		// The title is in a TIT2 frame embedded in the chapter frame
+		chapter := Chapter{StartOffsetMs: start, StartOffsetSec: start / 1000, LengthMs: max(stop-start, 0)}
+		embedded := ID3Tag{Version: t.Version, Frames: parseID3Frames(frame.Data[end+17:], t.Version, false)}
+		if title, ok := embedded.Get("TIT2"); ok {
+			chapter.Title = title.Text()
+		}
+		chapters = append(chapters, chapter)
+	}
+
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].StartOffsetMs < chapters[j].StartOffsetMs })
+	for i := range chapters {
+		if chapters[i].Title == "" {
+			chapters[i].Title = fmt.Sprintf("Chapter %d", i+1)
+		}
+	}
+
+	return chapters
+}
+
+// NewID3ChapterFrames returns a CHAP frame for each of the chapters, and the CTOC frame that lists them.
+func NewID3ChapterFrames(chapters []Chapter) []ID3Frame {
+
+	if len(chapters) == 0 {
+		return nil
+	}
+
+	// The table of contents is the top level and is ordered
+	toc := append([]byte("toc"), 0, 0x03, byte(min(len(chapters), 255)))
+	var frames []ID3Frame
+	for i, chapter := range chapters {
+		id := fmt.Sprintf("ch%d", i)
+		if i < 255 {
+			toc = append(toc, id...)
+			toc = append(toc, 0)
+		}
+
+		data := append([]byte(id), 0)
+		data = binary.BigEndian.AppendUint32(data, uint32(chapter.StartOffsetMs))
+		data = binary.BigEndian.AppendUint32(data, uint32(chapter.StartOffsetMs+chapter.LengthMs))
+		data = append(data, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+		data = append(data, ID3Tag{Frames: []ID3Frame{NewID3TextFrame("TIT2", chapter.Title)}}.encodeFrames()...)
+		frames = append(frames, ID3Frame{ID: "CHAP", Data: data})
+	}
+
+	return append([]ID3Frame{{ID: "CTOC", Data: toc}}, frames...)
+}
+
+// NewID3TextFrame returns a text frame (e.g. TIT2) with the value encoded as UTF-8.
+func NewID3TextFrame(id, value string) ID3Frame {
+	return ID3Frame{ID: id, Data: append([]byte{3}, value...)}
+}
+
+// NewID3UserTextFrame returns a TXXX frame, which holds a tag that has no frame of its own.
+func NewID3UserTextFrame(description, value string) ID3Frame {
+	data := append([]byte{3}, description...)
+	data = append(data, 0)
+	data = append(data, value...)
+	return ID3Frame{ID: "TXXX", Data: data}
+}
+
+// NewID3PictureFrame returns an APIC frame with the image as the front cover.
+func NewID3PictureFrame(mimeType string, image []byte) ID3Frame {
+	data := append([]byte{0}, mimeType...)
+	data = append(data, 0, 3, 0)
+	data = append(data, image...)
+	return ID3Frame{ID: "APIC", Data: data}
+}
+
+// DecodeID3String decodes a string in one of the ID3 encodings, Latin-1, UTF-16 with a BOM, UTF-16BE or UTF-8.
+func DecodeID3String(encoding byte, data []byte) string {
+
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		var units []uint16
+		for i := 0; i+1 < len(data); i += 2 {
+			// The byte order mark can start each value
+			if data[i] == 0xFF && data[i+1] == 0xFE {
+				bigEndian = false
+				continue
+			}
+			if data[i] == 0xFE && data[i+1] == 0xFF {
+				bigEndian = true
+				continue
+			}
+			if bigEndian {
+				units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+			} else {
+				units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+			}
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	case 3:
+		return strings.TrimRight(string(data), "\x00")
+	default:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return strings.TrimRight(string(runes), "\x00")
+	}
+}
+
+// syncsafe decodes a syncsafe integer, which stores 7 bits in each byte.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// toSyncsafe encodes a syncsafe integer.
+func toSyncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7F, byte(n>>14) & 0x7F, byte(n>>7) & 0x7F, byte(n) & 0x7F}
+}
+
+// removeUnsync reverses unsynchronisation, which inserts a zero byte after every 0xFF.
+func removeUnsync(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		out = append(out, data[i])
+		if data[i] == 0xFF && i+1 < len(data) && data[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
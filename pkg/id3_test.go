@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestID3RoundTrip(t *testing.T) {
+
+	chapters := []Chapter{
+		{Title: "Opening Credits", StartOffsetMs: 0, LengthMs: 1000},
+		{Title: "Chapter 1: Ünïcödé", StartOffsetMs: 1000, StartOffsetSec: 1, LengthMs: 1500},
+		{Title: "Chapter 2", StartOffsetMs: 2500, StartOffsetSec: 2, LengthMs: 112},
+	}
+
+	tests := []struct {
+		name     string
+		existing bool // The file already has a tag, which the new one replaces
+		large    bool // The new tag does not fit in the space of the old one
+	}{
+		{name: "no tag"},
+		{name: "in place", existing: true},
+		{name: "rewritten", existing: true, large: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			file, start := writeTestMP3(t, t.TempDir(), "book.mp3", testMP3{frames: 10, id3v2: test.existing})
+			before, _ := os.ReadFile(file)
+			audio := before[start:]
+			if test.existing {
+				// Leaves room for the new tag to be written in place
+				if err := WriteID3v2(file, ID3Tag{Frames: []ID3Frame{NewID3TextFrame("TIT2", "Old")}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tag := ID3Tag{Frames: []ID3Frame{
+				NewID3TextFrame("TIT2", "Book"),
+				NewID3TextFrame("TPE1", "Author"),
+				NewID3UserTextFrame("ASIN", "B000000000"),
+			}}
+			tag.Frames = append(tag.Frames, NewID3ChapterFrames(chapters)...)
+			if test.large {
+				tag.Frames = append(tag.Frames, NewID3PictureFrame("image/jpeg", make([]byte, 3*id3Padding)))
+			}
+			if err := WriteID3v2(file, tag); err != nil {
+				t.Fatal(err)
+			}
+
+			read, err := ReadID3v2(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.Version != 4 || !reflect.DeepEqual(read.Frames, tag.Frames) {
+				t.Errorf("read %d frames (version %d), want the %d written", len(read.Frames), read.Version, len(tag.Frames))
+			}
+			if got := read.Chapters(); !reflect.DeepEqual(got, chapters) {
+				t.Errorf("chapters = %+v, want %+v", got, chapters)
+			}
+			tags := read.TextTags()
+			if tags["title"] != "Book" || tags["artist"] != "Author" || tags["asin"] != "B000000000" {
+				t.Errorf("tags = %v", tags)
+			}
+
+			// The audio after the tag is left as it is
+			after, _ := os.ReadFile(file)
+			if !bytes.HasSuffix(after, audio) {
+				t.Error("the audio changed")
+			}
+			info, err := ScanMP3(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(info.FrameOffsets) != 10 {
+				t.Errorf("frames = %d after writing the tag, want 10", len(info.FrameOffsets))
+			}
+		})
+	}
+}
+
+func TestReadID3v23(t *testing.T) {
+
+	// An ID3v2.3 tag with an unsynchronised UTF-16 title, and a frame size that is not syncsafe
+	title := []byte{1, 0xFF, 0xFE, 'B', 0, 0xFF, 0x00, 'k', 0}
+	frames := []byte("TIT2")
+	frames = append(frames, 0, 0, 0, byte(len(title)), 0, 0)
+	frames = append(frames, title...)
+	frames = append(frames, "TPE1"...)
+	frames = append(frames, 0, 0, 0, 4, 0, 0, 0, 'A', 'b', 'c')
+
+	// Unsynchronisation adds a zero after each 0xFF
+	var body []byte
+	for _, b := range frames {
+		body = append(body, b)
+		if b == 0xFF {
+			body = append(body, 0)
+		}
+	}
+	body = append(body, make([]byte, 16)...)
+	data := append([]byte{'I', 'D', '3', 3, 0, 0x80}, toSyncsafe(len(body))...)
+	data = append(data, body...)
+
+	file := path.Join(t.TempDir(), "part.mp3")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := ReadID3v2(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := tag.TextTags()
+	if tag.Version != 3 || tags["title"] != "Bÿk" || tags["artist"] != "Abc" {
+		t.Errorf("version %d tags = %q, want version 3 with title %q and artist %q", tag.Version, tags, "Bÿk", "Abc")
+	}
+}
+
+func TestDecodeID3String(t *testing.T) {
+
+	tests := []struct {
+		encoding byte
+		data     []byte
+		want     string
+	}{
+		{0, []byte{'c', 'a', 'f', 0xE9, 0}, "café"},
+		{1, []byte{0xFF, 0xFE, 'h', 0, 'i', 0, 0, 0}, "hi"},
+		{1, []byte{0xFE, 0xFF, 0, 'h', 0, 'i'}, "hi"},
+		{1, []byte{0xFF, 0xFE, 'a', 0, 0, 0, 0xFF, 0xFE, 'b', 0}, "a\x00b"},
+		{2, []byte{0, 'h', 0, 'i'}, "hi"},
+		{2, []byte{0xD8, 0x3D, 0xDE, 0x00}, "😀"},
+		{3, []byte("héllo\x00"), "héllo"},
+	}
+
+	for _, test := range tests {
+		if got := DecodeID3String(test.encoding, test.data); got != test.want {
+			t.Errorf("DecodeID3String(%d, %v) = %q, want %q", test.encoding, test.data, got, test.want)
+		}
+	}
+}
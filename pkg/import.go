@@ -0,0 +1,344 @@
+// This file is responsible for importing chapters from chapter files, so hand edited chapters can be used as the chapter source.
+
+package pkg
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	cueIndexRegex   = regexp.MustCompile(`^\s*INDEX\s+01\s+(\d+):(\d{2}):(\d{2})\s*$`)
+	cueTitleRegex   = regexp.MustCompile(`^\s*TITLE\s+"?(.*?)"?\s*$`)
+	cueTrackRegex   = regexp.MustCompile(`^\s*TRACK\s+\d+`)
+	mp4chapsRegex   = regexp.MustCompile(`^\s*(\d+:\d{2}(?::\d{2})?(?:\.\d+)?)\s+(.*)$`)
+	audacityRegex   = regexp.MustCompile(`^\s*\d+(\.\d+)?\t\d+(\.\d+)?\t`)
+	timestampFormat = regexp.MustCompile(`^(?:(\d+):)?(\d+):(\d+(?:\.\d+)?)$`)
+)
+
+// ChapterImportFormats are the formats ImportChapters can read.
+var ChapterImportFormats = []string{"cue", "ffmetadata", "mp4chaps", "audacity", "csv", "json"}
+
+// ImportChapters reads the chapters from a chapter file, and checks them against the duration of the book.
+// The format is picked from the extension, and for .txt files from the contents.
+func ImportChapters(filepath string, totalMs int) ([]Chapter, error) {
+
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading chapters file: %w", err)
+	}
+
+	format := DetectChapterFormat(filepath, string(data))
+
+	var chapters []Chapter
+	switch format {
+	case "cue":
+		chapters, err = parseCUE(string(data))
+	case "ffmetadata":
+		chapters, err = parseFFMetadataChapters(string(data))
+	case "mp4chaps":
+		chapters, err = parseMP4Chaps(string(data))
+	case "audacity":
+		chapters, err = parseAudacity(string(data))
+	case "csv":
+		chapters, err = parseCSV(string(data))
+	case "json":
+		chapters, err = parseJSON(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s chapters: %w", format, err)
+	}
+
+	return ValidateChapters(chapters, totalMs)
+}
+
+// DetectChapterFormat returns the format of a chapter file, from the extension or the contents.
+func DetectChapterFormat(filepath, content string) string {
+
+	switch strings.ToLower(path.Ext(filepath)) {
+	case ".cue":
+		return "cue"
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	}
+
+	// Checks the contents of text files
+	trimmed := strings.TrimSpace(content)
+	switch {
+	case strings.HasPrefix(trimmed, ";FFMETADATA1"):
+		return "ffmetadata"
+	case strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "["):
+		return "json"
+	case audacityRegex.MatchString(trimmed):
+		return "audacity"
+	case strings.Contains(trimmed, "INDEX 01"):
+		return "cue"
+	}
+
+	return "mp4chaps"
+}
+
+// ValidateChapters sorts the chapters, checks every start is inside the book, and calculates the lengths.
+// The first chapter is moved to the start of the book, so none of the audio is left without a chapter.
+func ValidateChapters(chapters []Chapter, totalMs int) ([]Chapter, error) {
+
+	if len(chapters) == 0 {
+		return nil, fmt.Errorf("no chapters found")
+	}
+
+	sort.SliceStable(chapters, func(i, j int) bool {
+		return chapters[i].StartOffsetMs < chapters[j].StartOffsetMs
+	})
+
+	for i, chapter := range chapters {
+		if chapter.StartOffsetMs < 0 {
+			return nil, fmt.Errorf("chapter %d (%s) starts before the book", i+1, chapter.Title)
+		}
+		if totalMs > 0 && chapter.StartOffsetMs >= totalMs {
+			return nil, fmt.Errorf("chapter %d (%s) starts at %s, after the end of the book (%s)",
+				i+1, chapter.Title, CalculateDuration(chapter.StartOffsetMs).ToString(), CalculateDuration(totalMs).ToString())
+		}
+		if i > 0 && chapter.StartOffsetMs == chapters[i-1].StartOffsetMs {
+			return nil, fmt.Errorf("chapters %d and %d start at the same time", i, i+1)
+		}
+	}
+
+	// The first chapter starts the book, so any audio before it is not lost
+	if chapters[0].StartOffsetMs != 0 {
+		fmt.Printf("Warning: chapter 1 (%s) starts at %s, it is moved to the start of the book\n",
+			chapters[0].Title, CalculateDuration(chapters[0].StartOffsetMs).ToString())
+		chapters[0].StartOffsetMs = 0
+	}
+
+	// Calculates the length of each chapter from the start of the next one
+	for i := range chapters {
+		chapters[i].StartOffsetSec = chapters[i].StartOffsetMs / 1000
+		if i < len(chapters)-1 {
+			chapters[i].LengthMs = chapters[i+1].StartOffsetMs - chapters[i].StartOffsetMs
+		} else {
+			chapters[i].LengthMs = totalMs - chapters[i].StartOffsetMs
+		}
+	}
+
+	return chapters, nil
+}
+
+// ParseTimestamp parses a timestamp as "HH:MM:SS.mmm", "MM:SS.mmm" or a number of seconds, and returns milliseconds.
+func ParseTimestamp(value string) (int, error) {
+
+	value = strings.TrimSpace(value)
+
+	// A plain number is a number of seconds
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return int(math.Round(seconds * 1000)), nil
+	}
+
+	match := timestampFormat.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("invalid timestamp '%s'", value)
+	}
+
+	hours := 0
+	if match[1] != "" {
+		hours, _ = strconv.Atoi(match[1])
+	}
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.ParseFloat(match[3], 64)
+
+	return hours*3600000 + minutes*60000 + int(math.Round(seconds*1000)), nil
+}
+
+// parseCUE reads the tracks of a CUE sheet, which are indexed in frames of 1/75 second.
+func parseCUE(content string) ([]Chapter, error) {
+
+	var chapters []Chapter
+	inTrack := false
+	title := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case cueTrackRegex.MatchString(line):
+			inTrack = true
+			title = ""
+		case inTrack && cueTitleRegex.MatchString(line):
+			title = cueTitleRegex.FindStringSubmatch(line)[1]
+		case inTrack && cueIndexRegex.MatchString(line):
+			match := cueIndexRegex.FindStringSubmatch(line)
+			minutes, _ := strconv.Atoi(match[1])
+			seconds, _ := strconv.Atoi(match[2])
+			frames, _ := strconv.Atoi(match[3])
+			start := minutes*60000 + seconds*1000 + frames*1000/75
+			chapters = append(chapters, Chapter{StartOffsetMs: start, Title: title})
+		}
+	}
+
+	return chapters, scanner.Err()
+}
+
+// parseFFMetadataChapters reads the [CHAPTER] sections of an ffmetadata file.
+func parseFFMetadataChapters(content string) ([]Chapter, error) {
+
+	f, err := ParseFFMetadata(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.ToChapters(), nil
+}
+
+// parseMP4Chaps reads the mp4chaps (Nero) text format, "HH:MM:SS.mmm Title" on each line.
+func parseMP4Chaps(content string) ([]Chapter, error) {
+
+	var chapters []Chapter
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		match := mp4chapsRegex.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("line %d: expected 'HH:MM:SS.mmm Title'", i+1)
+		}
+		start, err := ParseTimestamp(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		chapters = append(chapters, Chapter{StartOffsetMs: start, Title: strings.TrimSpace(match[2])})
+	}
+
+	return chapters, nil
+}
+
+// parseAudacity reads an Audacity label track, tab separated start, end and title in seconds.
+func parseAudacity(content string) ([]Chapter, error) {
+
+	var chapters []Chapter
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		// Spectral selection lines start with a backslash
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "\\") {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected tab separated start, end and title", i+1)
+		}
+		start, err := ParseTimestamp(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		title := ""
+		if len(fields) == 3 {
+			title = fields[2]
+		}
+		chapters = append(chapters, Chapter{StartOffsetMs: start, Title: title})
+	}
+
+	return chapters, nil
+}
+
+// parseCSV reads chapters from CSV. With a header row the start is read from the start_ms or start column, and
+// the title from the title column. Without one the first column is the start and the last column is the title.
+func parseCSV(content string) ([]Chapter, error) {
+
+	records, err := csv.NewReader(strings.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	// Finds the columns from the header, if there is one
+	startCol, titleCol, msCol := 0, len(records[0])-1, -1
+	header := false
+	for i, name := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "start":
+			startCol, header = i, true
+		case "start_ms":
+			msCol, header = i, true
+		case "title":
+			titleCol, header = i, true
+		}
+	}
+	if header {
+		records = records[1:]
+	}
+
+	var chapters []Chapter
+	for i, record := range records {
+		var start int
+		if msCol != -1 {
+			start, err = strconv.Atoi(strings.TrimSpace(record[msCol]))
+		} else {
+			start, err = ParseTimestamp(record[startCol])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		chapters = append(chapters, Chapter{StartOffsetMs: start, Title: strings.TrimSpace(record[titleCol])})
+	}
+
+	return chapters, nil
+}
+
+// parseJSON reads chapters from JSON, either Podlove Simple Chapters, the audnexus chapter response,
+// or a list of chapters with startOffsetMs (or start) and title.
+func parseJSON(data []byte) ([]Chapter, error) {
+
+	// The start is a timestamp string, or a number of seconds
+	type jsonChapter struct {
+		Start         json.RawMessage `json:"start"`
+		StartOffsetMs *int            `json:"startOffsetMs"`
+		Title         string          `json:"title"`
+	}
+
+	// The chapters are either the whole document, or under a chapters key
+	var list []jsonChapter
+	if err := json.Unmarshal(data, &list); err != nil {
+		var doc struct {
+			Chapters []jsonChapter `json:"chapters"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		list = doc.Chapters
+	}
+
+	var chapters []Chapter
+	for i, item := range list {
+		var start int
+		if item.StartOffsetMs != nil {
+			start = *item.StartOffsetMs
+		} else {
+			value := string(item.Start)
+			if len(item.Start) > 0 && item.Start[0] == '"' {
+				if err := json.Unmarshal(item.Start, &value); err != nil {
+					return nil, fmt.Errorf("chapter %d: %w", i+1, err)
+				}
+			}
+			var err error
+			start, err = ParseTimestamp(value)
+			if err != nil {
+				return nil, fmt.Errorf("chapter %d: %w", i+1, err)
+			}
+		}
+		chapters = append(chapters, Chapter{StartOffsetMs: start, Title: item.Title})
+	}
+
+	return chapters, nil
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONChapters(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+		want []Chapter
+		err  bool
+	}{
+		{
+			name: "podlove timestamps",
+			data: `{"chapters": [{"start": "00:00:00.000", "title": "One"}, {"start": "01:02.5", "title": "Two"}]}`,
+			want: []Chapter{{Title: "One"}, {StartOffsetMs: 62500, Title: "Two"}},
+		},
+		{
+			name: "podlove seconds",
+			data: `{"chapters": [{"start": 0, "title": "One"}, {"start": 62.5, "title": "Two"}]}`,
+			want: []Chapter{{Title: "One"}, {StartOffsetMs: 62500, Title: "Two"}},
+		},
+		{
+			name: "seconds as a string",
+			data: `[{"start": "62.5", "title": "Two"}]`,
+			want: []Chapter{{StartOffsetMs: 62500, Title: "Two"}},
+		},
+		{
+			name: "offsets in milliseconds",
+			data: `[{"startOffsetMs": 0, "title": "One"}, {"startOffsetMs": 1500, "title": "Two"}]`,
+			want: []Chapter{{Title: "One"}, {StartOffsetMs: 1500, Title: "Two"}},
+		},
+		{name: "invalid start", data: `[{"start": "soon", "title": "One"}]`, err: true},
+		{name: "missing start", data: `[{"title": "One"}]`, err: true},
+		{name: "start of the wrong type", data: `[{"start": true, "title": "One"}]`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseJSON([]byte(test.data))
+			if (err != nil) != test.err {
+				t.Fatalf("error = %v, want error %v", err, test.err)
+			}
+			if !test.err && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("chapters = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateChapters(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		chapters []Chapter
+		want     []Chapter
+		err      bool
+	}{
+		{
+			name:     "sorted and measured",
+			chapters: []Chapter{{StartOffsetMs: 4000, Title: "Two"}, {StartOffsetMs: 0, Title: "One"}},
+			want:     []Chapter{{StartOffsetMs: 0, LengthMs: 4000, Title: "One"}, {StartOffsetMs: 4000, StartOffsetSec: 4, LengthMs: 6000, Title: "Two"}},
+		},
+		{
+			name:     "first chapter moved to the start",
+			chapters: []Chapter{{StartOffsetMs: 1500, Title: "One"}, {StartOffsetMs: 4000, Title: "Two"}},
+			want:     []Chapter{{StartOffsetMs: 0, LengthMs: 4000, Title: "One"}, {StartOffsetMs: 4000, StartOffsetSec: 4, LengthMs: 6000, Title: "Two"}},
+		},
+		{name: "no chapters", err: true},
+		{name: "negative start", chapters: []Chapter{{StartOffsetMs: -1}}, err: true},
+		{name: "after the end", chapters: []Chapter{{StartOffsetMs: 0}, {StartOffsetMs: 10000}}, err: true},
+		{name: "same start", chapters: []Chapter{{StartOffsetMs: 0}, {StartOffsetMs: 0}}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ValidateChapters(test.chapters, 10000)
+			if (err != nil) != test.err {
+				t.Fatalf("error = %v, want error %v", err, test.err)
+			}
+			if !test.err && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("chapters = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// This file is responsible for reading the chapters and tags of an existing audiobook file, so it can be used instead of an openbook.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	tagYearRegex     = regexp.MustCompile(`\d{4}`)
+	tagPositionRegex = regexp.MustCompile(`\d+(\.\d+)?`)
+)
+
+// InputExtensions are the audiobook files that can be read with ReadAudiobookFile.
+var InputExtensions = []string{".m4b", ".m4a", ".mp4", ".mp3"}
+
+// ReadAudiobookFile reads the tags and chapters of an existing audiobook file with ffprobe.
+// The returned metadata holds the chapters of the file, which is empty if it has none.
+func ReadAudiobookFile(ctx context.Context, filepath string) (Metadata, error) {
+
+	var metadata Metadata
+
+	if !containsString(InputExtensions, strings.ToLower(path.Ext(filepath))) {
+		return metadata, fmt.Errorf("unsupported input file '%s' (valid: %s)", path.Base(filepath), strings.Join(InputExtensions, ", "))
+	}
+
+	result, err := ProbeFile(ctx, filepath)
+	if err != nil {
+		return metadata, err
+	}
+
+	// Tag names differ in case between containers
+	metadata = metadataFromTags(lowerKeys(result.Format.Tags))
+
+	// Falls back to the file name if the file has no title
+	if metadata.Title == "" {
+		metadata.Title = strings.TrimSuffix(path.Base(filepath), path.Ext(filepath))
+	}
+
+	totalMs := result.DurationMS()
+	metadata.Duration = CalculateDuration(totalMs)
+
+	// Gets the chapters, ffprobe reports the times in seconds
+	for i, item := range result.Chapters {
+		start := secondsToMs(item.StartTime)
+		end := secondsToMs(item.EndTime)
+		title := firstTag(lowerKeys(item.Tags), "title")
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		metadata.Chapters = append(metadata.Chapters, Chapter{
+			LengthMs:       end - start,
+			StartOffsetMs:  start,
+			StartOffsetSec: start / 1000,
+			Title:          title,
+		})
+	}
+
+	return metadata, nil
+}
+
+// SourceBitrate returns the bitrate of the audio in the file in kbps, or 0 if it is not known.
+func SourceBitrate(ctx context.Context, filepath string) int {
+
+	result, err := ProbeFile(ctx, filepath)
+	if err != nil {
+		return 0
+	}
+
+	info, err := result.AudioStream()
+	if err != nil {
+		return 0
+	}
+
+	return info.Bitrate
+}
+
+// metadataFromTags reads the book details from tags with lower case keys, using the names ffprobe gives them.
+func metadataFromTags(tags map[string]string) Metadata {
+
+	var metadata Metadata
+
+	// Gets the book details, from the first tag that is set
+	metadata.Title = firstTag(tags, "album", "title")
+	metadata.Author = firstTag(tags, "album_artist", "artist", "author")
+	metadata.Narrator = firstTag(tags, "composer", "narrator", "narratedby")
+	metadata.Publisher = firstTag(tags, "publisher", "label")
+	metadata.Summary = firstTag(tags, "description", "synopsis", "comment")
+	metadata.ASIN = firstTag(tags, "asin", "audible_asin")
+	metadata.Series.Name = firstTag(tags, "series", "mvnm")
+
+	// Gets the year, from a full date if that is what the file has
+	if year := tagYearRegex.FindString(firstTag(tags, "date", "year")); year != "" {
+		metadata.Year = year
+	}
+
+	// Gets the series position, if it is a number
+	if number := tagPositionRegex.FindString(firstTag(tags, "number", "series-part", "mvin")); number != "" {
+		metadata.Series.Position, _ = strconv.ParseFloat(number, 64)
+	}
+
+	return metadata
+}
+
+// firstTag returns the value of the first of the tags that is set.
+func firstTag(tags map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := strings.TrimSpace(tags[key]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// lowerKeys returns a copy of the tags with lower case keys.
+func lowerKeys(tags map[string]string) map[string]string {
+	lower := map[string]string{}
+	for key, value := range tags {
+		lower[strings.ToLower(key)] = value
+	}
+	return lower
+}
@@ -0,0 +1,173 @@
+// This file is responsible for measuring and normalizing the loudness of an audiobook (EBU R128).
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// LoudnessOptions describes how the loudness of the audiobook is normalized.
+type LoudnessOptions struct {
+	Mode     string  // off, normalize (changes the audio) or tag (only writes ReplayGain/iTunNORM tags)
+	Target   float64 // Integrated loudness target in LUFS
+	TruePeak float64 // Maximum true peak in dBTP
+}
+
+// LoudnessStats contains the loudness of the audiobook measured by the first pass.
+type LoudnessStats struct {
+	Integrated float64 // Integrated loudness in LUFS
+	TruePeak   float64 // True peak in dBTP
+	LRA        float64 // Loudness range in LU
+	Threshold  float64 // Relative gating threshold in LUFS
+}
+
+// replayGainReference is the loudness ReplayGain 2.0 gains are calculated against.
+const replayGainReference = -18.0
+
+// Validate checks that the loudness options are valid.
+func (o LoudnessOptions) Validate() error {
+	switch o.Mode {
+	case "off", "normalize", "tag":
+	default:
+		return fmt.Errorf("invalid loudness mode '%s' (valid: off, normalize, tag)", o.Mode)
+	}
+	if o.Target < -70 || o.Target > -5 {
+		return fmt.Errorf("loudness target must be between -70 and -5 LUFS")
+	}
+	if o.TruePeak < -9 || o.TruePeak > 0 {
+		return fmt.Errorf("true peak must be between -9 and 0 dBTP")
+	}
+	return nil
+}
+
+// MeasureLoudness runs the first pass of the loudness normalization over the whole concatenated book.
+// It returns the integrated loudness, true peak and loudness range measured by ffmpeg's loudnorm filter.
+func MeasureLoudness(ctx context.Context, files []string, opts LoudnessOptions) (LoudnessStats, error) {
+
+	fmt.Println("Measuring loudness...")
+
+	var stats LoudnessStats
+
+	// Create a slice to store the command line arguments
+	var args []string
+
+	// Append the input file paths to the arguments slice using the "concat" format
+	args = append(args, "-hide_banner", "-nostats", "-i", "concat:"+strings.Join(files, "|"))
+
+	// Analyses the audio, and discards the output
+	args = append(args, "-map", "0:a", "-af", fmt.Sprintf("loudnorm=I=%g:TP=%g:print_format=json", opts.Target, opts.TruePeak))
+	args = append(args, "-f", "null", "-")
+
+	// Create a new command using the ffmpeg executable and the arguments
+	cmd := newCommand(ctx, FFmpegBinary, args...)
+
+	// The measurements are printed to stderr, after the rest of the log
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println("Output:", string(output))
+		return stats, fmt.Errorf("error running ffmpeg command: %w", err)
+	}
+
+	// Finds the JSON block at the end of the output
+	text := string(output)
+	start := strings.LastIndex(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start == -1 || end < start {
+		return stats, fmt.Errorf("loudness measurements not found in ffmpeg output")
+	}
+
+	// The values are all strings in the loudnorm output
+	var rsp map[string]string
+	if err := json.Unmarshal([]byte(text[start:end+1]), &rsp); err != nil {
+		return stats, fmt.Errorf("error decoding loudness measurements: %w", err)
+	}
+
+	// Converts the measurements to numbers
+	values := map[string]*float64{
+		"input_i":      &stats.Integrated,
+		"input_tp":     &stats.TruePeak,
+		"input_lra":    &stats.LRA,
+		"input_thresh": &stats.Threshold,
+	}
+	for key, value := range values {
+		*value, err = strconv.ParseFloat(rsp[key], 64)
+		if err != nil {
+			return stats, fmt.Errorf("error decoding loudness measurement %s: %w", key, err)
+		}
+	}
+
+	// Silence is reported as -inf, which can't be normalized
+	if math.IsInf(stats.Integrated, 0) {
+		return stats, fmt.Errorf("the audio is silent, loudness can't be measured")
+	}
+
+	return stats, nil
+}
+
+// Gain returns the linear gain in dB that brings the audio to the target loudness.
+// The gain is capped so the true peak does not go over the target true peak, which means quiet
+// books with loud peaks may end up below the target rather than being compressed.
+func (s LoudnessStats) Gain(opts LoudnessOptions) float64 {
+	gain := opts.Target - s.Integrated
+	if s.TruePeak+gain > opts.TruePeak {
+		gain = opts.TruePeak - s.TruePeak
+	}
+	return gain
+}
+
+// Filter returns the ffmpeg filter for the second pass of the normalization.
+// The same gain is applied to every chapter, so the whole book plays at one consistent loudness.
+func (s LoudnessStats) Filter(opts LoudnessOptions) string {
+	return fmt.Sprintf("volume=%.2fdB", s.Gain(opts))
+}
+
+// ReplayGainTags returns the ReplayGain and iTunNORM tags for the measured loudness.
+// The book is treated as a single album, so the track and album values are the same for every file.
+func (s LoudnessStats) ReplayGainTags() map[string]string {
+
+	// ReplayGain 2.0 uses -18 LUFS as the reference loudness
+	gain := fmt.Sprintf("%.2f dB", replayGainReference-s.Integrated)
+	peak := fmt.Sprintf("%.6f", math.Pow(10, s.TruePeak/20))
+
+	return map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": gain,
+		"REPLAYGAIN_TRACK_PEAK": peak,
+		"REPLAYGAIN_ALBUM_GAIN": gain,
+		"REPLAYGAIN_ALBUM_PEAK": peak,
+		"iTunNORM":              s.ITunNORM(),
+	}
+}
+
+// ITunNORM returns the Sound Check value used by iTunes and Apple devices.
+// It is made of ten hex values, the first four are the gain for the left and right channels
+// (at a reference of 1000 and 2500), and the 7th and 8th are the peak sample values.
+func (s LoudnessStats) ITunNORM() string {
+
+	// Sound Check stores the inverse of the gain as a power ratio
+	adjust := math.Pow(10, -(replayGainReference-s.Integrated)/10)
+	clamp := func(v float64) uint32 {
+		return uint32(math.Max(0, math.Min(65534, math.Round(v))))
+	}
+	g1000 := clamp(1000 * adjust)
+	g2500 := clamp(2500 * adjust)
+	peak := clamp(math.Pow(10, s.TruePeak/20) * 32768)
+
+	values := []uint32{g1000, g1000, g2500, g2500, 0, 0, peak, peak, 0, 0}
+
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%08X", v))
+	}
+
+	return " " + strings.Join(parts, " ")
+}
+
+// ToString returns a string representation of the LoudnessStats struct.
+func (s LoudnessStats) ToString() string {
+	return fmt.Sprintf("Integrated: %.1f LUFS, True Peak: %.1f dBTP, LRA: %.1f LU", s.Integrated, s.TruePeak, s.LRA)
+}
@@ -0,0 +1,287 @@
+// This file is responsible for the manifest of a book, which records what was planned and what was finished, so a
+// run that stops part way can be resumed.
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// ManifestName is the name of the manifest in the output directory.
+const ManifestName = ".libby-chapterizer.json"
+
+// manifestVersion is the version of the manifest layout, a manifest with another version is not resumed.
+const manifestVersion = 1
+
+// Manifest records the plan of the outputs in a directory, and which of their files were finished.
+type Manifest struct {
+	Version  int               `json:"version"`
+	Tool     string            `json:"tool"`
+	ASIN     string            `json:"asin,omitempty"`
+	Title    string            `json:"title"`
+	Inputs   []ManifestInput   `json:"inputs"`
+	Chapters []Chapter         `json:"chapters"`
+	Outputs  []*ManifestOutput `json:"outputs"`
+
+	dir string // The directory the manifest is written to
+}
+
+// ManifestInput is one of the audio files the book was made from.
+type ManifestInput struct {
+	Path string `json:"path"` // The name of the file, so the book can be moved
+	Size int64  `json:"size"`
+	Hash string `json:"sha256"`
+}
+
+// ManifestOutput is one of the outputs written to the directory.
+type ManifestOutput struct {
+	Output   string         `json:"output"`  // The output as format:layout[:template]
+	Encoder  string         `json:"encoder"` // The encoder settings, the output is made again if they change
+	Complete bool           `json:"complete"`
+	Files    []ManifestFile `json:"files"`
+}
+
+// ManifestFile is one of the files of an output.
+type ManifestFile struct {
+	Path     string `json:"path"`
+	Written  string `json:"written,omitempty"` // The name the file was written with, if the overwrite policy renamed it
+	LengthMs int    `json:"lengthMs"`
+	Size     int64  `json:"size,omitempty"`
+	Complete bool   `json:"complete"`
+}
+
+// ReadManifest reads the manifest in the directory. An empty manifest is returned if there is none, or if it was
+// written by a version of the manifest that can't be resumed.
+func ReadManifest(dir string) (*Manifest, error) {
+
+	manifest := &Manifest{Version: manifestVersion, dir: dir}
+
+	data, err := os.ReadFile(path.Join(dir, ManifestName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var existing Manifest
+	if err := json.Unmarshal(data, &existing); err != nil {
+		fmt.Println("Warning: the manifest in " + dir + " can't be read, the outputs are made again")
+		return manifest, nil
+	}
+	if existing.Version != manifestVersion {
+		return manifest, nil
+	}
+	existing.dir = dir
+
+	return &existing, nil
+}
+
+// HashInputs gets the size and hash of each of the audio files, so a change to them is noticed.
+func HashInputs(files []string) ([]ManifestInput, error) {
+
+	var inputs []ManifestInput
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("error opening input: %w", err)
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error hashing %s: %w", file, err)
+		}
+
+		inputs = append(inputs, ManifestInput{Path: path.Base(file), Size: size, Hash: hex.EncodeToString(hash.Sum(nil))})
+	}
+
+	return inputs, nil
+}
+
+// Prepare records the plan of the book. If the inputs or chapters changed since the manifest was written, or force
+// is set, none of the outputs are treated as finished.
+func (m *Manifest) Prepare(tool, asin, title string, inputs []ManifestInput, chapters []Chapter, force bool) {
+
+	if force || !sameJSON(m.Inputs, inputs) || !sameJSON(m.Chapters, chapters) {
+		m.Outputs = nil
+	}
+
+	m.Version = manifestVersion
+	m.Tool = tool
+	m.ASIN = asin
+	m.Title = title
+	m.Inputs = inputs
+	m.Chapters = chapters
+}
+
+// PlanOutput records the files of the output, and returns it. A file is only kept as finished if the output was
+// planned the same way before, and the file still has the size it was written with and is as long as its chapter.
+func (m *Manifest) PlanOutput(ctx context.Context, target OutputTarget, meta Metadata, asin, outputDir string, opts VerifyOptions) *ManifestOutput {
+
+	output := &ManifestOutput{Output: target.ToString(), Encoder: target.Encoder.ToString()}
+	if target.Encoder.Filter != "" {
+		output.Encoder += ", filter " + target.Encoder.Filter
+	}
+
+	if target.Single {
+		lengthMs := 0
+		if len(meta.Chapters) > 0 {
+			last := meta.Chapters[len(meta.Chapters)-1]
+			lengthMs = last.StartOffsetMs + last.LengthMs
+		}
+		output.Files = append(output.Files, ManifestFile{Path: path.Base(target.GetSingleFilePath(meta, asin, outputDir)), LengthMs: lengthMs})
+	} else {
+		for i, chapter := range meta.Chapters {
+			output.Files = append(output.Files, ManifestFile{Path: SplitFileName(i+1, chapter.Title, target.Format.Extension), LengthMs: chapter.LengthMs})
+		}
+	}
+
+	// Keeps the files that were finished by an earlier run
+	index := -1
+	for i, previous := range m.Outputs {
+		if previous.Output == output.Output {
+			index = i
+		}
+	}
+	if index >= 0 && m.Outputs[index].Encoder == output.Encoder && len(m.Outputs[index].Files) == len(output.Files) {
+		for i, previous := range m.Outputs[index].Files {
+			if previous.Complete && previous.Path == output.Files[i].Path && m.checkFile(ctx, previous, opts) {
+				output.Files[i] = previous
+			}
+		}
+	}
+	output.Complete = output.isComplete()
+
+	if index >= 0 {
+		m.Outputs[index] = output
+	} else {
+		m.Outputs = append(m.Outputs, output)
+	}
+	return output
+}
+
+// Finish records that the file of the output was written with the name, and saves the manifest.
+func (m *Manifest) Finish(output *ManifestOutput, index int, name string) error {
+
+	file := &output.Files[index]
+	info, err := os.Stat(path.Join(m.dir, name))
+	if err != nil {
+		return fmt.Errorf("error checking output file: %w", err)
+	}
+	file.Written = ""
+	if name != file.Path {
+		file.Written = name
+	}
+	file.Size = info.Size()
+	file.Complete = true
+	output.Complete = output.isComplete()
+
+	return m.Save()
+}
+
+// Save writes the manifest to the directory, through a temporary file so it is never left half written.
+func (m *Manifest) Save() error {
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+
+	file := path.Join(m.dir, ManifestName)
+	if err := os.WriteFile(file+".tmp", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	return nil
+}
+
+// Progress returns the split progress of the output, which skips the finished files. As each of the others is
+// written it is placed, and recorded with the name it was placed with (it is not recorded if it was skipped).
+func (m *Manifest) Progress(output *ManifestOutput, place func(index int) (string, error)) *SplitProgress {
+
+	progress := &SplitProgress{Skip: map[int]bool{}}
+	for i, file := range output.Files {
+		if file.Complete {
+			progress.Skip[i] = true
+		}
+	}
+	progress.Finished = func(index int) error {
+		name, err := place(index)
+		if err != nil || name == "" {
+			return err
+		}
+		return m.Finish(output, index, name)
+	}
+
+	return progress
+}
+
+// Remaining returns the number of files of the output that still have to be written.
+func (o ManifestOutput) Remaining() int {
+	remaining := 0
+	for _, file := range o.Files {
+		if !file.Complete {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// isComplete checks if every file of the output was written.
+func (o ManifestOutput) isComplete() bool {
+	return len(o.Files) > 0 && o.Remaining() == 0
+}
+
+// WrittenPath returns the path the file of the output was written to, which is the planned path unless the
+// overwrite policy renamed it.
+func (m *Manifest) WrittenPath(output, planned string) string {
+
+	if m == nil {
+		return planned
+	}
+	for _, recorded := range m.Outputs {
+		if recorded.Output != output {
+			continue
+		}
+		for _, file := range recorded.Files {
+			if file.Path == path.Base(planned) && file.Written != "" {
+				return path.Join(path.Dir(planned), file.Written)
+			}
+		}
+	}
+
+	return planned
+}
+
+// checkFile checks a finished file still has the size it was written with, and is as long as its chapter.
+func (m *Manifest) checkFile(ctx context.Context, file ManifestFile, opts VerifyOptions) bool {
+
+	filePath := path.Join(m.dir, file.Path)
+	if file.Written != "" {
+		filePath = path.Join(m.dir, file.Written)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil || info.Size() != file.Size {
+		return false
+	}
+
+	return len(verifyFile(ctx, filePath, file.LengthMs, opts).Problems) == 0
+}
+
+// sameJSON checks if the two values are encoded the same, which is how they were compared when the manifest was read.
+func sameJSON(a, b any) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+)
+
+// testManifestPlan plans an mp3 output split into the chapters of the metadata.
+func testManifestPlan(t *testing.T, m *Manifest, meta Metadata) *ManifestOutput {
+	target, err := ParseOutputTarget("mp3:split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.PlanOutput(context.Background(), target, meta, "", m.dir, VerifyOptions{ToleranceMs: 1000})
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+
+	dir := t.TempDir()
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Outputs) != 0 {
+		t.Fatalf("new manifest has %d outputs", len(m.Outputs))
+	}
+
+	inputs := []ManifestInput{{Path: "Part 1.mp3", Size: 10, Hash: "abc"}}
+	meta := Metadata{Title: "Book", Chapters: testChapters(3, 10)}
+	m.Prepare("dev", "B000000000", "Book", inputs, meta.Chapters, false)
+	output := testManifestPlan(t, m, meta)
+	if len(output.Files) != 3 || output.Remaining() != 3 || output.Complete {
+		t.Fatalf("planned %d files with %d remaining (complete %v), want 3 remaining", len(output.Files), output.Remaining(), output.Complete)
+	}
+
+	// Finishes the first file under its own name, and the second under the name the overwrite policy gave it
+	os.WriteFile(path.Join(dir, output.Files[0].Path), []byte("one"), 0644)
+	os.WriteFile(path.Join(dir, "renamed.mp3"), []byte("two!"), 0644)
+	if err := m.Finish(output, 0, output.Files[0].Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Finish(output, 1, "renamed.mp3"); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameJSON(read, m) {
+		t.Fatalf("read manifest differs from the saved one")
+	}
+	files := read.Outputs[0].Files
+	if !files[0].Complete || files[0].Written != "" || files[0].Size != 3 {
+		t.Errorf("file 1 = %+v, want complete with size 3", files[0])
+	}
+	if !files[1].Complete || files[1].Written != "renamed.mp3" || files[1].Size != 4 {
+		t.Errorf("file 2 = %+v, want complete, written as renamed.mp3 with size 4", files[1])
+	}
+	if read.Outputs[0].Remaining() != 1 {
+		t.Errorf("remaining = %d, want 1", read.Outputs[0].Remaining())
+	}
+
+	progress := read.Progress(read.Outputs[0], func(int) (string, error) { return "", nil })
+	if !progress.Skip[0] || !progress.Skip[1] || progress.Skip[2] {
+		t.Errorf("skipped = %v, want the first two files", progress.Skip)
+	}
+}
+
+func TestManifestPrepare(t *testing.T) {
+
+	inputs := []ManifestInput{{Path: "Part 1.mp3", Size: 10, Hash: "abc"}}
+	chapters := testChapters(2, 10)
+
+	tests := []struct {
+		name     string
+		inputs   []ManifestInput
+		chapters []Chapter
+		force    bool
+		kept     bool
+	}{
+		{"unchanged", inputs, chapters, false, true},
+		{"forced", inputs, chapters, true, false},
+		{"inputs changed", []ManifestInput{{Path: "Part 1.mp3", Size: 10, Hash: "def"}}, chapters, false, false},
+		{"chapters changed", inputs, testChapters(3, 10), false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &Manifest{Version: manifestVersion, dir: t.TempDir(), Inputs: inputs, Chapters: chapters,
+				Outputs: []*ManifestOutput{{Output: "mp3:split"}}}
+			m.Prepare("dev", "", "Book", test.inputs, test.chapters, test.force)
+			if kept := len(m.Outputs) == 1; kept != test.kept {
+				t.Errorf("outputs kept = %v, want %v", kept, test.kept)
+			}
+		})
+	}
+}
+
+func TestManifestPlanOutputChecksFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	meta := Metadata{Title: "Book", Chapters: testChapters(2, 10)}
+	m := &Manifest{Version: manifestVersion, dir: dir}
+	output := testManifestPlan(t, m, meta)
+	for i := range output.Files {
+		os.WriteFile(path.Join(dir, output.Files[i].Path), []byte("data"), 0644)
+		if err := m.Finish(output, i, output.Files[i].Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A file that changed size since it was finished is made again
+	os.WriteFile(path.Join(dir, output.Files[1].Path), []byte("changed"), 0644)
+	output = testManifestPlan(t, m, meta)
+	if output.Files[1].Complete || output.Complete {
+		t.Errorf("file 2 = %+v, want it made again", output.Files[1])
+	}
+
+	// A different encoder means every file is made again
+	m.Outputs[0].Encoder = "other"
+	m.Outputs[0].Files[0].Complete = true
+	if output = testManifestPlan(t, m, meta); output.Remaining() != 2 {
+		t.Errorf("remaining = %d after the encoder changed, want 2", output.Remaining())
+	}
+}
+
+func TestReadManifestInvalid(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"not json", "{"},
+		{"other version", `{"version": 99, "outputs": [{"output": "mp3:split"}]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(path.Join(dir, ManifestName), []byte(test.content), 0644)
+			m, err := ReadManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Outputs) != 0 || m.Version != manifestVersion {
+				t.Errorf("manifest = %+v, want an empty one", m)
+			}
+		})
+	}
+}
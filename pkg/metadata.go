@@ -1,9 +1,9 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os/exec"
 	"regexp"
@@ -179,10 +179,14 @@ type Metadata struct {
 	Author    string
 	Narrator  string
 	Publisher string
+	Year      string
 	Duration  Duration
 	Summary   string
 	Abridged  bool
 	Chapters  []Chapter
+	Cover     []byte            // Embedded cover image, e.g. from the ID3 tags of the parts
+	CoverType string            // MIME type of the cover image
+	Tags      map[string]string // Extra tags written to the output, e.g. ReplayGain
 }
 
 // ToString returns a string representation of the Process struct.
@@ -214,15 +218,28 @@ func (o Openbook) CalculateRuntime() int {
 	return int(totalDuration)
 }
 
+// RuntimeMS returns the total duration of the audio in the Openbook in milliseconds.
+func (o Openbook) RuntimeMS() int {
+	totalDuration := 0.0
+	for _, item := range o.Spine {
+		totalDuration += item.AudioDuration
+	}
+	return int(totalDuration * 1000)
+}
+
 // GetMetadataFromASIN retrieves metadata for a book based on its ASIN.
-func GetMetadataFromASIN(asin string) (Metadata, error) {
+func GetMetadataFromASIN(ctx context.Context, asin string) (Metadata, error) {
 	metadata := Metadata{} // Starts with an empty Metadata struct
 
 	// Construct the request URL for the top level metadata
 	requestURL := fmt.Sprintf("https://api.audnex.us/books/%s", asin)
 
-	// Send an HTTP GET request to the API
-	response, err := http.Get(requestURL)
+	// Send an HTTP GET request to the API, which is cancelled with the context
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return metadata, fmt.Errorf("error creating request: %w", err)
+	}
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return metadata, fmt.Errorf("error making request: %w", err)
 	}
@@ -253,6 +270,11 @@ func GetMetadataFromASIN(asin string) (Metadata, error) {
 		metadata.Summary = summary
 	}
 
+	// Gets the year of the release date and assigns it
+	if date, ok := rsp["releaseDate"].(string); ok && len(date) >= 4 {
+		metadata.Year = date[:4]
+	}
+
 	// Gets the abridged status and assigns it
 	if abridged, ok := rsp["abridged"].(string); ok {
 		switch abridged {
@@ -349,7 +371,7 @@ func GetMetadataLocal(openbook Openbook) (Metadata, error) {
 }
 
 // GetChaptersLocal retrieves the chapters of a book and their durations from local mp3 files.
-func GetChaptersLocal(book Openbook, mp3s []string) ([]Chapter, error) {
+func GetChaptersLocal(ctx context.Context, book Openbook, mp3s []string) ([]Chapter, error) {
 	// chapters will store the information about each chapter
 	var chapters []ChapterInfo
 
@@ -367,12 +389,9 @@ func GetChaptersLocal(book Openbook, mp3s []string) ([]Chapter, error) {
 				path = mp3
 
 				// Get the duration of the mp3 file
-				milli, err := GetFileDurationMS(path)
+				milli, err := GetFileDurationMS(ctx, path)
 				if err != nil {
-					log.Fatalf("Error getting duration: %v", err)
-				} else {
-					path = ""
-					fileDuration = Duration{}
+					return nil, fmt.Errorf("error getting duration: %w", err)
 				}
 
 				fileDuration = CalculateDuration(milli)
@@ -454,64 +473,18 @@ func (m Metadata) ToString() string {
 			"Series:    %s\n"+
 			"Position:  %f\n"+
 			"Publisher: %s\n"+
+			"Year:      %s\n"+
 			"Chapters:  %d\n"+
 			"Duration:  %s\n"+
 			"Abridged:  %t\n"+
 			"Summary:   %s",
 		m.ASIN, m.Title, m.Author, m.Series.Name, m.Series.Position,
-		m.Publisher, len(m.Chapters), m.Duration.ToString(), m.Abridged, m.Summary,
+		m.Publisher, m.Year, len(m.Chapters), m.Duration.ToString(), m.Abridged, m.Summary,
 	)
 }
 
 // ToFFMPEGMetadata converts the Metadata struct to a string representation of FFmpeg metadata.
+// Keys and values are escaped, so titles and summaries can contain any character.
 func (m Metadata) ToFFMPEGMetadata() string {
-	// Initialize the metadata string with the FFmpeg metadata version.
-	metadata := ";FFMETADATA1\n"
-
-	// Add the title metadata.
-	metadata += "title=" + m.Title + "\n"
-
-	// Add the series metadata.
-	metadata += "series=" + m.Series.Name + "\n"
-
-	// Add the number metadata with formatted float value.
-	metadata += fmt.Sprintf("number=%f\n", m.Series.Position)
-
-	// Add the author metadata.
-	metadata += "author=" + m.Author + "\n"
-
-	// Add the publisher metadata.
-	metadata += "publisher=" + m.Publisher + "\n"
-
-	// Add the ASIN metadata if it is not empty.
-	if m.ASIN != "" {
-		metadata += "asin=" + m.ASIN + "\n"
-	}
-
-	// Add a new line for separation.
-	metadata += "\n"
-
-	// Add the chapter metadata for each chapter in the list.
-	for _, chapter := range m.Chapters {
-		// Add the chapter header.
-		metadata += "[CHAPTER]\n"
-
-		// Add the chapter timebase.
-		metadata += "TIMEBASE=1/1000\n"
-
-		// Add the chapter start offset.
-		metadata += "START=" + strconv.Itoa(chapter.StartOffsetMs) + "\n"
-
-		// Add the chapter end offset.
-		metadata += "END=" + strconv.Itoa(chapter.StartOffsetMs+chapter.LengthMs) + "\n"
-
-		// Add the chapter title.
-		metadata += "title=" + chapter.Title + "\n"
-
-		// Add a new line for separation.
-		metadata += "\n"
-	}
-
-	// Return the generated metadata string.
-	return metadata
+	return m.ToFFMetadata().String()
 }
@@ -0,0 +1,511 @@
+// This file is responsible for reading MP3 files natively, to get their exact duration and an index of their frames.
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// MPEG audio versions, as stored in the frame header.
+const (
+	mpegVersion25 = 0
+	mpegVersion2  = 2
+	mpegVersion1  = 3
+)
+
+// decoderDelay is the delay MP3 decoders add to the start of the audio, which gapless players remove
+// along with the encoder delay from the LAME header.
+const decoderDelay = 529
+
+var mp3Bitrates = map[[2]int][]int{
+	{mpegVersion1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{mpegVersion1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{mpegVersion1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{mpegVersion2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{mpegVersion2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{mpegVersion2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mp3SampleRates = map[int][]int{
+	mpegVersion1:  {44100, 48000, 32000},
+	mpegVersion2:  {22050, 24000, 16000},
+	mpegVersion25: {11025, 12000, 8000},
+}
+
+// MP3FrameHeader is a decoded MPEG audio frame header.
+type MP3FrameHeader struct {
+	Version    int // mpegVersion1, mpegVersion2 or mpegVersion25
+	Layer      int // 1, 2 or 3
+	Protected  bool
+	Bitrate    int // kbps
+	SampleRate int
+	Padding    bool
+	Channels   int
+	Raw        uint32
+}
+
+// MP3Info describes an MP3 file, and holds the offset of every audio frame in it.
+type MP3Info struct {
+	Path            string
+	Version         int
+	Layer           int
+	SampleRate      int
+	Channels        int
+	SamplesPerFrame int
+	AudioStart      int64   // Offset of the first frame, after any ID3v2 tags
+	AudioEnd        int64   // Offset after the last frame, before any ID3v1 or APE tags
+	InfoFrame       int64   // Offset of the Xing/Info/VBRI frame, -1 if there is none
+	FrameOffsets    []int64 // Offset of each audio frame, the info frame is not included
+	VBR             bool    // Set if the file has a Xing or VBRI header, or the bitrate changes
+	EncoderDelay    int     // From the LAME header, -1 if it is not known
+	EncoderPadding  int     // From the LAME header, -1 if it is not known
+	HeaderFrames    int     // Number of frames listed in the Xing or VBRI header, 0 if there is none
+	Encoder         string  // Encoder version from the LAME header, e.g. "LAME3.100"
+}
+
+// mp3Cache holds the results of ScanMP3, so a file is only scanned once per run.
+var mp3Cache = map[string]*MP3Info{}
+var mp3Mutex sync.Mutex
+
+// ScanMP3 reads every frame header of the MP3 file, and the Xing, VBRI and LAME headers if it has them.
+// Results are cached by path, size and modification time, so repeated calls are free.
+func ScanMP3(filepath string) (*MP3Info, error) {
+
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+
+	// Returns the cached result, if there is one
+	key := fmt.Sprintf("%s|%d|%d", filepath, stat.Size(), stat.ModTime().UnixNano())
+	mp3Mutex.Lock()
+	cached, ok := mp3Cache[key]
+	mp3Mutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	info := &MP3Info{Path: filepath, InfoFrame: -1, EncoderDelay: -1, EncoderPadding: -1}
+
+	// Finds where the audio starts and ends, around the tags
+	info.AudioStart, err = skipID3v2(file)
+	if err != nil {
+		return nil, err
+	}
+	info.AudioEnd, err = findTagsAtEnd(file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(info.AudioStart, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	reader := bufio.NewReaderSize(file, 64*1024)
+
+	// Walks the frames
+	offset := info.AudioStart
+	var first *MP3FrameHeader
+	bitrate := 0
+	for offset+4 <= info.AudioEnd {
+
+		peek, err := reader.Peek(4)
+		if err != nil {
+			break
+		}
+		header, ok := ParseMP3FrameHeader(binary.BigEndian.Uint32(peek))
+
+		// Frames must match the first frame, anything else is junk and is skipped until the next frame
+		if ok && first != nil && (header.Version != first.Version || header.Layer != first.Layer || header.SampleRate != first.SampleRate) {
+			ok = false
+		}
+		size := 0
+		if ok {
+			size = header.FrameSize()
+		}
+		if !ok || size <= 4 || offset+int64(size) > info.AudioEnd {
+			if ok && first != nil && offset+int64(size) > info.AudioEnd {
+				// The last frame is cut short
+				break
+			}
+			if _, err := reader.Discard(1); err != nil {
+				break
+			}
+			offset++
+			continue
+		}
+
+		// The first frame may be a Xing, Info or VBRI frame instead of audio
+		if first == nil {
+			frame := make([]byte, size)
+			if _, err := io.ReadFull(reader, frame); err != nil {
+				break
+			}
+			first = &header
+			info.Version = header.Version
+			info.Layer = header.Layer
+			info.SampleRate = header.SampleRate
+			info.Channels = header.Channels
+			info.SamplesPerFrame = header.SamplesPerFrame()
+			bitrate = header.Bitrate
+			if info.parseInfoFrame(header, frame) {
+				info.InfoFrame = offset
+			} else {
+				info.FrameOffsets = append(info.FrameOffsets, offset)
+			}
+			offset += int64(size)
+			continue
+		}
+
+		if header.Bitrate != bitrate {
+			info.VBR = true
+		}
+		info.FrameOffsets = append(info.FrameOffsets, offset)
+		if _, err := reader.Discard(size); err != nil {
+			break
+		}
+		offset += int64(size)
+	}
+
+	if len(info.FrameOffsets) == 0 {
+		return nil, fmt.Errorf("no mp3 frames found in %s", filepath)
+	}
+
+	// Stores the result for the next call
+	mp3Mutex.Lock()
+	mp3Cache[key] = info
+	mp3Mutex.Unlock()
+
+	return info, nil
+}
+
+// ParseMP3FrameHeader decodes a frame header, it returns false if the value is not a valid header.
+// Free format bitrates are not supported.
+func ParseMP3FrameHeader(raw uint32) (MP3FrameHeader, bool) {
+
+	var h MP3FrameHeader
+	h.Raw = raw
+
+	if raw>>21 != 0x7FF {
+		return h, false
+	}
+
+	h.Version = int(raw>>19) & 3
+	layerBits := int(raw>>17) & 3
+	bitrateIndex := int(raw>>12) & 15
+	rateIndex := int(raw>>10) & 3
+	if h.Version == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return h, false
+	}
+
+	h.Layer = 4 - layerBits
+	h.Protected = (raw>>16)&1 == 0
+	h.Padding = (raw>>9)&1 == 1
+	h.SampleRate = mp3SampleRates[h.Version][rateIndex]
+	h.Channels = 2
+	if (raw>>6)&3 == 3 {
+		h.Channels = 1
+	}
+
+	// MPEG 2.5 uses the MPEG 2 bitrates
+	version := h.Version
+	if version == mpegVersion25 {
+		version = mpegVersion2
+	}
+	h.Bitrate = mp3Bitrates[[2]int{version, h.Layer}][bitrateIndex]
+
+	return h, true
+}
+
+// SamplesPerFrame returns the number of samples in each frame.
+func (h MP3FrameHeader) SamplesPerFrame() int {
+	switch {
+	case h.Layer == 1:
+		return 384
+	case h.Layer == 3 && h.Version != mpegVersion1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// FrameSize returns the size of the frame in bytes, including the header.
+func (h MP3FrameHeader) FrameSize() int {
+
+	padding := 0
+	if h.Padding {
+		padding = 1
+	}
+
+	if h.Layer == 1 {
+		return (12*h.Bitrate*1000/h.SampleRate + padding) * 4
+	}
+
+	return h.SamplesPerFrame()/8*h.Bitrate*1000/h.SampleRate + padding
+}
+
+// SideInfoSize returns the size of the Layer III side information, which follows the header (and CRC).
+func (h MP3FrameHeader) SideInfoSize() int {
+	if h.Version == mpegVersion1 {
+		if h.Channels == 1 {
+			return 17
+		}
+		return 32
+	}
+	if h.Channels == 1 {
+		return 9
+	}
+	return 17
+}
+
+// parseInfoFrame reads the Xing/Info (with the LAME extension) or VBRI header from the first frame.
+// It returns false if the frame is an audio frame.
+func (i *MP3Info) parseInfoFrame(h MP3FrameHeader, frame []byte) bool {
+
+	// The Xing header follows the side information
+	xing := 4 + h.SideInfoSize()
+	if len(frame) >= xing+8 && (bytes.Equal(frame[xing:xing+4], []byte("Xing")) || bytes.Equal(frame[xing:xing+4], []byte("Info"))) {
+
+		i.VBR = string(frame[xing:xing+4]) == "Xing"
+		flags := binary.BigEndian.Uint32(frame[xing+4:])
+		pos := xing + 8
+		if flags&1 != 0 && len(frame) >= pos+4 {
+			i.HeaderFrames = int(binary.BigEndian.Uint32(frame[pos:]))
+			pos += 4
+		}
+		if flags&2 != 0 {
+			pos += 4
+		}
+		if flags&4 != 0 {
+			pos += 100
+		}
+		if flags&8 != 0 {
+			pos += 4
+		}
+
+		// The LAME extension holds the encoder delay and padding, 21 bytes in
+		if len(frame) >= pos+24 && isEncoderTag(frame[pos:pos+4]) {
+			i.Encoder = string(bytes.TrimRight(frame[pos:pos+9], "\x00 "))
+			delay := frame[pos+21 : pos+24]
+			i.EncoderDelay = int(delay[0])<<4 | int(delay[1])>>4
+			i.EncoderPadding = int(delay[1]&0x0F)<<8 | int(delay[2])
+		}
+
+		return true
+	}
+
+	// The VBRI header is always 32 bytes after the header
+	if len(frame) >= 4+32+18 && bytes.Equal(frame[36:40], []byte("VBRI")) {
+		i.VBR = true
+		i.EncoderDelay = int(binary.BigEndian.Uint16(frame[42:]))
+		i.HeaderFrames = int(binary.BigEndian.Uint32(frame[50:]))
+		return true
+	}
+
+	return false
+}
+
+// TotalSamples returns the number of samples in the audio frames, without removing the encoder delay and padding.
+func (i *MP3Info) TotalSamples() int64 {
+	return int64(len(i.FrameOffsets)) * int64(i.SamplesPerFrame)
+}
+
+// StartSkip returns the number of samples a gapless decoder removes from the start of the audio.
+func (i *MP3Info) StartSkip() int {
+	if i.EncoderDelay < 0 {
+		return 0
+	}
+	return i.EncoderDelay + decoderDelay
+}
+
+// PlayableSamples returns the number of samples that are played, without the encoder delay and padding.
+func (i *MP3Info) PlayableSamples() int64 {
+	samples := i.TotalSamples()
+	if i.EncoderDelay >= 0 && i.EncoderPadding >= 0 {
+		samples -= int64(i.EncoderDelay + i.EncoderPadding)
+	}
+	return max(samples, 0)
+}
+
+// DurationMS returns the exact duration of the file in milliseconds, counted from the frames.
+func (i *MP3Info) DurationMS() int {
+	return int(i.PlayableSamples() * 1000 / int64(i.SampleRate))
+}
+
+// Bitrate returns the average bitrate of the audio frames in kbps.
+func (i *MP3Info) Bitrate() int {
+	bytes := i.AudioEnd - i.FrameOffsets[0]
+	seconds := float64(i.TotalSamples()) / float64(i.SampleRate)
+	if seconds == 0 {
+		return 0
+	}
+	return int(float64(bytes) * 8 / seconds / 1000)
+}
+
+// FrameEnd returns the offset after the frame at the index.
+func (i *MP3Info) FrameEnd(index int) int64 {
+	if index+1 < len(i.FrameOffsets) {
+		return i.FrameOffsets[index+1]
+	}
+	return i.AudioEnd
+}
+
+// FrameAtMS returns the index of the frame that is playing at the time in milliseconds,
+// on the timeline a gapless player uses (after the start skip is removed).
+func (i *MP3Info) FrameAtMS(ms int) int {
+	sample := int64(ms)*int64(i.SampleRate)/1000 + int64(i.StartSkip())
+	index := int(sample / int64(i.SamplesPerFrame))
+	return min(max(index, 0), len(i.FrameOffsets))
+}
+
+// FrameStartMS returns the time in milliseconds the frame at the index starts playing, on the gapless timeline.
+func (i *MP3Info) FrameStartMS(index int) int {
+	sample := int64(index)*int64(i.SamplesPerFrame) - int64(i.StartSkip())
+	return int(max(sample, 0) * 1000 / int64(i.SampleRate))
+}
+
+// MP3Timeline places the frames of several MP3 files one after another, like the parts of a Libby download.
+type MP3Timeline struct {
+	Files  []*MP3Info
+	Starts []int // Start of each file on the timeline in milliseconds
+}
+
+// TimelinePosition is a frame in one of the files of a timeline.
+type TimelinePosition struct {
+	File  int // Index of the file
+	Frame int // Index of the frame in the file, may equal the number of frames at the end of a file
+}
+
+// BuildMP3Timeline scans each of the files, and places them one after another.
+func BuildMP3Timeline(files []string) (MP3Timeline, error) {
+
+	var timeline MP3Timeline
+	start := 0
+	for _, file := range files {
+		info, err := ScanMP3(file)
+		if err != nil {
+			return timeline, err
+		}
+		timeline.Files = append(timeline.Files, info)
+		timeline.Starts = append(timeline.Starts, start)
+		start += info.DurationMS()
+	}
+
+	return timeline, nil
+}
+
+// TotalMS returns the duration of all the files together in milliseconds.
+func (t MP3Timeline) TotalMS() int {
+	if len(t.Files) == 0 {
+		return 0
+	}
+	return t.Starts[len(t.Starts)-1] + t.Files[len(t.Files)-1].DurationMS()
+}
+
+// Locate returns the frame nearest to the time in milliseconds on the timeline.
+func (t MP3Timeline) Locate(ms int) TimelinePosition {
+
+	if len(t.Files) == 0 {
+		return TimelinePosition{}
+	}
+
+	// Finds the file the time is in
+	file := sort.Search(len(t.Starts), func(i int) bool { return t.Starts[i] > ms }) - 1
+	file = max(file, 0)
+	info := t.Files[file]
+	local := ms - t.Starts[file]
+
+	// Rounds to the nearest frame boundary
+	frame := info.FrameAtMS(local)
+	if frame < len(info.FrameOffsets) && local-info.FrameStartMS(frame) > info.FrameStartMS(frame+1)-local {
+		frame++
+	}
+
+	return TimelinePosition{File: file, Frame: min(frame, len(info.FrameOffsets))}
+}
+
+// PositionMS returns the time in milliseconds of a position on the timeline.
+func (t MP3Timeline) PositionMS(pos TimelinePosition) int {
+	return t.Starts[pos.File] + t.Files[pos.File].FrameStartMS(pos.Frame)
+}
+
+// skipID3v2 returns the offset after any ID3v2 tags at the start of the file.
+func skipID3v2(file *os.File) (int64, error) {
+
+	offset := int64(0)
+	header := make([]byte, 10)
+	for {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return 0, fmt.Errorf("error reading file: %w", err)
+		}
+		if !bytes.Equal(header[:3], []byte("ID3")) {
+			return offset, nil
+		}
+
+		// The size is syncsafe, 7 bits per byte, and does not include the header (or footer)
+		offset += 10 + int64(syncsafe(header[6:10]))
+		if header[5]&0x10 != 0 {
+			offset += 10
+		}
+	}
+}
+
+// findTagsAtEnd returns the offset of any ID3v1 and APEv2 tags at the end of the file, or the size if there are none.
+func findTagsAtEnd(file *os.File, size int64) (int64, error) {
+
+	end := size
+
+	// ID3v1 is the last 128 bytes
+	if end >= 128 {
+		tag := make([]byte, 3)
+		if _, err := file.ReadAt(tag, end-128); err != nil {
+			return 0, fmt.Errorf("error reading file: %w", err)
+		}
+		if bytes.Equal(tag, []byte("TAG")) {
+			end -= 128
+		}
+	}
+
+	// APEv2 has a 32 byte footer, its size includes the items and the footer but not the header
+	if end >= 32 {
+		footer := make([]byte, 32)
+		if _, err := file.ReadAt(footer, end-32); err != nil {
+			return 0, fmt.Errorf("error reading file: %w", err)
+		}
+		if bytes.Equal(footer[:8], []byte("APETAGEX")) {
+			tagSize := int64(binary.LittleEndian.Uint32(footer[12:]))
+			flags := binary.LittleEndian.Uint32(footer[20:])
+			end -= tagSize
+			if flags&0x80000000 != 0 {
+				end -= 32
+			}
+		}
+	}
+
+	return max(end, 0), nil
+}
+
+// isEncoderTag checks if the bytes start an encoder tag in the LAME extension, e.g. "LAME" or "Lavf".
+func isEncoderTag(tag []byte) bool {
+	for _, prefix := range []string{"LAME", "Lavf", "Lavc", "GOGO", "L3.9"} {
+		if bytes.HasPrefix(tag, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+)
+
+// testMP3Header is an MPEG 1 Layer III frame header, 128 kbps at 44100 Hz in joint stereo, the frames are 417 bytes.
+const testMP3Header = 0xFFFB9044
+
+// testMP3 describes an MP3 file written by writeTestMP3.
+type testMP3 struct {
+	frames   int
+	id3v2    bool // Starts with an ID3v2 tag
+	id3v1    bool // Ends with an ID3v1 tag
+	junk     int  // Bytes of junk after the tenth frame
+	lame     bool // Starts with an Info frame with a LAME extension
+	delay    int
+	padding  int
+	truncate int // Bytes cut from the end of the last frame
+}
+
+// writeTestMP3 writes the MP3 file, and returns its path and the offset of its first frame.
+func writeTestMP3(t *testing.T, dir, name string, spec testMP3) (string, int64) {
+
+	var data []byte
+	if spec.id3v2 {
+		data = append(data, (&ID3Tag{Frames: []ID3Frame{NewID3TextFrame("TIT2", "Part")}}).Encode()...)
+	}
+	start := int64(len(data))
+
+	header, _ := ParseMP3FrameHeader(testMP3Header)
+	frame := func() []byte {
+		buf := make([]byte, header.FrameSize())
+		binary.BigEndian.PutUint32(buf, testMP3Header)
+		return buf
+	}
+
+	if spec.lame {
+		buf := frame()
+		pos := 4 + header.SideInfoSize()
+		copy(buf[pos:], "Info")
+		binary.BigEndian.PutUint32(buf[pos+4:], 0x0F)
+		binary.BigEndian.PutUint32(buf[pos+8:], uint32(spec.frames))
+		copy(buf[pos+120:], "LAME3.100")
+		buf[pos+120+21] = byte(spec.delay >> 4)
+		buf[pos+120+22] = byte(spec.delay&0x0F)<<4 | byte(spec.padding>>8)
+		buf[pos+120+23] = byte(spec.padding)
+		data = append(data, buf...)
+	}
+
+	for i := 0; i < spec.frames; i++ {
+		data = append(data, frame()...)
+		if i == 9 {
+			data = append(data, bytes.Repeat([]byte{0x55}, spec.junk)...)
+		}
+	}
+	data = data[:len(data)-spec.truncate]
+
+	if spec.id3v1 {
+		tag := make([]byte, 128)
+		copy(tag, "TAG")
+		data = append(data, tag...)
+	}
+
+	file := path.Join(dir, name)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file, start
+}
+
+func TestParseMP3FrameHeader(t *testing.T) {
+
+	tests := []struct {
+		raw        uint32
+		ok         bool
+		version    int
+		layer      int
+		bitrate    int
+		sampleRate int
+		channels   int
+		size       int
+	}{
+		{raw: 0xFFFB9044, ok: true, version: mpegVersion1, layer: 3, bitrate: 128, sampleRate: 44100, channels: 2, size: 417},
+		{raw: 0xFFFB9244, ok: true, version: mpegVersion1, layer: 3, bitrate: 128, sampleRate: 44100, channels: 2, size: 418},
+		{raw: 0xFFFB50C4, ok: true, version: mpegVersion1, layer: 3, bitrate: 64, sampleRate: 44100, channels: 1, size: 208},
+		{raw: 0xFFF360C4, ok: true, version: mpegVersion2, layer: 3, bitrate: 48, sampleRate: 22050, channels: 1, size: 156},
+		{raw: 0xFFE368C4, ok: true, version: mpegVersion25, layer: 3, bitrate: 48, sampleRate: 8000, channels: 1, size: 432},
+		{raw: 0xFFFD9044, ok: true, version: mpegVersion1, layer: 2, bitrate: 160, sampleRate: 44100, channels: 2, size: 522},
+		{raw: 0xFFFB0044, ok: false}, // Free format
+		{raw: 0xFFFBF044, ok: false}, // Bad bitrate
+		{raw: 0xFFFB9C44, ok: false}, // Reserved sample rate
+		{raw: 0xFFEB9044, ok: false}, // Reserved version
+		{raw: 0xFFF99044, ok: false}, // Reserved layer
+		{raw: 0x49443303, ok: false}, // ID3
+	}
+
+	for _, test := range tests {
+		h, ok := ParseMP3FrameHeader(test.raw)
+		if ok != test.ok {
+			t.Errorf("%08X: ok = %v, want %v", test.raw, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if h.Version != test.version || h.Layer != test.layer || h.Bitrate != test.bitrate || h.SampleRate != test.sampleRate ||
+			h.Channels != test.channels || h.FrameSize() != test.size {
+			t.Errorf("%08X = version %d layer %d %d kbps %d Hz %d channels %d bytes, want version %d layer %d %d kbps %d Hz %d channels %d bytes",
+				test.raw, h.Version, h.Layer, h.Bitrate, h.SampleRate, h.Channels, h.FrameSize(),
+				test.version, test.layer, test.bitrate, test.sampleRate, test.channels, test.size)
+		}
+	}
+}
+
+func TestScanMP3(t *testing.T) {
+
+	samples := func(frames, skipped int) int { return (frames*1152 - skipped) * 1000 / 44100 }
+
+	tests := []struct {
+		name       string
+		spec       testMP3
+		frames     int
+		durationMs int
+		delay      int
+		vbr        bool
+	}{
+		{name: "frames only", spec: testMP3{frames: 100}, frames: 100, durationMs: samples(100, 0), delay: -1},
+		{name: "ID3v2 and ID3v1 tags", spec: testMP3{frames: 100, id3v2: true, id3v1: true}, frames: 100, durationMs: samples(100, 0), delay: -1},
+		{name: "junk between frames", spec: testMP3{frames: 100, junk: 7}, frames: 100, durationMs: samples(100, 0), delay: -1},
+		{name: "truncated last frame", spec: testMP3{frames: 100, truncate: 100}, frames: 99, durationMs: samples(99, 0), delay: -1},
+		{name: "LAME header", spec: testMP3{frames: 100, id3v2: true, lame: true, delay: 576, padding: 1000},
+			frames: 100, durationMs: samples(100, 1576), delay: 576},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			file, start := writeTestMP3(t, t.TempDir(), "part.mp3", test.spec)
+			info, err := ScanMP3(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stat, _ := os.Stat(file)
+			end := stat.Size()
+			if test.spec.id3v1 {
+				end -= 128
+			}
+			if test.spec.lame {
+				if info.InfoFrame != start {
+					t.Errorf("info frame at %d, want %d", info.InfoFrame, start)
+				}
+				start += 417
+			}
+			if info.AudioStart > start || info.FrameOffsets[0] != start || info.AudioEnd != end {
+				t.Errorf("audio from %d (first frame %d) to %d, want %d to %d", info.AudioStart, info.FrameOffsets[0], info.AudioEnd, start, end)
+			}
+			if len(info.FrameOffsets) != test.frames {
+				t.Errorf("frames = %d, want %d", len(info.FrameOffsets), test.frames)
+			}
+			if info.DurationMS() != test.durationMs {
+				t.Errorf("duration = %d, want %d", info.DurationMS(), test.durationMs)
+			}
+			if info.EncoderDelay != test.delay || info.VBR != test.vbr {
+				t.Errorf("delay = %d vbr = %v, want %d and %v", info.EncoderDelay, info.VBR, test.delay, test.vbr)
+			}
+		})
+	}
+}
+
+func TestSplitMP3FilesInfoFrame(t *testing.T) {
+
+	dir := t.TempDir()
+	part1, _ := writeTestMP3(t, dir, "part1.mp3", testMP3{frames: 200, lame: true, delay: 576, padding: 1000})
+	part2, _ := writeTestMP3(t, dir, "part2.mp3", testMP3{frames: 200, lame: true, delay: 576, padding: 800})
+
+	// The second chapter spans the two parts, and the third runs to the end of the book (10381 ms)
+	chapters := []Chapter{
+		{Title: "One", StartOffsetMs: 0, LengthMs: 2000},
+		{Title: "Two", StartOffsetMs: 2000, StartOffsetSec: 2, LengthMs: 5000},
+		{Title: "Three", StartOffsetMs: 7000, StartOffsetSec: 7, LengthMs: 3381},
+	}
+	out := t.TempDir()
+	if err := SplitMP3Files(context.Background(), []string{part1, part2}, chapters, Metadata{Title: "Book"}, out, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The playable samples of the chapters add up to those of the book
+	total := int64(0)
+	for i, chapter := range chapters {
+		file := path.Join(out, SplitFileName(i+1, chapter.Title, "mp3"))
+		info, err := ScanMP3(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.InfoFrame < 0 || info.Encoder != "LAME3.100" || info.HeaderFrames != len(info.FrameOffsets) {
+			t.Errorf("chapter %d: info frame %d, encoder %q, %d frames in the header, want %d", i+1, info.InfoFrame, info.Encoder,
+				info.HeaderFrames, len(info.FrameOffsets))
+		}
+		total += info.PlayableSamples()
+
+		// The CRC of the LAME header covers the frame up to it
+		data, _ := os.ReadFile(file)
+		frame := data[info.InfoFrame:info.FrameOffsets[0]]
+		header, _ := ParseMP3FrameHeader(binary.BigEndian.Uint32(frame))
+		pos := 4 + header.SideInfoSize() + 120
+		crc := newCRC16()
+		crc.Write(frame[:pos+34])
+		if got := binary.BigEndian.Uint16(frame[pos+34:]); got != crc.Sum16() {
+			t.Errorf("chapter %d: header CRC = %04X, want %04X", i+1, got, crc.Sum16())
+		}
+		if header.Bitrate != 64 {
+			t.Errorf("chapter %d: header frame is %d kbps, want the smallest that fits (64)", i+1, header.Bitrate)
+		}
+
+		if diff := info.DurationMS() - chapter.LengthMs; diff < -27 || diff > 27 {
+			t.Errorf("chapter %d is %d ms long, want %d within a frame", i+1, info.DurationMS(), chapter.LengthMs)
+		}
+	}
+	if want := int64(400*1152 - 576 - 800); total != want {
+		t.Errorf("chapters hold %d samples, want %d", total, want)
+	}
+}
+
+func TestInfoFrameReadError(t *testing.T) {
+
+	file, _ := writeTestMP3(t, t.TempDir(), "part.mp3", testMP3{frames: 10})
+	stream, err := openMP3Stream([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	if _, err := stream.infoFrame(mp3Cut{End: 10}, stream.ranges(0, 10), 4170, 0); err == nil {
+		t.Error("expected an error reading the frame header of a closed file")
+	}
+}
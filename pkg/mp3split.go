@@ -0,0 +1,498 @@
+// This file is responsible for splitting MP3 files into chapters natively, at frame boundaries and without re-encoding.
+
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// ErrMP3Unsplittable is returned by SplitMP3Files when the parts can't be read natively, before anything is written.
+var ErrMP3Unsplittable = errors.New("mp3 files can not be split natively")
+
+// maxGaplessValue is the largest encoder delay or padding the LAME header can hold (12 bits).
+const maxGaplessValue = 4095
+
+// lameTagSize is the size of the LAME extension of the Xing header.
+const lameTagSize = 36
+
+// mp3Stream is the audio frames of the parts of a book, one after another.
+type mp3Stream struct {
+	Timeline MP3Timeline
+	Firsts   []int // Index of the first frame of each part in the stream
+	Frames   int   // Number of frames in the stream
+	handles  []*os.File
+}
+
+// mp3Cut is the frames written to a chapter file, as indexes in the stream.
+// The frames from First to Start are only there to fill the bit reservoir and the decoder,
+// and are skipped by gapless players with the encoder delay.
+type mp3Cut struct {
+	First   int
+	Start   int
+	End     int
+	Delay   int
+	Padding int
+}
+
+// mp3Range is a run of frames in one of the parts.
+type mp3Range struct {
+	Part  int
+	Frame int // Index of the first frame in the part
+	Count int
+	From  int64
+	To    int64
+}
+
+// SplitMP3Files splits the MP3 files of an audiobook into a file for each chapter, without decoding the audio.
+// Each chapter is cut at the frame nearest to its start, with the frames its first frame needs from the bit
+// reservoir, and is given a Xing/LAME header with the encoder delay and padding, so gapless players play
+// exactly the chapter. Chapters can span the parts of the book.
+func SplitMP3Files(ctx context.Context, files []string, chapters []Chapter, meta Metadata, outputDir string, progress *SplitProgress) error {
+
+	stream, err := openMP3Stream(files)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMP3Unsplittable, err)
+	}
+	defer stream.Close()
+
+	cuts, err := stream.planCuts(chapters)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMP3Unsplittable, err)
+	}
+
+	// Uses the cover of the metadata, or copies it from the tag of the first part
+	var cover []ID3Frame
+	if meta.Cover != nil {
+		cover = append(cover, NewID3PictureFrame(meta.CoverType, meta.Cover))
+	} else if source, err := ReadID3v2(files[0]); err == nil {
+		for _, frame := range source.Frames {
+			if frame.ID == "APIC" {
+				cover = append(cover, frame)
+			}
+		}
+	}
+
+	for i, chap := range chapters {
+		count := i + 1
+		if progress.skip(i) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Tags the file the same way ffmpeg did
+		tag := ID3Tag{Frames: []ID3Frame{
+			NewID3TextFrame("TIT2", chap.Title),
+			NewID3TextFrame("TPE1", meta.Author),
+			NewID3TextFrame("TALB", meta.Title),
+			NewID3TextFrame("TRCK", fmt.Sprintf("%d/%d", count, len(chapters))),
+		}}
+		if meta.Year != "" {
+			tag.Frames = append(tag.Frames, NewID3TextFrame("TDRC", meta.Year))
+		}
+		if meta.ASIN != "" {
+			tag.Frames = append(tag.Frames, NewID3UserTextFrame("ASIN", meta.ASIN))
+		}
+		for _, key := range sortedKeys(meta.Tags) {
+			tag.Frames = append(tag.Frames, NewID3UserTextFrame(key, meta.Tags[key]))
+		}
+		tag.Frames = append(tag.Frames, cover...)
+
+		output := path.Join(outputDir, SplitFileName(count, chap.Title, "mp3"))
+		if err := stream.writeCut(cuts[i], tag, output); err != nil {
+			return fmt.Errorf("error writing chapter %d: %w", count, err)
+		}
+		if err := progress.finish(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openMP3Stream scans the parts, and checks they can be joined without re-encoding.
+func openMP3Stream(files []string) (*mp3Stream, error) {
+
+	timeline, err := BuildMP3Timeline(files)
+	if err != nil {
+		return nil, err
+	}
+	if len(timeline.Files) == 0 {
+		return nil, fmt.Errorf("no mp3 files to split")
+	}
+
+	stream := &mp3Stream{Timeline: timeline}
+	first := timeline.Files[0]
+	for _, info := range timeline.Files {
+		if info.Version != first.Version || info.Layer != first.Layer || info.SampleRate != first.SampleRate {
+			return nil, fmt.Errorf("%s has a different sample rate or layer to %s", path.Base(info.Path), path.Base(first.Path))
+		}
+		stream.Firsts = append(stream.Firsts, stream.Frames)
+		stream.Frames += len(info.FrameOffsets)
+	}
+
+	for _, file := range files {
+		handle, err := os.Open(file)
+		if err != nil {
+			stream.Close()
+			return nil, fmt.Errorf("error opening file: %w", err)
+		}
+		stream.handles = append(stream.handles, handle)
+	}
+
+	return stream, nil
+}
+
+// Close closes the parts.
+func (s *mp3Stream) Close() {
+	for _, handle := range s.handles {
+		handle.Close()
+	}
+}
+
+// locate returns the part and the index in the part of a frame in the stream.
+func (s *mp3Stream) locate(index int) (int, int) {
+	part := sort.Search(len(s.Firsts), func(i int) bool { return s.Firsts[i] > index }) - 1
+	return part, index - s.Firsts[part]
+}
+
+// samplesPerFrame returns the number of samples in each frame of the stream.
+func (s *mp3Stream) samplesPerFrame() int {
+	return s.Timeline.Files[0].SamplesPerFrame
+}
+
+// planCuts finds the frames of each chapter. Chapters share their boundaries, so no audio is repeated or lost.
+func (s *mp3Stream) planCuts(chapters []Chapter) ([]mp3Cut, error) {
+
+	spf := s.samplesPerFrame()
+
+	// Finds the frame nearest to the start of each chapter
+	bounds := []int{0}
+	for i, chap := range chapters[1:] {
+		pos := s.Timeline.Locate(chap.StartOffsetMs)
+		bound := s.Firsts[pos.File] + pos.Frame
+		if bound <= bounds[i] {
+			bound = bounds[i] + 1
+		}
+		if bound >= s.Frames {
+			return nil, fmt.Errorf("chapter %d (%s) starts after the end of the audio", i+2, chap.Title)
+		}
+		bounds = append(bounds, bound)
+	}
+	bounds = append(bounds, s.Frames)
+
+	var cuts []mp3Cut
+	for i := range chapters {
+		cut := mp3Cut{Start: bounds[i], End: bounds[i+1]}
+
+		// The book starts after the delay of the first part, and ends before the padding of the last
+		target := cut.Start * spf
+		if i == 0 {
+			target = s.Timeline.Files[0].StartSkip()
+		}
+		cut.Padding = decoderDelay
+		if last := s.Timeline.Files[len(s.Timeline.Files)-1]; i == len(chapters)-1 && last.EncoderPadding >= 0 {
+			cut.Padding = last.EncoderPadding
+		}
+
+		// Starts early enough for the frame before the chapter to be decoded, as the decoder overlaps frames,
+		// and for the first frame to have its bit reservoir
+		cut.First = cut.Start
+		if cut.Start > 0 {
+			before, err := s.reservoirFrames(cut.Start - 1)
+			if err != nil {
+				return nil, err
+			}
+			first, err := s.reservoirFrames(cut.Start)
+			if err != nil {
+				return nil, err
+			}
+			cut.First = min(cut.Start-1-before, cut.Start-first)
+			cut.First = max(cut.First, 0, cut.Start-(maxGaplessValue+decoderDelay)/spf)
+		}
+		cut.Delay = min(max(target-cut.First*spf-decoderDelay, 0), maxGaplessValue)
+
+		cuts = append(cuts, cut)
+	}
+
+	return cuts, nil
+}
+
+// reservoirFrames returns the number of frames before the frame that hold the start of its audio data.
+func (s *mp3Stream) reservoirFrames(index int) (int, error) {
+
+	begin, _, err := s.readSideInfo(index)
+	if err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for available := 0; available < begin && index-frames > 0; {
+		frames++
+		_, payload, err := s.readSideInfo(index - frames)
+		if err != nil {
+			return 0, err
+		}
+		available += payload
+	}
+
+	return frames, nil
+}
+
+// readSideInfo returns where the audio data of a frame starts (main_data_begin, in bytes before the frame's own
+// audio data), and the number of bytes of audio data the frame holds.
+func (s *mp3Stream) readSideInfo(index int) (int, int, error) {
+
+	part, frame := s.locate(index)
+	info := s.Timeline.Files[part]
+
+	buf := make([]byte, 6)
+	if _, err := s.handles[part].ReadAt(buf, info.FrameOffsets[frame]); err != nil {
+		return 0, 0, fmt.Errorf("error reading frame: %w", err)
+	}
+	header, ok := ParseMP3FrameHeader(binary.BigEndian.Uint32(buf))
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid frame at %d in %s", info.FrameOffsets[frame], path.Base(info.Path))
+	}
+
+	// Only Layer III uses the bit reservoir
+	if header.Layer != 3 {
+		return 0, header.FrameSize() - 4, nil
+	}
+
+	pos := int64(4)
+	crc := 0
+	if header.Protected {
+		pos, crc = 6, 2
+	}
+	if _, err := s.handles[part].ReadAt(buf[:2], info.FrameOffsets[frame]+pos); err != nil {
+		return 0, 0, fmt.Errorf("error reading frame: %w", err)
+	}
+
+	begin := int(buf[0])
+	if header.Version == mpegVersion1 {
+		begin = int(buf[0])<<1 | int(buf[1])>>7
+	}
+
+	return begin, header.FrameSize() - 4 - crc - header.SideInfoSize(), nil
+}
+
+// ranges returns the runs of frames in each part that make up the frames from first to end.
+func (s *mp3Stream) ranges(first, end int) []mp3Range {
+
+	var ranges []mp3Range
+	for index := first; index < end; {
+		part, frame := s.locate(index)
+		info := s.Timeline.Files[part]
+		count := min(len(info.FrameOffsets)-frame, end-index)
+		ranges = append(ranges, mp3Range{
+			Part:  part,
+			Frame: frame,
+			Count: count,
+			From:  info.FrameOffsets[frame],
+			To:    info.FrameEnd(frame + count - 1),
+		})
+		index += count
+	}
+
+	return ranges
+}
+
+// writeCut writes the tag, a Xing/LAME header frame and the frames of the cut to the file.
+func (s *mp3Stream) writeCut(cut mp3Cut, tag ID3Tag, filepath string) error {
+
+	ranges := s.ranges(cut.First, cut.End)
+	var audioBytes int64
+	for _, r := range ranges {
+		audioBytes += r.To - r.From
+	}
+
+	out, err := os.Create(filepath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := out.Write(tag.Encode()); err != nil {
+		return fmt.Errorf("error writing tag: %w", err)
+	}
+	infoOffset, _ := out.Seek(0, io.SeekCurrent)
+
+	// Writes a placeholder for the header frame, it needs the CRC of the audio
+	header, err := s.infoFrame(cut, ranges, audioBytes, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(header); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+
+	// Copies the frames
+	crc := newCRC16()
+	writer := io.MultiWriter(out, crc)
+	for _, r := range ranges {
+		if _, err := io.Copy(writer, io.NewSectionReader(s.handles[r.Part], r.From, r.To-r.From)); err != nil {
+			return fmt.Errorf("error copying frames: %w", err)
+		}
+	}
+
+	header, err = s.infoFrame(cut, ranges, audioBytes, crc.Sum16())
+	if err != nil {
+		return err
+	}
+	if _, err := out.WriteAt(header, infoOffset); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+
+	return out.Close()
+}
+
+// infoFrame returns a Xing (or Info for constant bitrate) frame with a LAME extension, describing the frames.
+// The frame uses the smallest bitrate that fits the headers, an error is returned if none of them do.
+func (s *mp3Stream) infoFrame(cut mp3Cut, ranges []mp3Range, audioBytes int64, musicCRC uint16) ([]byte, error) {
+
+	first := s.Timeline.Files[0]
+	part, frame := s.locate(cut.First)
+	raw, err := s.frameHeader(part, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	// No CRC and no padding, and picks the bitrate
+	raw |= 1 << 16
+	raw &^= 1 << 9
+	var header MP3FrameHeader
+	found := false
+	for index := uint32(1); index < 15 && !found; index++ {
+		candidate, ok := ParseMP3FrameHeader(raw&^(0xF<<12) | index<<12)
+		if ok && candidate.FrameSize() >= 4+candidate.SideInfoSize()+120+lameTagSize {
+			header = candidate
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no bitrate of the frame header %08X fits the Xing/LAME header", raw)
+	}
+
+	size := header.FrameSize()
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf, header.Raw)
+
+	vbr := false
+	for _, info := range s.Timeline.Files {
+		vbr = vbr || info.VBR
+	}
+
+	frames := cut.End - cut.First
+	total := int64(size) + audioBytes
+
+	// The Xing header, with the frame count, byte count, seek table and quality
+	pos := 4 + header.SideInfoSize()
+	if vbr {
+		copy(buf[pos:], "Xing")
+	} else {
+		copy(buf[pos:], "Info")
+	}
+	binary.BigEndian.PutUint32(buf[pos+4:], 0x0F)
+	binary.BigEndian.PutUint32(buf[pos+8:], uint32(frames))
+	binary.BigEndian.PutUint32(buf[pos+12:], uint32(total))
+
+	// The seek table holds the position of each percent of the audio, in 256ths of the file
+	for i := 0; i < 100; i++ {
+		index := i * frames / 100
+		offset := int64(size)
+		for _, r := range ranges {
+			if index < r.Count {
+				offset += s.Timeline.Files[r.Part].FrameOffsets[r.Frame+index] - r.From
+				break
+			}
+			index -= r.Count
+			offset += r.To - r.From
+		}
+		buf[pos+16+i] = byte(min(offset*256/total, 255))
+	}
+	binary.BigEndian.PutUint32(buf[pos+116:], 100)
+
+	// The LAME extension, with the encoder delay and padding and the CRCs
+	lame := buf[pos+120 : pos+120+lameTagSize]
+	encoder := "LAME3.100"
+	if len(first.Encoder) >= 9 && first.Encoder[:4] == "LAME" {
+		encoder = first.Encoder[:9]
+	}
+	copy(lame, encoder)
+	if vbr {
+		lame[9] = 3
+	} else {
+		lame[9] = 1
+	}
+	headerInfo, _ := ParseMP3FrameHeader(raw)
+	lame[20] = byte(min(headerInfo.Bitrate, 255))
+	lame[21] = byte(cut.Delay >> 4)
+	lame[22] = byte(cut.Delay&0x0F)<<4 | byte(cut.Padding>>8)
+	lame[23] = byte(cut.Padding)
+	binary.BigEndian.PutUint32(lame[28:], uint32(total))
+	binary.BigEndian.PutUint16(lame[32:], musicCRC)
+
+	crc := newCRC16()
+	crc.Write(buf[:pos+120+34])
+	binary.BigEndian.PutUint16(lame[34:], crc.Sum16())
+
+	return buf, nil
+}
+
+// frameHeader returns the raw header of a frame in one of the parts.
+func (s *mp3Stream) frameHeader(part, frame int) (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := s.handles[part].ReadAt(buf, s.Timeline.Files[part].FrameOffsets[frame]); err != nil {
+		return 0, fmt.Errorf("error reading frame header: %w", err)
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// crc16Table is the lookup table for the CRC-16 used by the LAME header (polynomial 0x8005, reflected).
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 calculates the CRC-16 of the data written to it.
+type crc16 struct {
+	crc uint16
+}
+
+// newCRC16 returns a CRC-16 hash.
+func newCRC16() *crc16 {
+	return &crc16{}
+}
+
+// Write adds the data to the CRC.
+func (c *crc16) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.crc = c.crc>>8 ^ crc16Table[byte(c.crc)^b]
+	}
+	return len(p), nil
+}
+
+// Sum16 returns the CRC.
+func (c *crc16) Sum16() uint16 {
+	return c.crc
+}
@@ -0,0 +1,456 @@
+// This file is responsible for reading and writing the boxes (atoms) of MP4 files, without touching the audio.
+
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// mp4Containers are the boxes that only hold other boxes. The items of an ilst are containers too.
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "udta": true,
+	"edts": true, "dinf": true, "tref": true, "ilst": true, "meta": true, "gmhd": true,
+}
+
+// mp4Padding is the size of the free box left after the moov box when the file is rewritten,
+// so the next change to the tags or chapters can be written in place.
+const mp4Padding = 4096
+
+// MP4Box is a box of an MP4 file. Containers hold their children, other boxes hold their contents.
+type MP4Box struct {
+	Type     string
+	Data     []byte // Contents of the box, or the version and flags of a meta box
+	Children []*MP4Box
+}
+
+// mp4TopBox is a box at the top level of the file, which is not read into memory.
+type mp4TopBox struct {
+	Type   string
+	Offset int64
+	Size   int64
+}
+
+// MP4File is an MP4 file, the moov box is read into memory and the other top level boxes (like mdat) are left on disk.
+type MP4File struct {
+	Path           string
+	Moov           *MP4Box
+	boxes          []mp4TopBox
+	size           int64
+	chapterTrack   *MP4Box // Chapter track added by SetChapters, its samples are written by Save
+	chapterSamples []byte
+	dropLast       bool // The last box only holds the samples of the old chapter track
+}
+
+// ReadMP4 reads the top level boxes of the file, and the contents of the moov box.
+func ReadMP4(filepath string) (*MP4File, error) {
+
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+
+	f := &MP4File{Path: filepath, size: stat.Size()}
+	header := make([]byte, 16)
+	for offset := int64(0); offset+8 <= f.size; {
+
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return nil, fmt.Errorf("error reading box header: %w", err)
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:8])
+		headerSize := int64(8)
+
+		// A size of 1 is followed by a 64 bit size, and 0 runs to the end of the file
+		switch size {
+		case 1:
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, fmt.Errorf("error reading box header: %w", err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		case 0:
+			size = f.size - offset
+		}
+		if size < headerSize || offset+size > f.size {
+			return nil, fmt.Errorf("invalid %s box at %d in %s", typ, offset, path.Base(filepath))
+		}
+
+		f.boxes = append(f.boxes, mp4TopBox{Type: typ, Offset: offset, Size: size})
+
+		if typ == "moov" {
+			data := make([]byte, size-headerSize)
+			if _, err := file.ReadAt(data, offset+headerSize); err != nil {
+				return nil, fmt.Errorf("error reading moov box: %w", err)
+			}
+			children, err := parseMP4Boxes(data, "moov")
+			if err != nil {
+				return nil, err
+			}
+			f.Moov = &MP4Box{Type: "moov", Children: children}
+		}
+
+		offset += size
+	}
+
+	if f.Moov == nil {
+		return nil, fmt.Errorf("no moov box in %s", path.Base(filepath))
+	}
+
+	return f, nil
+}
+
+// parseMP4Boxes parses the boxes in the contents of a container.
+func parseMP4Boxes(data []byte, parent string) ([]*MP4Box, error) {
+
+	var boxes []*MP4Box
+	for pos := 0; pos+8 <= len(data); {
+
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		headerSize := 8
+		switch size {
+		case 1:
+			if pos+16 > len(data) {
+				return nil, fmt.Errorf("invalid %s box in %s", typ, parent)
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+			headerSize = 16
+		case 0:
+			size = len(data) - pos
+		}
+		if size < headerSize || pos+size > len(data) {
+			return nil, fmt.Errorf("invalid %s box in %s", typ, parent)
+		}
+		body := data[pos+headerSize : pos+size]
+		pos += size
+
+		box := &MP4Box{Type: typ}
+		switch {
+		case typ == "meta":
+			// iTunes meta boxes are full boxes, QuickTime ones start with the hdlr box
+			if len(body) >= 8 && string(body[4:8]) != "hdlr" {
+				box.Data = append([]byte(nil), body[:4]...)
+				body = body[4:]
+			}
+			fallthrough
+		case mp4Containers[typ] || parent == "ilst":
+			children, err := parseMP4Boxes(body, typ)
+			if err != nil {
+				return nil, err
+			}
+			box.Children = children
+		default:
+			box.Data = append([]byte(nil), body...)
+		}
+
+		boxes = append(boxes, box)
+	}
+
+	return boxes, nil
+}
+
+// Encode returns the box with its header.
+func (b *MP4Box) Encode() []byte {
+
+	body := append([]byte(nil), b.Data...)
+	for _, child := range b.Children {
+		body = append(body, child.Encode()...)
+	}
+
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], b.Type)
+	return append(out, body...)
+}
+
+// Child returns the first child of the box with the type, following the path of types, or nil if there is none.
+func (b *MP4Box) Child(types ...string) *MP4Box {
+	box := b
+	for _, typ := range types {
+		var next *MP4Box
+		for _, child := range box.Children {
+			if child.Type == typ {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		box = next
+	}
+	return box
+}
+
+// RemoveChildren removes the children of the box the function returns true for.
+func (b *MP4Box) RemoveChildren(remove func(child *MP4Box) bool) {
+	var kept []*MP4Box
+	for _, child := range b.Children {
+		if !remove(child) {
+			kept = append(kept, child)
+		}
+	}
+	b.Children = kept
+}
+
+// Tracks returns the trak boxes of the file.
+func (f *MP4File) Tracks() []*MP4Box {
+	var tracks []*MP4Box
+	for _, child := range f.Moov.Children {
+		if child.Type == "trak" {
+			tracks = append(tracks, child)
+		}
+	}
+	return tracks
+}
+
+// trackHandler returns the handler type of the track, e.g. "soun" or "text".
+func trackHandler(trak *MP4Box) string {
+	hdlr := trak.Child("mdia", "hdlr")
+	if hdlr == nil || len(hdlr.Data) < 12 {
+		return ""
+	}
+	return string(hdlr.Data[8:12])
+}
+
+// trackID returns the ID of the track from its tkhd box.
+func trackID(trak *MP4Box) uint32 {
+	tkhd := trak.Child("tkhd")
+	if tkhd == nil || len(tkhd.Data) < 24 {
+		return 0
+	}
+	if tkhd.Data[0] == 1 {
+		return binary.BigEndian.Uint32(tkhd.Data[20:])
+	}
+	return binary.BigEndian.Uint32(tkhd.Data[12:])
+}
+
+// chunkOffsets returns the offsets of the chunks of the track, from its stco or co64 box.
+func chunkOffsets(trak *MP4Box) []int64 {
+
+	var offsets []int64
+	if stco := trak.Child("mdia", "minf", "stbl", "stco"); stco != nil && len(stco.Data) >= 8 {
+		count := int(binary.BigEndian.Uint32(stco.Data[4:]))
+		for i := 0; i < count && 8+i*4+4 <= len(stco.Data); i++ {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(stco.Data[8+i*4:])))
+		}
+	}
+	if co64 := trak.Child("mdia", "minf", "stbl", "co64"); co64 != nil && len(co64.Data) >= 8 {
+		count := int(binary.BigEndian.Uint32(co64.Data[4:]))
+		for i := 0; i < count && 8+i*8+8 <= len(co64.Data); i++ {
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(co64.Data[8+i*8:])))
+		}
+	}
+
+	return offsets
+}
+
+// shiftChunkOffsets moves the chunks of the track at or after the offset, for when the boxes before them change size.
+func shiftChunkOffsets(trak *MP4Box, from, delta int64) error {
+
+	if stco := trak.Child("mdia", "minf", "stbl", "stco"); stco != nil && len(stco.Data) >= 8 {
+		count := int(binary.BigEndian.Uint32(stco.Data[4:]))
+		for i := 0; i < count && 8+i*4+4 <= len(stco.Data); i++ {
+			offset := int64(binary.BigEndian.Uint32(stco.Data[8+i*4:]))
+			if offset < from {
+				continue
+			}
+			if offset+delta > 0xFFFFFFFF {
+				return fmt.Errorf("chunk offset %d does not fit in the stco box", offset+delta)
+			}
+			binary.BigEndian.PutUint32(stco.Data[8+i*4:], uint32(offset+delta))
+		}
+	}
+	if co64 := trak.Child("mdia", "minf", "stbl", "co64"); co64 != nil && len(co64.Data) >= 8 {
+		count := int(binary.BigEndian.Uint32(co64.Data[4:]))
+		for i := 0; i < count && 8+i*8+8 <= len(co64.Data); i++ {
+			offset := int64(binary.BigEndian.Uint64(co64.Data[8+i*8:]))
+			if offset >= from {
+				binary.BigEndian.PutUint64(co64.Data[8+i*8:], uint64(offset+delta))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Save writes the moov box, and any chapter samples, back to the file. The mdat box is never changed.
+// If the moov box is before the mdat (faststart), it is written in place when it fits in its old space
+// (and any free boxes after it), otherwise the file is rewritten with the chunk offsets moved. If the
+// moov box is at the end of the file it is always written in place.
+func (f *MP4File) Save() error {
+
+	// Leaves out the samples of the old chapter track, if they were at the end of the file
+	boxes := f.boxes
+	if f.dropLast {
+		boxes = boxes[:len(boxes)-1]
+	}
+
+	// Works out where the moov box is, and how much space it has
+	moovIndex := -1
+	for i, box := range boxes {
+		if box.Type == "moov" {
+			moovIndex = i
+		}
+	}
+	moov := boxes[moovIndex]
+	space := moov.Size
+	next := moovIndex + 1
+	for next < len(boxes) && (boxes[next].Type == "free" || boxes[next].Type == "skip") {
+		space += boxes[next].Size
+		next++
+	}
+
+	// The samples of the chapter track are written at the end of the file, in an mdat box of their own
+	end := boxes[len(boxes)-1].Offset + boxes[len(boxes)-1].Size
+	size := int64(len(f.Moov.Encode()))
+
+	switch {
+	case next == len(boxes):
+		// The moov box is at the end, so it can grow, and the samples follow it
+		f.setSampleOffset(moov.Offset + size + 8)
+		return f.writeInPlace(moov.Offset, f.Moov.Encode(), moov.Offset+size)
+
+	case size == space || size+8 <= space:
+		// The moov box fits, the rest of its space is filled with a free box
+		f.setSampleOffset(end + 8)
+		out := f.Moov.Encode()
+		if size < space {
+			out = append(out, freeBox(space-size)...)
+		}
+		return f.writeInPlace(moov.Offset, out, end)
+
+	default:
+		// The moov box grows, so everything after it moves
+		delta := size + mp4Padding - space
+		for _, trak := range f.Tracks() {
+			if trak == f.chapterTrack {
+				continue
+			}
+			if err := shiftChunkOffsets(trak, moov.Offset+space, delta); err != nil {
+				return err
+			}
+		}
+		f.setSampleOffset(end + delta + 8)
+		return f.rewrite(boxes, moovIndex, next, f.Moov.Encode())
+	}
+}
+
+// setSampleOffset points the chunk of the chapter track to the offset of its samples.
+func (f *MP4File) setSampleOffset(offset int64) {
+	if f.chapterTrack == nil {
+		return
+	}
+	stco := f.chapterTrack.Child("mdia", "minf", "stbl", "stco")
+	binary.BigEndian.PutUint32(stco.Data[8:], uint32(offset))
+}
+
+// writeInPlace writes the moov box (and any free box after it) at the offset, then the chapter samples,
+// and ends the file after them.
+func (f *MP4File) writeInPlace(offset int64, out []byte, samplesAt int64) error {
+
+	file, err := os.OpenFile(f.Path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(out, offset); err != nil {
+		return fmt.Errorf("error writing moov box: %w", err)
+	}
+
+	end := samplesAt
+	if f.chapterSamples != nil {
+		samples := mdatBox(f.chapterSamples)
+		if _, err := file.WriteAt(samples, samplesAt); err != nil {
+			return fmt.Errorf("error writing chapter samples: %w", err)
+		}
+		end += int64(len(samples))
+	}
+	if err := file.Truncate(end); err != nil {
+		return fmt.Errorf("error truncating file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// rewrite writes a copy of the file with the new moov box, replacing the boxes from the moov box up to next,
+// and renames it over the file. The other boxes are copied as they are.
+func (f *MP4File) rewrite(boxes []mp4TopBox, moovIndex, next int, moov []byte) error {
+
+	source, err := os.Open(f.Path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer source.Close()
+
+	temp, err := os.CreateTemp(path.Dir(f.Path), ".mp4-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	for i, box := range boxes {
+		switch {
+		case i == moovIndex:
+			if _, err := temp.Write(append(moov, freeBox(mp4Padding)...)); err != nil {
+				return fmt.Errorf("error writing moov box: %w", err)
+			}
+		case i > moovIndex && i < next:
+			// Free space after the moov box is replaced by the padding
+		default:
+			if _, err := io.Copy(temp, io.NewSectionReader(source, box.Offset, box.Size)); err != nil {
+				return fmt.Errorf("error copying %s box: %w", box.Type, err)
+			}
+		}
+	}
+
+	if f.chapterSamples != nil {
+		if _, err := temp.Write(mdatBox(f.chapterSamples)); err != nil {
+			return fmt.Errorf("error writing chapter samples: %w", err)
+		}
+	}
+
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	source.Close()
+
+	// Keeps the permissions of the original file
+	if stat, err := os.Stat(f.Path); err == nil {
+		os.Chmod(temp.Name(), stat.Mode())
+	}
+
+	if err := os.Rename(temp.Name(), f.Path); err != nil {
+		return fmt.Errorf("error replacing file: %w", err)
+	}
+
+	return nil
+}
+
+// freeBox returns a free box of the size, including its header.
+func freeBox(size int64) []byte {
+	box := make([]byte, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], "free")
+	return box
+}
+
+// mdatBox returns an mdat box holding the data.
+func mdatBox(data []byte) []byte {
+	box := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(box, uint32(8+len(data)))
+	copy(box[4:], "mdat")
+	return append(box, data...)
+}
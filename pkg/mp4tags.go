@@ -0,0 +1,685 @@
+// This file is responsible for the tags (ilst) and chapters (chpl and the chapter track) of MP4 files.
+
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// iTunes data types, stored in the data box of each ilst item.
+const (
+	mp4DataUTF8 = 1
+	mp4DataJPEG = 13
+	mp4DataPNG  = 14
+	mp4DataInt  = 21
+)
+
+// mp4FreeformMean is the namespace of the freeform (----) items written for the tags that have no atom of their own.
+const mp4FreeformMean = "com.apple.iTunes"
+
+// mp4Atoms are the ilst items written from the metadata, by their common tag name.
+var mp4Atoms = map[string]string{
+	"title":        "\xa9nam",
+	"album":        "\xa9alb",
+	"artist":       "\xa9ART",
+	"album_artist": "aART",
+	"composer":     "\xa9wrt",
+	"date":         "\xa9day",
+	"description":  "desc",
+	"genre":        "\xa9gen",
+}
+
+// SetTags replaces the tags of the file with the metadata. Items the metadata does not write are kept.
+func (f *MP4File) SetTags(meta Metadata) {
+
+	ilst := f.ilst()
+
+	// Builds the items
+	var items []*MP4Box
+	text := func(name, value string) {
+		if value != "" {
+			items = append(items, ilstItem(mp4Atoms[name], mp4DataUTF8, []byte(value)))
+		}
+	}
+	freeform := func(name, value string) {
+		if value != "" {
+			items = append(items, ilstFreeform(name, value))
+		}
+	}
+
+	text("title", meta.Title)
+	text("album", meta.Title)
+	text("artist", meta.Author)
+	text("album_artist", meta.Author)
+	text("composer", meta.Narrator)
+	text("date", meta.Year)
+	text("description", meta.Summary)
+	text("genre", "Audiobook")
+
+	// Media type 2 is an audiobook
+	items = append(items, ilstItem("stik", mp4DataInt, []byte{2}))
+
+	if meta.Cover != nil {
+		kind := mp4DataJPEG
+		if meta.CoverType == "image/png" {
+			kind = mp4DataPNG
+		}
+		items = append(items, ilstItem("covr", uint32(kind), meta.Cover))
+	}
+
+	freeform("ASIN", meta.ASIN)
+	freeform("PUBLISHER", meta.Publisher)
+	freeform("SERIES", meta.Series.Name)
+	if meta.Series.Name != "" && meta.Series.Position != 0 {
+		freeform("SERIES-PART", strconv.FormatFloat(meta.Series.Position, 'f', -1, 64))
+	}
+	for _, key := range sortedKeys(meta.Tags) {
+		freeform(key, meta.Tags[key])
+	}
+
+	// Removes the items that are replaced, then adds the new ones
+	replaced := map[string]bool{}
+	for _, item := range items {
+		replaced[ilstKey(item)] = true
+	}
+	ilst.RemoveChildren(func(child *MP4Box) bool {
+		return replaced[ilstKey(child)]
+	})
+	ilst.Children = append(ilst.Children, items...)
+}
+
+// Tags returns the text tags of the file. Atoms are keyed by their common tag name (e.g. title), or their type if
+// they have none, and freeform items by their name (e.g. ASIN).
+func (f *MP4File) Tags() map[string]string {
+
+	names := map[string]string{}
+	for name, atom := range mp4Atoms {
+		names[atom] = name
+	}
+
+	tags := map[string]string{}
+	ilst := f.Moov.Child("udta", "meta", "ilst")
+	if ilst == nil {
+		return tags
+	}
+
+	for _, item := range ilst.Children {
+		data := item.Child("data")
+		if data == nil || len(data.Data) < 8 || binary.BigEndian.Uint32(data.Data)&0xFFFFFF != mp4DataUTF8 {
+			continue
+		}
+		key := ilstKey(item)
+		if name, ok := names[key]; ok {
+			key = name
+		} else {
+			key = strings.Replace(key, "\xa9", "©", 1)
+		}
+		tags[key] = string(data.Data[8:])
+	}
+
+	return tags
+}
+
+// SetTrack sets the title and track number of a file that holds a single chapter of the book.
+func (f *MP4File) SetTrack(title string, number, total int) {
+
+	ilst := f.ilst()
+	ilst.RemoveChildren(func(child *MP4Box) bool {
+		return child.Type == mp4Atoms["title"] || child.Type == "trkn"
+	})
+
+	// The track number and total are 16 bits each, after 2 reserved bytes
+	trkn := []byte{0, 0, byte(number >> 8), byte(number), byte(total >> 8), byte(total), 0, 0}
+	ilst.Children = append(ilst.Children, ilstItem(mp4Atoms["title"], mp4DataUTF8, []byte(title)), ilstItem("trkn", 0, trkn))
+}
+
+// Cover returns the first cover image of the file and its MIME type, or nil if it has none.
+func (f *MP4File) Cover() ([]byte, string) {
+
+	covr := f.Moov.Child("udta", "meta", "ilst", "covr")
+	if covr == nil {
+		return nil, ""
+	}
+	data := covr.Child("data")
+	if data == nil || len(data.Data) <= 8 {
+		return nil, ""
+	}
+
+	if binary.BigEndian.Uint32(data.Data)&0xFFFFFF == mp4DataPNG {
+		return data.Data[8:], "image/png"
+	}
+	return data.Data[8:], "image/jpeg"
+}
+
+// SetChapters replaces the chapters of the file, in a Nero chpl box and a QuickTime chapter track.
+// Nero chapters are limited to 255, the chapter track holds all of them.
+func (f *MP4File) SetChapters(chapters []Chapter) error {
+
+	audio := f.audioTrack()
+	if audio == nil {
+		return fmt.Errorf("no audio track in %s", f.Path)
+	}
+
+	f.removeChapters(audio)
+	if len(chapters) == 0 {
+		return nil
+	}
+
+	// The Nero chapters are in 100 nanosecond units
+	count := min(len(chapters), 255)
+	chpl := []byte{1, 0, 0, 0, 0, 0, 0, 0, byte(count)}
+	for _, chapter := range chapters[:count] {
+		title := truncateUTF8(chapter.Title, 255)
+		chpl = binary.BigEndian.AppendUint64(chpl, uint64(chapter.StartOffsetMs)*10000)
+		chpl = append(chpl, byte(len(title)))
+		chpl = append(chpl, title...)
+	}
+	udta := f.Moov.Child("udta")
+	if udta == nil {
+		udta = &MP4Box{Type: "udta"}
+		f.Moov.Children = append(f.Moov.Children, udta)
+	}
+	udta.Children = append(udta.Children, &MP4Box{Type: "chpl", Data: chpl})
+
+	// Adds the chapter track, and points the audio track to it
+	id := f.nextTrackID()
+	f.chapterTrack, f.chapterSamples = chapterTrack(id, chapters, f.movieTimescale())
+	f.Moov.Children = append(f.Moov.Children, f.chapterTrack)
+
+	tref := audio.Child("tref")
+	if tref == nil {
+		tref = &MP4Box{Type: "tref"}
+		audio.Children = append(audio.Children, tref)
+	}
+	tref.Children = append(tref.Children, &MP4Box{Type: "chap", Data: binary.BigEndian.AppendUint32(nil, id)})
+
+	return nil
+}
+
+// Chapters returns the chapters of the file from the chapter track the audio track points to, or from its chpl box
+// if it has none, with the length of the last chapter running to the end of the audio.
+func (f *MP4File) Chapters() []Chapter {
+
+	chapters := f.trackChapters()
+	if chapters == nil {
+		chapters = f.neroChapters()
+	}
+
+	total := f.DurationMS()
+	for i := range chapters {
+		if i+1 < len(chapters) {
+			chapters[i].LengthMs = chapters[i+1].StartOffsetMs - chapters[i].StartOffsetMs
+		} else {
+			chapters[i].LengthMs = max(total-chapters[i].StartOffsetMs, 0)
+		}
+	}
+
+	return chapters
+}
+
+// neroChapters returns the start and title of the chapters in the chpl box, which holds at most 255.
+func (f *MP4File) neroChapters() []Chapter {
+
+	chpl := f.Moov.Child("udta", "chpl")
+	if chpl == nil || len(chpl.Data) < 5 {
+		return nil
+	}
+
+	// Version 1 has 4 reserved bytes before the count
+	pos := 4
+	if chpl.Data[0] == 1 {
+		pos += 4
+	}
+	if pos >= len(chpl.Data) {
+		return nil
+	}
+	count := int(chpl.Data[pos])
+	pos++
+
+	var chapters []Chapter
+	for i := 0; i < count && pos+9 <= len(chpl.Data); i++ {
+		start := int(binary.BigEndian.Uint64(chpl.Data[pos:]) / 10000)
+		length := int(chpl.Data[pos+8])
+		pos += 9
+		if pos+length > len(chpl.Data) {
+			break
+		}
+		chapters = append(chapters, Chapter{StartOffsetMs: start, StartOffsetSec: start / 1000, Title: string(chpl.Data[pos : pos+length])})
+		pos += length
+	}
+
+	return chapters
+}
+
+// trackChapters returns the start and title of the chapters in the QuickTime chapter track, read from the samples
+// on disk. It returns nil if the audio track points to no chapter track, or it can't be read.
+func (f *MP4File) trackChapters() []Chapter {
+
+	audio := f.audioTrack()
+	if audio == nil {
+		return nil
+	}
+	chap := audio.Child("tref", "chap")
+	if chap == nil || len(chap.Data) < 4 {
+		return nil
+	}
+	id := binary.BigEndian.Uint32(chap.Data)
+
+	var trak *MP4Box
+	for _, track := range f.Tracks() {
+		if trackID(track) == id && track != f.chapterTrack {
+			trak = track
+		}
+	}
+	if trak == nil {
+		return nil
+	}
+
+	// The timescale of the media, version 1 has 64 bit creation and modification times before it
+	timescale := uint64(1000)
+	if mdhd := trak.Child("mdia", "mdhd"); mdhd != nil && len(mdhd.Data) >= 24 {
+		if mdhd.Data[0] == 1 {
+			timescale = uint64(binary.BigEndian.Uint32(mdhd.Data[20:]))
+		} else {
+			timescale = uint64(binary.BigEndian.Uint32(mdhd.Data[12:]))
+		}
+	}
+	durations := sampleDurations(trak)
+	offsets, sizes := sampleLocations(trak)
+	if timescale == 0 || len(offsets) == 0 || len(durations) < len(offsets) {
+		return nil
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	// Each sample is the length of the title and the title, followed by boxes like encd
+	var chapters []Chapter
+	start := uint64(0)
+	for i, offset := range offsets {
+		if sizes[i] < 2 || sizes[i] > 1<<20 {
+			return nil
+		}
+		sample := make([]byte, sizes[i])
+		if _, err := file.ReadAt(sample, offset); err != nil {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(sample))
+		if 2+length > len(sample) {
+			return nil
+		}
+		ms := int(start * 1000 / timescale)
+		chapters = append(chapters, Chapter{StartOffsetMs: ms, StartOffsetSec: ms / 1000, Title: string(sample[2 : 2+length])})
+		start += durations[i]
+	}
+
+	return chapters
+}
+
+// sampleDurations returns the duration of each sample of the track from its stts box, in the media timescale.
+func sampleDurations(trak *MP4Box) []uint64 {
+
+	stts := trak.Child("mdia", "minf", "stbl", "stts")
+	if stts == nil || len(stts.Data) < 8 {
+		return nil
+	}
+
+	var durations []uint64
+	count := int(binary.BigEndian.Uint32(stts.Data[4:]))
+	for i := 0; i < count && 8+i*8+8 <= len(stts.Data); i++ {
+		samples := int(binary.BigEndian.Uint32(stts.Data[8+i*8:]))
+		duration := uint64(binary.BigEndian.Uint32(stts.Data[12+i*8:]))
+		for j := 0; j < samples && len(durations) < 1<<16; j++ {
+			durations = append(durations, duration)
+		}
+	}
+
+	return durations
+}
+
+// sampleLocations returns the offset and size of each sample of the track, from its stsz, stsc and chunk offsets.
+func sampleLocations(trak *MP4Box) ([]int64, []int) {
+
+	stbl := trak.Child("mdia", "minf", "stbl")
+	if stbl == nil {
+		return nil, nil
+	}
+	stsz, stsc := stbl.Child("stsz"), stbl.Child("stsc")
+	if stsz == nil || stsc == nil || len(stsz.Data) < 12 || len(stsc.Data) < 8 {
+		return nil, nil
+	}
+
+	// A sample size of 0 means each sample has its own size
+	var sizes []int
+	fixed := int(binary.BigEndian.Uint32(stsz.Data[4:]))
+	count := int(binary.BigEndian.Uint32(stsz.Data[8:]))
+	for i := 0; i < count && i < 1<<16; i++ {
+		if fixed != 0 {
+			sizes = append(sizes, fixed)
+		} else if 12+i*4+4 <= len(stsz.Data) {
+			sizes = append(sizes, int(binary.BigEndian.Uint32(stsz.Data[12+i*4:])))
+		} else {
+			return nil, nil
+		}
+	}
+
+	// Each stsc entry gives the samples per chunk from its first chunk (counted from 1) up to the next entry
+	chunks := chunkOffsets(trak)
+	entries := int(binary.BigEndian.Uint32(stsc.Data[4:]))
+	var offsets []int64
+	for e := 0; e < entries && 8+e*12+12 <= len(stsc.Data); e++ {
+		first := int(binary.BigEndian.Uint32(stsc.Data[8+e*12:])) - 1
+		perChunk := int(binary.BigEndian.Uint32(stsc.Data[12+e*12:]))
+		last := len(chunks)
+		if e+1 < entries && 8+(e+1)*12+4 <= len(stsc.Data) {
+			last = min(int(binary.BigEndian.Uint32(stsc.Data[8+(e+1)*12:]))-1, last)
+		}
+		for chunk := max(first, 0); chunk < last; chunk++ {
+			offset := chunks[chunk]
+			for j := 0; j < perChunk && len(offsets) < len(sizes); j++ {
+				offsets = append(offsets, offset)
+				offset += int64(sizes[len(offsets)-1])
+			}
+		}
+	}
+	if len(offsets) != len(sizes) {
+		return nil, nil
+	}
+
+	return offsets, sizes
+}
+
+// DurationMS returns the duration of the file from its mvhd box in milliseconds.
+func (f *MP4File) DurationMS() int {
+	mvhd := f.Moov.Child("mvhd")
+	if mvhd == nil || len(mvhd.Data) < 20 {
+		return 0
+	}
+	if mvhd.Data[0] == 1 {
+		if len(mvhd.Data) < 32 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint64(mvhd.Data[24:]) * 1000 / uint64(max(f.movieTimescale(), 1)))
+	}
+	return int(uint64(binary.BigEndian.Uint32(mvhd.Data[16:])) * 1000 / uint64(max(f.movieTimescale(), 1)))
+}
+
+// WriteMP4Metadata writes the tags and chapters to an MP4 file (m4b or m4a) natively, without ffmpeg.
+func WriteMP4Metadata(filepath string, meta Metadata, chapters []Chapter) error {
+
+	f, err := ReadMP4(filepath)
+	if err != nil {
+		return err
+	}
+
+	f.SetTags(meta)
+	if err := f.SetChapters(chapters); err != nil {
+		return err
+	}
+
+	return f.Save()
+}
+
+// ilst returns the ilst box of the file, adding it (and its meta box) if the file has none.
+func (f *MP4File) ilst() *MP4Box {
+
+	udta := f.Moov.Child("udta")
+	if udta == nil {
+		udta = &MP4Box{Type: "udta"}
+		f.Moov.Children = append(f.Moov.Children, udta)
+	}
+
+	meta := udta.Child("meta")
+	if meta == nil {
+		// iTunes metadata handler, 'mdir' with 'appl' as the manufacturer
+		hdlr := make([]byte, 25)
+		copy(hdlr[8:], "mdir")
+		copy(hdlr[12:], "appl")
+		meta = &MP4Box{Type: "meta", Data: []byte{0, 0, 0, 0}, Children: []*MP4Box{{Type: "hdlr", Data: hdlr}}}
+		udta.Children = append(udta.Children, meta)
+	}
+
+	ilst := meta.Child("ilst")
+	if ilst == nil {
+		ilst = &MP4Box{Type: "ilst"}
+		meta.Children = append(meta.Children, ilst)
+	}
+
+	return ilst
+}
+
+// audioTrack returns the first sound track of the file.
+func (f *MP4File) audioTrack() *MP4Box {
+	for _, trak := range f.Tracks() {
+		if trackHandler(trak) == "soun" {
+			return trak
+		}
+	}
+	return nil
+}
+
+// removeChapters removes the chpl box, and the chapter track the audio track points to. If the samples of the
+// chapter track are in an mdat box at the end of the file (where SetChapters writes them), that box is removed too.
+func (f *MP4File) removeChapters(audio *MP4Box) {
+
+	if udta := f.Moov.Child("udta"); udta != nil {
+		udta.RemoveChildren(func(child *MP4Box) bool { return child.Type == "chpl" })
+	}
+
+	tref := audio.Child("tref")
+	if tref == nil {
+		return
+	}
+	ids := map[uint32]bool{}
+	for _, chap := range tref.Children {
+		if chap.Type != "chap" {
+			continue
+		}
+		for i := 0; i+4 <= len(chap.Data); i += 4 {
+			ids[binary.BigEndian.Uint32(chap.Data[i:])] = true
+		}
+	}
+	tref.RemoveChildren(func(child *MP4Box) bool { return child.Type == "chap" })
+	if len(tref.Children) == 0 {
+		audio.RemoveChildren(func(child *MP4Box) bool { return child.Type == "tref" })
+	}
+
+	// Checks if the last box only holds the samples of the chapter tracks
+	last := f.boxes[len(f.boxes)-1]
+	inLast := func(offset int64) bool { return offset >= last.Offset && offset < last.Offset+last.Size }
+	chapterOnly := last.Type == "mdat"
+	for _, trak := range f.Tracks() {
+		for _, offset := range chunkOffsets(trak) {
+			if inLast(offset) != ids[trackID(trak)] {
+				chapterOnly = false
+			}
+		}
+	}
+	f.dropLast = chapterOnly && len(ids) > 0
+
+	f.Moov.RemoveChildren(func(child *MP4Box) bool {
+		return child.Type == "trak" && ids[trackID(child)]
+	})
+}
+
+// nextTrackID returns the next free track ID from the mvhd box, and increments it.
+func (f *MP4File) nextTrackID() uint32 {
+
+	mvhd := f.Moov.Child("mvhd")
+	id := uint32(1)
+	for _, trak := range f.Tracks() {
+		id = max(id, trackID(trak)+1)
+	}
+	if mvhd != nil && len(mvhd.Data) >= 4 {
+		pos := len(mvhd.Data) - 4
+		id = max(id, binary.BigEndian.Uint32(mvhd.Data[pos:]))
+		binary.BigEndian.PutUint32(mvhd.Data[pos:], id+1)
+	}
+
+	return id
+}
+
+// movieTimescale returns the timescale of the mvhd box, the units of the track durations.
+func (f *MP4File) movieTimescale() uint32 {
+	mvhd := f.Moov.Child("mvhd")
+	if mvhd == nil || len(mvhd.Data) < 24 {
+		return 1000
+	}
+	if mvhd.Data[0] == 1 {
+		return binary.BigEndian.Uint32(mvhd.Data[20:])
+	}
+	return binary.BigEndian.Uint32(mvhd.Data[12:])
+}
+
+// chapterTrack builds a QuickTime text track with a sample for each chapter, and returns it with its samples.
+// The chunk offset is filled in when the file is saved.
+func chapterTrack(id uint32, chapters []Chapter, movieTimescale uint32) (*MP4Box, []byte) {
+
+	// Each sample is the length of the title, the title, and an encd box marking it as UTF-8
+	var samples []byte
+	var sizes, durations []uint32
+	total := uint32(0)
+	for i, chapter := range chapters {
+		title := truncateUTF8(chapter.Title, 0xFFFF)
+		sample := binary.BigEndian.AppendUint16(nil, uint16(len(title)))
+		sample = append(sample, title...)
+		sample = append(sample, 0, 0, 0, 12, 'e', 'n', 'c', 'd', 0, 0, 1, 0)
+		samples = append(samples, sample...)
+		sizes = append(sizes, uint32(len(sample)))
+
+		// The first chapter starts at the start of the audio
+		length := chapter.LengthMs
+		if i == 0 {
+			length += chapter.StartOffsetMs
+		}
+		durations = append(durations, uint32(max(length, 1)))
+		total += durations[i]
+	}
+
+	u32 := binary.BigEndian.AppendUint32
+	u16 := binary.BigEndian.AppendUint16
+	matrix := func(b []byte) []byte {
+		for _, v := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+			b = u32(b, v)
+		}
+		return b
+	}
+
+	// The track is disabled, so players use it for the chapters and don't show it as subtitles
+	tkhd := u32(nil, 0)
+	tkhd = u32(u32(tkhd, 0), 0)
+	tkhd = u32(u32(tkhd, id), 0)
+	tkhd = u32(tkhd, uint32(uint64(total)*uint64(movieTimescale)/1000))
+	tkhd = append(tkhd, make([]byte, 16)...)
+	tkhd = matrix(tkhd)
+	tkhd = u32(u32(tkhd, 0), 0)
+
+	// The media is in milliseconds, with an undefined language
+	mdhd := u32(nil, 0)
+	mdhd = u32(u32(mdhd, 0), 0)
+	mdhd = u32(u32(mdhd, 1000), total)
+	mdhd = u16(u16(mdhd, 0x55C4), 0)
+
+	hdlr := append(make([]byte, 8), "text"...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, "Chapters\x00"...)
+
+	// The QuickTime text sample description
+	text := append(make([]byte, 6), 0, 1)
+	text = u32(u32(text, 0), 1)
+	text = append(text, make([]byte, 6+8+8+2+2+1+2+6+1)...)
+	stsd := u32(u32(nil, 0), 1)
+	stsd = append(stsd, (&MP4Box{Type: "text", Data: text}).Encode()...)
+
+	stts := u32(u32(nil, 0), uint32(len(durations)))
+	for _, duration := range durations {
+		stts = u32(u32(stts, 1), duration)
+	}
+	stsc := u32(u32(nil, 0), 1)
+	stsc = u32(u32(u32(stsc, 1), uint32(len(chapters))), 1)
+	stsz := u32(u32(u32(nil, 0), 0), uint32(len(sizes)))
+	for _, size := range sizes {
+		stsz = u32(stsz, size)
+	}
+	stco := u32(u32(u32(nil, 0), 1), 0)
+
+	// The generic media header, with the text matrix QuickTime expects
+	gmin := u32(nil, 0)
+	gmin = u16(gmin, 0x40)
+	gmin = u16(u16(u16(gmin, 0x8000), 0x8000), 0x8000)
+	gmin = u16(u16(gmin, 0), 0)
+
+	dref := u32(u32(nil, 0), 1)
+	dref = append(dref, (&MP4Box{Type: "url ", Data: []byte{0, 0, 0, 1}}).Encode()...)
+
+	trak := &MP4Box{Type: "trak", Children: []*MP4Box{
+		{Type: "tkhd", Data: tkhd},
+		{Type: "mdia", Children: []*MP4Box{
+			{Type: "mdhd", Data: mdhd},
+			{Type: "hdlr", Data: hdlr},
+			{Type: "minf", Children: []*MP4Box{
+				{Type: "gmhd", Children: []*MP4Box{
+					{Type: "gmin", Data: gmin},
+					{Type: "text", Data: matrix(nil)},
+				}},
+				{Type: "dinf", Children: []*MP4Box{{Type: "dref", Data: dref}}},
+				{Type: "stbl", Children: []*MP4Box{
+					{Type: "stsd", Data: stsd},
+					{Type: "stts", Data: stts},
+					{Type: "stsc", Data: stsc},
+					{Type: "stsz", Data: stsz},
+					{Type: "stco", Data: stco},
+				}},
+			}},
+		}},
+	}}
+
+	return trak, samples
+}
+
+// ilstItem returns an ilst item with a data box of the type.
+func ilstItem(atom string, kind uint32, value []byte) *MP4Box {
+	data := append(binary.BigEndian.AppendUint32(nil, kind), 0, 0, 0, 0)
+	data = append(data, value...)
+	return &MP4Box{Type: atom, Children: []*MP4Box{{Type: "data", Data: data}}}
+}
+
+// ilstFreeform returns a freeform (----) ilst item, for a tag that has no atom of its own.
+func ilstFreeform(name, value string) *MP4Box {
+	item := ilstItem("----", mp4DataUTF8, []byte(value))
+	item.Children = append([]*MP4Box{
+		{Type: "mean", Data: append([]byte{0, 0, 0, 0}, mp4FreeformMean...)},
+		{Type: "name", Data: append([]byte{0, 0, 0, 0}, name...)},
+	}, item.Children...)
+	return item
+}
+
+// ilstKey returns the key of an ilst item, its type, or its name for freeform items.
+func ilstKey(item *MP4Box) string {
+	if item.Type != "----" {
+		return item.Type
+	}
+	if name := item.Child("name"); name != nil && len(name.Data) >= 4 {
+		return string(name.Data[4:])
+	}
+	return item.Type
+}
+
+// truncateUTF8 shortens the value to at most the number of bytes, without splitting a character.
+func truncateUTF8(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	for size > 0 && !utf8.RuneStart(value[size]) {
+		size--
+	}
+	return value[:size]
+}
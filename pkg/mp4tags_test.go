@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeTestMP4 writes a minimal MP4 file with one sound track of the duration, in milliseconds, and returns its path.
+func writeTestMP4(t *testing.T, durationMs uint32) string {
+
+	u32 := binary.BigEndian.AppendUint32
+
+	mvhd := u32(u32(u32(nil, 0), 0), 0)
+	mvhd = u32(u32(mvhd, 1000), durationMs)
+	mvhd = append(mvhd, make([]byte, 76)...)
+	mvhd = u32(mvhd, 2)
+
+	tkhd := u32(u32(u32(nil, 0), 0), 0)
+	tkhd = u32(u32(tkhd, 1), 0)
+	tkhd = u32(tkhd, durationMs)
+	tkhd = append(tkhd, make([]byte, 60)...)
+
+	mdhd := u32(u32(u32(nil, 0), 0), 0)
+	mdhd = u32(u32(mdhd, 1000), durationMs)
+	mdhd = u32(mdhd, 0)
+
+	hdlr := append(make([]byte, 8), "soun"...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+
+	moov := &MP4Box{Type: "moov", Children: []*MP4Box{
+		{Type: "mvhd", Data: mvhd},
+		{Type: "trak", Children: []*MP4Box{
+			{Type: "tkhd", Data: tkhd},
+			{Type: "mdia", Children: []*MP4Box{
+				{Type: "mdhd", Data: mdhd},
+				{Type: "hdlr", Data: hdlr},
+				{Type: "minf", Children: []*MP4Box{
+					{Type: "stbl", Children: []*MP4Box{
+						{Type: "stsd", Data: u32(u32(nil, 0), 0)},
+						{Type: "stts", Data: u32(u32(u32(u32(nil, 0), 1), 1), durationMs)},
+						{Type: "stsc", Data: u32(u32(u32(u32(u32(nil, 0), 1), 1), 1), 1)},
+						{Type: "stsz", Data: u32(u32(u32(nil, 0), 4), 1)},
+						{Type: "stco", Data: u32(u32(u32(nil, 0), 1), 0)},
+					}},
+				}},
+			}},
+		}},
+	}}
+
+	// The audio sample is in the mdat box after the ftyp box
+	ftyp := (&MP4Box{Type: "ftyp", Data: []byte("M4B \x00\x00\x02\x00isomM4B ")}).Encode()
+	binary.BigEndian.PutUint32(moov.Child("trak", "mdia", "minf", "stbl", "stco").Data[8:], uint32(len(ftyp)+8))
+	data := append(ftyp, (&MP4Box{Type: "mdat", Data: []byte{1, 2, 3, 4}}).Encode()...)
+	data = append(data, moov.Encode()...)
+
+	file := path.Join(t.TempDir(), "book.m4b")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// testChapters returns the number of chapters, each a minute long, with titles of the length.
+func testChapters(count, titleLength int) []Chapter {
+	var chapters []Chapter
+	for i := 0; i < count; i++ {
+		title := fmt.Sprintf("Chapter %d ", i+1)
+		title += strings.Repeat("é", max(titleLength-len(title), 0)/2)
+		chapters = append(chapters, Chapter{Title: title, StartOffsetMs: i * 60000, StartOffsetSec: i * 60, LengthMs: 60000})
+	}
+	return chapters
+}
+
+func TestMP4ChaptersRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		chapters []Chapter
+	}{
+		{"one chapter", testChapters(1, 10)},
+		{"few chapters", testChapters(12, 20)},
+		{"more than 255 chapters", testChapters(300, 20)},
+		{"long titles", testChapters(3, 600)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			total := len(test.chapters) * 60000
+			file := writeTestMP4(t, uint32(total))
+
+			// Writes the chapters twice, the second time reading them back first like retag does
+			if err := WriteMP4Metadata(file, Metadata{Title: "Book"}, test.chapters); err != nil {
+				t.Fatal(err)
+			}
+			f, err := ReadMP4(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteMP4Metadata(file, Metadata{Title: "Book"}, f.Chapters()); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = ReadMP4(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := f.Chapters()
+			if len(got) != len(test.chapters) {
+				t.Fatalf("got %d chapters, want %d", len(got), len(test.chapters))
+			}
+			for i, want := range test.chapters {
+				if got[i].Title != want.Title || got[i].StartOffsetMs != want.StartOffsetMs || got[i].LengthMs != want.LengthMs {
+					t.Errorf("chapter %d = %q at %d for %d, want %q at %d for %d", i+1, got[i].Title, got[i].StartOffsetMs,
+						got[i].LengthMs, want.Title, want.StartOffsetMs, want.LengthMs)
+				}
+			}
+
+			// The Nero chapters hold the first 255, with their titles cut to 255 bytes
+			nero := f.neroChapters()
+			if len(nero) != min(len(test.chapters), 255) {
+				t.Errorf("got %d Nero chapters, want %d", len(nero), min(len(test.chapters), 255))
+			}
+			if len(nero) > 0 && nero[0].Title != truncateUTF8(test.chapters[0].Title, 255) {
+				t.Errorf("Nero chapter 1 = %q, want %q", nero[0].Title, truncateUTF8(test.chapters[0].Title, 255))
+			}
+		})
+	}
+}
+
+func TestMP4TagsRoundTrip(t *testing.T) {
+
+	file := writeTestMP4(t, 60000)
+	meta := Metadata{Title: "Book", Author: "Author", Narrator: "Narrator", Year: "2020", ASIN: "B000000000",
+		Tags: map[string]string{"CUSTOM": "value"}}
+	if err := WriteMP4Metadata(file, meta, testChapters(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ReadMP4(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := lowerKeys(f.Tags())
+	want := map[string]string{"title": "Book", "album": "Book", "artist": "Author", "composer": "Narrator", "date": "2020",
+		"genre": "Audiobook", "asin": "B000000000", "custom": "value"}
+	for key, value := range want {
+		if tags[key] != value {
+			t.Errorf("tag %s = %q, want %q", key, tags[key], value)
+		}
+	}
+}
+
+func TestMP4SetTagsKeepsUnwrittenItems(t *testing.T) {
+
+	file := writeTestMP4(t, 60000)
+	meta := Metadata{Title: "Book", Author: "Author", Summary: "Summary", Cover: []byte{0xFF, 0xD8}, CoverType: "image/jpeg"}
+	if err := WriteMP4Metadata(file, meta, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes a new title, without a summary or cover
+	if err := WriteMP4Metadata(file, Metadata{Title: "New Book", Author: "Author"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ReadMP4(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := lowerKeys(f.Tags())
+	if tags["title"] != "New Book" || tags["description"] != "Summary" {
+		t.Errorf("title = %q, description = %q, want the new title and the old description", tags["title"], tags["description"])
+	}
+	if cover, _ := f.Cover(); len(cover) != 2 {
+		t.Errorf("cover = %v, want the old cover", cover)
+	}
+
+	// Each item is written once
+	counts := map[string]int{}
+	for _, item := range f.ilst().Children {
+		counts[ilstKey(item)]++
+	}
+	for key, count := range counts {
+		if count != 1 {
+			t.Errorf("%q is written %d times", key, count)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// This file is responsible for the output targets that are produced in a single run.
+
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// OutputTarget describes one output of a run, the format, the layout and where it is written.
+type OutputTarget struct {
+	Format   OutputFormat
+	Single   bool   // A single file with chapter markers, instead of a file per chapter
+	Template string // Directory template relative to the output path, empty uses GetOutputDirPath
+	Encoder  EncoderOptions
+	Fallback EncoderOptions // Used when lossless output is not possible
+}
+
+// OutputPathData contains the fields available to an output path template.
+// Every field is normalized, so it can be used as part of a path.
+type OutputPathData struct {
+	Author   string
+	Narrator string
+	Title    string
+	Series   string
+	Position string // Series position padded the same as the default path, e.g. "02.0"
+	ASIN     string
+	Format   string
+	Layout   string
+	Default  string // The default directory (Author/Series/[Position]. Title (ASIN))
+}
+
+// ParseOutputTarget parses an output flag formatted as "format:layout[:template]",
+// e.g. "m4b:single" or "mp3:split:{{.Author}}/{{.Title}} (MP3)".
+func ParseOutputTarget(spec string) (OutputTarget, error) {
+
+	var target OutputTarget
+
+	// Splits the spec into its parts, the template may contain colons of its own
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 {
+		return target, fmt.Errorf("invalid output '%s', expected format:layout[:template]", spec)
+	}
+
+	// Gets the format
+	format, err := GetOutputFormat(parts[0])
+	if err != nil {
+		return target, err
+	}
+	target.Format = format
+
+	// Gets the layout
+	switch strings.ToLower(parts[1]) {
+	case "single":
+		target.Single = true
+	case "split":
+		target.Single = false
+	default:
+		return target, fmt.Errorf("invalid output layout '%s' (valid: single, split)", parts[1])
+	}
+
+	// Gets the template, and checks it can be parsed
+	if len(parts) == 3 {
+		target.Template = parts[2]
+		if _, err := template.New("output").Option("missingkey=error").Parse(target.Template); err != nil {
+			return target, fmt.Errorf("invalid output template '%s': %w", target.Template, err)
+		}
+	}
+
+	return target, nil
+}
+
+// Layout returns the name of the layout of the target.
+func (t OutputTarget) Layout() string {
+	if t.Single {
+		return "single"
+	}
+	return "split"
+}
+
+// ToString returns a string representation of the OutputTarget struct.
+func (t OutputTarget) ToString() string {
+	if t.Template == "" {
+		return t.Format.Name + ":" + t.Layout()
+	}
+	return t.Format.Name + ":" + t.Layout() + ":" + t.Template
+}
+
+// GetDirPath returns the directory the target is written to.
+// Without a template the directory from GetOutputDirPath is used.
+func (t OutputTarget) GetDirPath(meta Metadata, asin, outPath string) (string, error) {
+
+	// Gets the default directory
+	defaultDir, err := GetOutputDirPath(meta, asin, outPath)
+	if err != nil {
+		return "", err
+	}
+
+	if t.Template == "" {
+		return defaultDir, nil
+	}
+
+	// Builds the template data
+	data := OutputPathData{
+		Author:   NormalizeName(meta.Author),
+		Narrator: NormalizeName(meta.Narrator),
+		Title:    NormalizeName(meta.Title),
+		Series:   NormalizeName(meta.Series.Name),
+		ASIN:     NormalizeName(asin),
+		Format:   t.Format.Name,
+		Layout:   t.Layout(),
+		Default:  strings.TrimPrefix(strings.TrimPrefix(defaultDir, path.Clean(outPath)), "/"),
+	}
+	if meta.Series.Position != 0.0 {
+		data.Position = fmt.Sprintf("%04.1f", meta.Series.Position)
+	}
+
+	// Renders the template
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(t.Template)
+	if err != nil {
+		return "", fmt.Errorf("error parsing output template: %w", err)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("error rendering output template: %w", err)
+	}
+
+	// Normalizes each of the directories, and drops any that are empty
+	var dirs []string
+	for _, dir := range strings.Split(sb.String(), "/") {
+		dir = strings.TrimSpace(NormalizeName(dir))
+		if dir != "" && dir != "." && dir != ".." {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return "", fmt.Errorf("output template '%s' rendered an empty path", t.Template)
+	}
+
+	return path.Join(append([]string{outPath}, dirs...)...), nil
+}
+
+// GetSingleFilePath returns the path of the output file when the target is a single file.
+func (t OutputTarget) GetSingleFilePath(meta Metadata, asin, outputDir string) string {
+	title := NormalizeName(meta.Title)
+	if asin == "" {
+		return path.Join(outputDir, fmt.Sprintf("%s.%s", title, t.Format.Extension))
+	}
+	return path.Join(outputDir, fmt.Sprintf("%s (%s).%s", title, asin, t.Format.Extension))
+}
@@ -0,0 +1,208 @@
+// This file is responsible for inspecting audio files with ffprobe.
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProbeResult contains the parts of the ffprobe JSON output used by the chapterizer.
+type ProbeResult struct {
+	Format struct {
+		FormatName string            `json:"format_name,omitempty"`
+		Duration   string            `json:"duration,omitempty"`
+		BitRate    string            `json:"bit_rate,omitempty"`
+		Tags       map[string]string `json:"tags,omitempty"`
+	} `json:"format,omitempty"`
+	Streams []struct {
+		Index          int               `json:"index,omitempty"`
+		CodecName      string            `json:"codec_name,omitempty"`
+		CodecType      string            `json:"codec_type,omitempty"`
+		CodecTagString string            `json:"codec_tag_string,omitempty"`
+		SampleRate     string            `json:"sample_rate,omitempty"`
+		Channels       int               `json:"channels,omitempty"`
+		BitRate        string            `json:"bit_rate,omitempty"`
+		Tags           map[string]string `json:"tags,omitempty"`
+	} `json:"streams,omitempty"`
+	Chapters []struct {
+		ID        int               `json:"id,omitempty"`
+		TimeBase  string            `json:"time_base,omitempty"`
+		StartTime string            `json:"start_time,omitempty"`
+		EndTime   string            `json:"end_time,omitempty"`
+		Tags      map[string]string `json:"tags,omitempty"`
+	} `json:"chapters,omitempty"`
+}
+
+// StreamInfo describes the first audio stream of a file.
+type StreamInfo struct {
+	Codec      string
+	CodecTag   string
+	SampleRate int
+	Channels   int
+	Bitrate    int // kbps
+}
+
+// probeCache holds the results of ProbeFile, so a file is only probed once per run.
+var probeCache = map[string]ProbeResult{}
+var probeMutex sync.Mutex
+
+// ProbeFile runs ffprobe against the file and returns its format, streams and chapters.
+// Results are cached by path, size and modification time, so repeated calls are free.
+func ProbeFile(ctx context.Context, filepath string) (ProbeResult, error) {
+
+	var result ProbeResult
+
+	// Builds the cache key, so a file that changed is probed again
+	info, err := os.Stat(filepath)
+	if err != nil {
+		return result, fmt.Errorf("error reading file: %w", err)
+	}
+	key := fmt.Sprintf("%s|%d|%d", filepath, info.Size(), info.ModTime().UnixNano())
+
+	// Returns the cached result, if there is one
+	probeMutex.Lock()
+	cached, ok := probeCache[key]
+	probeMutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	// Create a new command with the ffprobe command and arguments
+	cmd := newCommand(ctx, FFprobeBinary, "-v", "error", "-show_format", "-show_streams", "-show_chapters", "-of", "json", filepath)
+
+	// Run the command and capture the stdout
+	stdout, err := cmd.Output()
+	if err != nil {
+		return result, fmt.Errorf("error running ffprobe command: %w", err)
+	}
+
+	// Decodes the JSON output
+	if err := json.Unmarshal(stdout, &result); err != nil {
+		return result, fmt.Errorf("error decoding ffprobe output: %w", err)
+	}
+
+	// Stores the result for the next call
+	probeMutex.Lock()
+	probeCache[key] = result
+	probeMutex.Unlock()
+
+	return result, nil
+}
+
+// AudioStream returns the details of the first audio stream in the probe result.
+func (r ProbeResult) AudioStream() (StreamInfo, error) {
+
+	for _, stream := range r.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+
+		info := StreamInfo{
+			Codec:    stream.CodecName,
+			CodecTag: stream.CodecTagString,
+			Channels: stream.Channels,
+		}
+
+		// ffprobe reports numbers as strings, missing values are left at zero
+		info.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+		if bps, err := strconv.Atoi(stream.BitRate); err == nil {
+			info.Bitrate = bps / 1000
+		}
+
+		return info, nil
+	}
+
+	return StreamInfo{}, fmt.Errorf("no audio stream found")
+}
+
+// DurationMS returns the duration of the probed file in milliseconds.
+func (r ProbeResult) DurationMS() int {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(r.Format.Duration), 64)
+	if err != nil {
+		return 0
+	}
+	return int(seconds * 1000)
+}
+
+// CanStreamCopyMP3 checks if the files can be muxed into an MP4 container without transcoding.
+// All files must be MP3 and share the same sample rate and channel layout, since the
+// container only holds a single description of the audio stream.
+// It returns whether the files can be copied, and the reason if they can not.
+func CanStreamCopyMP3(ctx context.Context, files []string) (bool, string, error) {
+
+	if len(files) == 0 {
+		return false, "no input files", nil
+	}
+
+	var first StreamInfo
+	for i, file := range files {
+
+		// Probes the file for the audio stream details
+		result, err := ProbeFile(ctx, file)
+		if err != nil {
+			return false, "", err
+		}
+		info, err := result.AudioStream()
+		if err != nil {
+			return false, "", fmt.Errorf("error probing %s: %w", file, err)
+		}
+
+		// Only MP3 audio can be copied
+		if info.Codec != "mp3" {
+			return false, fmt.Sprintf("%s is %s, not mp3", path.Base(file), info.Codec), nil
+		}
+
+		// Every file must match the first one
+		if i == 0 {
+			first = info
+		} else if info.SampleRate != first.SampleRate || info.Channels != first.Channels {
+			return false, fmt.Sprintf("%s has a different sample rate or channel layout", path.Base(file)), nil
+		}
+	}
+
+	return true, "", nil
+}
+
+// CheckM4BCompatible checks that a stream copied M4B file can be played by common audiobook players.
+// The file must be an MP4 container holding a single MP3 stream with the MP4 sample entry,
+// and it must contain the expected number of chapters.
+func CheckM4BCompatible(ctx context.Context, filepath string, chapters int) error {
+
+	result, err := ProbeFile(ctx, filepath)
+	if err != nil {
+		return err
+	}
+
+	// Checks the container
+	if !strings.Contains(result.Format.FormatName, "mp4") {
+		return fmt.Errorf("container is %s, not mp4", result.Format.FormatName)
+	}
+
+	// Checks the audio stream
+	info, err := result.AudioStream()
+	if err != nil {
+		return err
+	}
+	if info.Codec != "mp3" || info.CodecTag != "mp4a" {
+		return fmt.Errorf("audio stream is %s (%s), expected mp3 (mp4a)", info.Codec, info.CodecTag)
+	}
+
+	// Checks the duration could be read
+	if result.DurationMS() <= 0 {
+		return fmt.Errorf("duration could not be read")
+	}
+
+	// Checks the chapters were written
+	if len(result.Chapters) != chapters {
+		return fmt.Errorf("expected %d chapters, found %d", chapters, len(result.Chapters))
+	}
+
+	return nil
+}
@@ -0,0 +1,431 @@
+// This file is responsible for finding the outputs of a book that were already made, and retagging them in place.
+
+package pkg
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RetagFormats are the output formats whose tags and chapters can be rewritten without touching the audio.
+var RetagFormats = []string{"mp3", "m4b", "m4a"}
+
+var (
+	// splitFileRegex matches the name of a chapter file of a split output, as written by SplitFileName
+	splitFileRegex = regexp.MustCompile(`^\[(\d+)\]\. `)
+	// asinDirRegex matches the ASIN at the end of the default output directory, e.g. "Title (B00ABCDEFG)"
+	asinDirRegex = regexp.MustCompile(`\(([A-Z0-9]{10})\)$`)
+)
+
+// BookOutput is an output of a book that was already made, a single file or the chapter files of a split output.
+type BookOutput struct {
+	Format OutputFormat
+	Single bool
+	Files  []string // The single file, or the chapter files in track order
+}
+
+// BookDir is a directory that holds the outputs of a book.
+type BookDir struct {
+	Path    string
+	ASIN    string
+	Outputs []BookOutput
+}
+
+// ReadBookDir finds the outputs in the directory. Files named by SplitFileName are the chapters of a split
+// output, any other audio file is a single output. The ASIN is read from the name of the directory, or from
+// the tags of the first output.
+func ReadBookDir(dir string) (BookDir, error) {
+
+	book := BookDir{Path: path.Clean(dir)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return book, fmt.Errorf("error reading directory: %w", err)
+	}
+
+	split := map[string][]string{}
+	numbers := map[string]int{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		format, ok := OutputFormats[strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")]
+		if !ok {
+			continue
+		}
+
+		file := path.Join(book.Path, name)
+		if match := splitFileRegex.FindStringSubmatch(name); match != nil {
+			numbers[file], _ = strconv.Atoi(match[1])
+			split[format.Name] = append(split[format.Name], file)
+			continue
+		}
+		book.Outputs = append(book.Outputs, BookOutput{Format: format, Single: true, Files: []string{file}})
+	}
+
+	// Sorts the chapter files of each split output by their track number
+	var names []string
+	for name := range split {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files := split[name]
+		sort.Slice(files, func(i, j int) bool { return numbers[files[i]] < numbers[files[j]] })
+		book.Outputs = append(book.Outputs, BookOutput{Format: OutputFormats[name], Files: files})
+	}
+
+	// Gets the ASIN from the manifest, the directory name, or the tags of the outputs
+	if manifest, err := ReadManifest(book.Path); err == nil && manifest.ASIN != "" {
+		book.ASIN = manifest.ASIN
+	} else if match := asinDirRegex.FindStringSubmatch(path.Base(book.Path)); match != nil {
+		book.ASIN = match[1]
+	} else if len(book.Outputs) > 0 {
+		book.ASIN = readOutputASIN(book.Outputs[0])
+	}
+
+	return book, nil
+}
+
+// FindBookDirs finds the directories under the root that hold outputs of the book with the ASIN.
+func FindBookDirs(root, asin string) ([]BookDir, error) {
+
+	var found []BookDir
+	err := filepath.WalkDir(root, func(dir string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+
+		book, err := ReadBookDir(filepath.ToSlash(dir))
+		if err != nil {
+			return err
+		}
+		if len(book.Outputs) > 0 && strings.EqualFold(book.ASIN, asin) {
+			found = append(found, book)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching %s: %w", root, err)
+	}
+
+	return found, nil
+}
+
+// OutputRoot returns the output path the directory was written to, if it is the directory GetOutputDirPath
+// returns for the metadata.
+func OutputRoot(dir string, meta Metadata) (string, bool) {
+
+	rel, err := GetOutputDirPath(meta, meta.ASIN, "")
+	if err != nil {
+		return "", false
+	}
+
+	dir = path.Clean(dir)
+	if dir == rel {
+		return ".", true
+	}
+	if !strings.HasSuffix(dir, "/"+rel) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(dir, "/"+rel), true
+}
+
+// Move moves the directory of the book, and removes the directories it leaves empty up to the root.
+func (b *BookDir) Move(dir, root string) error {
+
+	dir = path.Clean(dir)
+	if dir == b.Path {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil && !strings.EqualFold(dir, b.Path) {
+		return fmt.Errorf("%s already exists", dir)
+	}
+
+	if err := os.MkdirAll(path.Dir(dir), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	if err := os.Rename(b.Path, dir); err != nil {
+		return fmt.Errorf("error moving directory: %w", err)
+	}
+
+	// Removes the author and series directories if they are now empty
+	root = path.Clean(root)
+	for parent := path.Dir(b.Path); strings.HasPrefix(parent, root+"/"); parent = path.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break
+		}
+	}
+
+	for i := range b.Outputs {
+		for j, file := range b.Outputs[i].Files {
+			b.Outputs[i].Files[j] = path.Join(dir, path.Base(file))
+		}
+	}
+	b.Path = dir
+
+	return nil
+}
+
+// ReadMetadata reads the book details and chapters of the output from its tags, without ffprobe. The chapters
+// of a split output are its files, in track order.
+func (o BookOutput) ReadMetadata() (Metadata, error) {
+
+	var metadata Metadata
+	if !containsString(RetagFormats, o.Format.Name) {
+		return metadata, fmt.Errorf("%s outputs can not be retagged (valid: %s)", o.Format.Name, strings.Join(RetagFormats, ", "))
+	}
+
+	start := 0
+	for i, file := range o.Files {
+		tags, chapters, durationMs, err := readOutputFile(file, o.Format)
+		if err != nil {
+			return metadata, fmt.Errorf("error reading %s: %w", path.Base(file), err)
+		}
+
+		if i == 0 {
+			metadata = metadataFromTags(tags)
+		}
+		if o.Single {
+			metadata.Chapters = chapters
+			metadata.Duration = CalculateDuration(durationMs)
+			return metadata, nil
+		}
+
+		// Each file of a split output is a chapter
+		title := firstTag(tags, "title")
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		metadata.Chapters = append(metadata.Chapters, Chapter{
+			LengthMs:       durationMs,
+			StartOffsetMs:  start,
+			StartOffsetSec: start / 1000,
+			Title:          title,
+		})
+		start += durationMs
+	}
+	metadata.Duration = CalculateDuration(start)
+
+	return metadata, nil
+}
+
+// FileNames returns the names the files of the output have once it is retagged with the metadata.
+func (o BookOutput) FileNames(meta Metadata) []string {
+
+	dir := path.Dir(o.Files[0])
+	if o.Single {
+		return []string{OutputTarget{Format: o.Format}.GetSingleFilePath(meta, meta.ASIN, dir)}
+	}
+
+	var names []string
+	for i, chapter := range meta.Chapters {
+		names = append(names, path.Join(dir, SplitFileName(i+1, chapter.Title, o.Format.Extension)))
+	}
+	return names
+}
+
+// Retag rewrites the tags, chapter titles and cover of the output from the metadata, and renames its files to
+// match. The audio is not changed, so the chapters of the metadata must be the chapters of the output, with
+// only their titles changed. The cover of each file is kept if the metadata has none.
+func (o *BookOutput) Retag(meta Metadata) error {
+
+	if !o.Single && len(meta.Chapters) != len(o.Files) {
+		return fmt.Errorf("the output has %d files, but there are %d chapters", len(o.Files), len(meta.Chapters))
+	}
+
+	names := o.FileNames(meta)
+	for i, file := range o.Files {
+
+		var err error
+		switch o.Format.Muxer {
+		case "ipod":
+			err = retagMP4(file, meta, i, o.Single)
+		case "mp3":
+			err = retagMP3(file, meta, i, o.Single)
+		default:
+			err = fmt.Errorf("%s outputs can not be retagged (valid: %s)", o.Format.Name, strings.Join(RetagFormats, ", "))
+		}
+		if err != nil {
+			return fmt.Errorf("error retagging %s: %w", path.Base(file), err)
+		}
+
+		// Renames the file, the track number keeps the names of split files unique
+		if names[i] == file {
+			continue
+		}
+		if _, err := os.Stat(names[i]); err == nil && !strings.EqualFold(names[i], file) {
+			return fmt.Errorf("error renaming %s: %s already exists", path.Base(file), path.Base(names[i]))
+		}
+		if err := os.Rename(file, names[i]); err != nil {
+			return fmt.Errorf("error renaming %s: %w", path.Base(file), err)
+		}
+		o.Files[i] = names[i]
+	}
+
+	return nil
+}
+
+// readOutputFile reads the tags of an output file with lower case keys, its chapters and its duration.
+func readOutputFile(file string, format OutputFormat) (map[string]string, []Chapter, int, error) {
+
+	switch format.Muxer {
+	case "ipod":
+		f, err := ReadMP4(file)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return lowerKeys(f.Tags()), f.Chapters(), f.DurationMS(), nil
+
+	case "mp3":
+		tag, err := ReadID3v2(file)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		info, err := ScanMP3(file)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return tag.TextTags(), tag.Chapters(), info.DurationMS(), nil
+	}
+
+	return nil, nil, 0, fmt.Errorf("%s outputs can not be read", format.Name)
+}
+
+// readOutputASIN returns the ASIN tag of the first file of the output, it only reads the tags.
+func readOutputASIN(o BookOutput) string {
+
+	switch o.Format.Muxer {
+	case "ipod":
+		if f, err := ReadMP4(o.Files[0]); err == nil {
+			return lowerKeys(f.Tags())["asin"]
+		}
+	case "mp3":
+		if tag, err := ReadID3v2(o.Files[0]); err == nil {
+			return tag.TextTags()["asin"]
+		}
+	}
+
+	return ""
+}
+
+// retagMP4 replaces the tags of an MP4 file, and its chapters if it is a single file. The index is the chapter
+// the file holds when it is part of a split output.
+func retagMP4(file string, meta Metadata, index int, single bool) error {
+
+	f, err := ReadMP4(file)
+	if err != nil {
+		return err
+	}
+
+	if meta.Cover == nil {
+		meta.Cover, meta.CoverType = f.Cover()
+	}
+	f.SetTags(meta)
+
+	if single {
+		if err := f.SetChapters(meta.Chapters); err != nil {
+			return err
+		}
+	} else {
+		f.SetTrack(meta.Chapters[index].Title, index+1, len(meta.Chapters))
+	}
+
+	return f.Save()
+}
+
+// retagMP3 replaces the tags of an MP3 file, and its chapter frames if it is a single file. Frames the
+// metadata does not write are kept, including the cover if the metadata has none.
+func retagMP3(file string, meta Metadata, index int, single bool) error {
+
+	old, err := ReadID3v2(file)
+	if err != nil {
+		return err
+	}
+
+	// Builds the frames, the same way as the outputs are tagged
+	var frames []ID3Frame
+	text := func(id, value string) {
+		if value != "" {
+			frames = append(frames, NewID3TextFrame(id, value))
+		}
+	}
+	user := func(description, value string) {
+		if value != "" {
+			frames = append(frames, NewID3UserTextFrame(description, value))
+		}
+	}
+
+	if single {
+		text("TIT2", meta.Title)
+	} else {
+		text("TIT2", meta.Chapters[index].Title)
+		text("TRCK", fmt.Sprintf("%d/%d", index+1, len(meta.Chapters)))
+	}
+	text("TALB", meta.Title)
+	text("TPE1", meta.Author)
+	text("TPE2", meta.Author)
+	text("TCOM", meta.Narrator)
+	text("TPUB", meta.Publisher)
+	text("TDRC", meta.Year)
+	user("ASIN", meta.ASIN)
+	user("SERIES", meta.Series.Name)
+	if meta.Series.Name != "" && meta.Series.Position != 0 {
+		user("SERIES-PART", strconv.FormatFloat(meta.Series.Position, 'f', -1, 64))
+	}
+	for _, key := range sortedKeys(meta.Tags) {
+		user(key, meta.Tags[key])
+	}
+	if single {
+		user("description", meta.Summary)
+		frames = append(frames, NewID3ChapterFrames(meta.Chapters)...)
+	}
+	if meta.Cover != nil {
+		frames = append(frames, NewID3PictureFrame(meta.CoverType, meta.Cover))
+	}
+
+	// Removes the frames that are replaced, the TXXX frames written by ffmpeg use lower case descriptions
+	replaced := map[string]bool{"TIT2": true, "TALB": true, "TPE1": true, "TPE2": true, "TCOM": true, "TPUB": true, "TDRC": true, "TYER": true}
+	if !single {
+		replaced["TRCK"] = true
+	} else {
+		replaced["CHAP"], replaced["CTOC"] = true, true
+	}
+	if meta.Cover != nil {
+		replaced["APIC"] = true
+	}
+	users := map[string]bool{"asin": true, "series": true, "series-part": true, "number": true, "author": true, "description": single}
+	for key := range meta.Tags {
+		users[strings.ToLower(key)] = true
+	}
+
+	tag := ID3Tag{Version: 4}
+	for _, frame := range old.Frames {
+		if replaced[frame.ID] {
+			continue
+		}
+		if frame.ID == "TXXX" && len(frame.Data) > 0 {
+			description := strings.SplitN(DecodeID3String(frame.Data[0], frame.Data[1:]), "\x00", 2)[0]
+			if users[strings.ToLower(description)] {
+				continue
+			}
+		}
+		tag.Frames = append(tag.Frames, frame)
+	}
+	tag.Frames = append(tag.Frames, frames...)
+
+	return WriteID3v2(file, tag)
+}
@@ -0,0 +1,144 @@
+// This file is responsible for the post-processing rules that are applied to the chapters before output.
+
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+var (
+	creditsRegex         = regexp.MustCompile(`(?i)^\s*(opening|closing|end|ending)?\s*credits\s*$`)
+	numberedChapterRegex = regexp.MustCompile(`^Chapter \d+$`)
+)
+
+// ChapterRules describes the post-processing applied to the chapters, a zero value disables a rule.
+type ChapterRules struct {
+	MinLengthMs int  // Chapters shorter than this are merged into a neighbour
+	MaxLengthMs int  // Chapters longer than this are split into parts at silences
+	DropCredits bool // Removes the "Opening Credits" and "End Credits" chapters
+	Renumber    bool // Renumbers the "Chapter N" titles so they are sequential
+}
+
+// IsEnabled checks if any of the rules are enabled.
+func (r ChapterRules) IsEnabled() bool {
+	return r.MinLengthMs > 0 || r.MaxLengthMs > 0 || r.DropCredits || r.Renumber
+}
+
+// Apply runs the rules over the chapters, in the order credits, merge, split and renumber.
+// Removed chapters are not cut from the audio, their time is given to a neighbouring chapter.
+// The silences are used to pick where long chapters are split, and can be nil.
+func (r ChapterRules) Apply(chapters []Chapter, silences []Silence) []Chapter {
+
+	// Copies the chapters so the originals are not changed
+	result := make([]Chapter, len(chapters))
+	copy(result, chapters)
+
+	if r.DropCredits {
+		for i := 0; i < len(result) && len(result) > 1; {
+			// Libby adds the length to some titles, e.g. "Opening Credits (00:32)"
+			if creditsRegex.MatchString(timestampRegex.ReplaceAllString(result[i].Title, "")) {
+				result = absorbChapter(result, i, i > 0 && i == len(result)-1)
+				continue
+			}
+			i++
+		}
+	}
+
+	if r.MinLengthMs > 0 {
+		for i := 0; i < len(result) && len(result) > 1; {
+			if result[i].LengthMs < r.MinLengthMs {
+				// Merges into the shorter neighbour, so the chapters stay as even as possible
+				intoPrevious := i == len(result)-1 || (i > 0 && result[i-1].LengthMs < result[i+1].LengthMs)
+				result = absorbChapter(result, i, intoPrevious)
+				continue
+			}
+			i++
+		}
+	}
+
+	if r.MaxLengthMs > 0 {
+		var split []Chapter
+		for _, chapter := range result {
+			split = append(split, splitChapter(chapter, r.MaxLengthMs, silences)...)
+		}
+		result = split
+	}
+
+	if r.Renumber {
+		number := 1
+		for i := range result {
+			if numberedChapterRegex.MatchString(result[i].Title) {
+				result[i].Title = "Chapter " + strconv.Itoa(number)
+				number++
+			}
+		}
+	}
+
+	return result
+}
+
+// absorbChapter removes the chapter at the index, and gives its time to the previous or next chapter.
+// The neighbour keeps its own title.
+func absorbChapter(chapters []Chapter, index int, intoPrevious bool) []Chapter {
+
+	removed := chapters[index]
+	if intoPrevious {
+		chapters[index-1].LengthMs += removed.LengthMs
+	} else {
+		chapters[index+1].StartOffsetMs = removed.StartOffsetMs
+		chapters[index+1].StartOffsetSec = removed.StartOffsetSec
+		chapters[index+1].LengthMs += removed.LengthMs
+	}
+
+	return append(chapters[:index], chapters[index+1:]...)
+}
+
+// splitChapter splits a chapter longer than maxMs into even parts titled "Title (Part 1/2)".
+// Each cut is moved to the silence closest to it, as long as the parts stay within a quarter of their length.
+func splitChapter(chapter Chapter, maxMs int, silences []Silence) []Chapter {
+
+	if chapter.LengthMs <= maxMs {
+		return []Chapter{chapter}
+	}
+
+	parts := int(math.Ceil(float64(chapter.LengthMs) / float64(maxMs)))
+	partMs := chapter.LengthMs / parts
+	end := chapter.StartOffsetMs + chapter.LengthMs
+
+	// Finds where each part starts
+	starts := []int{chapter.StartOffsetMs}
+	for i := 1; i < parts; i++ {
+		target := chapter.StartOffsetMs + i*partMs
+		cut := target
+		best := partMs / 4
+		for _, silence := range silences {
+			mid := silence.MidMs()
+			distance := int(math.Abs(float64(mid - target)))
+			if distance < best && mid > starts[len(starts)-1] && mid < end {
+				cut = mid
+				best = distance
+			}
+		}
+		starts = append(starts, cut)
+	}
+
+	// Creates the parts
+	var result []Chapter
+	for i, start := range starts {
+		partEnd := end
+		if i < len(starts)-1 {
+			partEnd = starts[i+1]
+		}
+		result = append(result, Chapter{
+			LengthMs:       partEnd - start,
+			StartOffsetMs:  start,
+			StartOffsetSec: start / 1000,
+			Title:          fmt.Sprintf("%s (Part %d/%d)", chapter.Title, i+1, parts),
+		})
+	}
+
+	return result
+}
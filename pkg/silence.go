@@ -0,0 +1,192 @@
+// This file is responsible for detecting silence in the audio, and moving chapter boundaries onto it.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	silenceStartRegex = regexp.MustCompile(`silence_start: (-?[\d.]+)`)
+	silenceEndRegex   = regexp.MustCompile(`silence_end: (-?[\d.]+)`)
+)
+
+// Silence is a gap in the audio, in milliseconds from the start of the book.
+type Silence struct {
+	StartMs int
+	EndMs   int
+}
+
+// SilenceOptions describes what counts as silence.
+type SilenceOptions struct {
+	NoiseDb       float64 // Anything quieter than this is silence, e.g. -30
+	MinDurationMs int     // Shortest gap that counts as silence
+}
+
+// BoundarySnap describes how far a chapter boundary was moved onto a silence.
+type BoundarySnap struct {
+	Index      int
+	Title      string
+	OriginalMs int
+	SnappedMs  int
+	Snapped    bool // False if there was no silence inside the window
+}
+
+// MidMs returns the middle of the silence, which is the safest place to cut.
+func (s Silence) MidMs() int {
+	return s.StartMs + (s.EndMs-s.StartMs)/2
+}
+
+// DurationMs returns the length of the silence.
+func (s Silence) DurationMs() int {
+	return s.EndMs - s.StartMs
+}
+
+// DetectSilences runs ffmpeg's silencedetect filter over the whole concatenated book in a single pass,
+// and returns every gap that is quieter and longer than the options specify.
+func DetectSilences(ctx context.Context, files []string, opts SilenceOptions) ([]Silence, error) {
+
+	fmt.Println("Detecting silence...")
+
+	// Create a slice to store the command line arguments
+	var args []string
+
+	// Append the input file paths to the arguments slice using the "concat" format
+	args = append(args, "-hide_banner", "-nostats", "-i", "concat:"+strings.Join(files, "|"))
+
+	// Analyses the audio, and discards the output
+	filter := fmt.Sprintf("silencedetect=noise=%gdB:d=%g", opts.NoiseDb, float64(opts.MinDurationMs)/1000)
+	args = append(args, "-map", "0:a", "-af", filter, "-f", "null", "-")
+
+	// Create a new command using the ffmpeg executable and the arguments
+	cmd := newCommand(ctx, FFmpegBinary, args...)
+
+	// The silences are logged to stderr
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println("Output:", string(output))
+		return nil, fmt.Errorf("error running ffmpeg command: %w", err)
+	}
+
+	// Each silence is logged as a start line followed by an end line
+	var silences []Silence
+	start := -1
+	for _, line := range strings.Split(string(output), "\n") {
+		if match := silenceStartRegex.FindStringSubmatch(line); match != nil {
+			start = secondsToMs(match[1])
+		} else if match := silenceEndRegex.FindStringSubmatch(line); match != nil && start != -1 {
+			silences = append(silences, Silence{StartMs: max(start, 0), EndMs: secondsToMs(match[1])})
+			start = -1
+		}
+	}
+
+	// A silence at the very end of the audio has no end line
+	if start != -1 {
+		total, err := GetTotalDurationMS(ctx, files)
+		if err != nil {
+			return nil, err
+		}
+		silences = append(silences, Silence{StartMs: start, EndMs: total})
+	}
+
+	return silences, nil
+}
+
+// SnapChapters moves each chapter boundary to the middle of the nearest silence within windowMs of it. If the
+// middle of a long silence is further away than the window, the boundary moves to the point of the silence at the
+// edge of the window instead, so a boundary is never moved more than windowMs.
+// The start of the first chapter and the end of the last chapter are not moved, and the lengths of the
+// chapters are recalculated. It returns the new chapters and a report of how far each boundary moved.
+func SnapChapters(chapters []Chapter, silences []Silence, windowMs int) ([]Chapter, []BoundarySnap) {
+
+	// Copies the chapters so the originals are not changed
+	snapped := make([]Chapter, len(chapters))
+	copy(snapped, chapters)
+
+	var report []BoundarySnap
+	for i := 1; i < len(snapped); i++ {
+
+		boundary := snapped[i].StartOffsetMs
+		snap := BoundarySnap{Index: i + 1, Title: snapped[i].Title, OriginalMs: boundary, SnappedMs: boundary}
+
+		// The boundary has to stay between the start of the previous chapter and the end of this one
+		lower := snapped[i-1].StartOffsetMs
+		upper := snapped[i].StartOffsetMs + snapped[i].LengthMs
+
+		// Finds the silence closest to the boundary, and the point in it to cut at
+		best := -1
+		bestDistance := math.MaxInt
+		target := boundary
+		for j, silence := range silences {
+			distance := distanceToSilence(boundary, silence)
+			cut := min(max(silence.MidMs(), boundary-windowMs), boundary+windowMs)
+			if distance <= windowMs && distance < bestDistance && cut > lower && cut < upper {
+				best = j
+				bestDistance = distance
+				target = cut
+			}
+		}
+
+		// Moves the boundary to the point in the silence
+		if best != -1 {
+			snap.SnappedMs = target
+			snap.Snapped = true
+			end := snapped[i].StartOffsetMs + snapped[i].LengthMs
+			snapped[i].StartOffsetMs = snap.SnappedMs
+			snapped[i].StartOffsetSec = snap.SnappedMs / 1000
+			snapped[i].LengthMs = end - snap.SnappedMs
+			snapped[i-1].LengthMs = snap.SnappedMs - snapped[i-1].StartOffsetMs
+		}
+
+		report = append(report, snap)
+	}
+
+	return snapped, report
+}
+
+// FormatSnapReport returns a table of how far each chapter boundary moved, for printing.
+func FormatSnapReport(report []BoundarySnap) string {
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%-4s %-13s %-13s %-11s %s\n", "#", "Original", "Snapped", "Moved", "Title"))
+	for _, item := range report {
+		moved := "no silence"
+		if item.Snapped {
+			moved = fmt.Sprintf("%+.2fs", float64(item.SnappedMs-item.OriginalMs)/1000)
+		}
+		sb.WriteString(fmt.Sprintf("%-4d %-13s %-13s %-11s %s\n",
+			item.Index,
+			CalculateDuration(item.OriginalMs).ToString(),
+			CalculateDuration(item.SnappedMs).ToString(),
+			moved,
+			item.Title,
+		))
+	}
+
+	return sb.String()
+}
+
+// distanceToSilence returns how far the offset is from the silence, 0 if it is inside it.
+func distanceToSilence(offset int, silence Silence) int {
+	if offset < silence.StartMs {
+		return silence.StartMs - offset
+	}
+	if offset > silence.EndMs {
+		return offset - silence.EndMs
+	}
+	return 0
+}
+
+// secondsToMs converts a number of seconds logged by ffmpeg to milliseconds.
+func secondsToMs(seconds string) int {
+	value, err := strconv.ParseFloat(seconds, 64)
+	if err != nil {
+		return 0
+	}
+	return int(math.Round(value * 1000))
+}
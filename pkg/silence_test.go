@@ -0,0 +1,40 @@
+package pkg
+
+import "testing"
+
+func TestSnapChapters(t *testing.T) {
+
+	chapters := func(boundary int) []Chapter {
+		return []Chapter{
+			{Title: "One", StartOffsetMs: 0, LengthMs: boundary},
+			{Title: "Two", StartOffsetMs: boundary, StartOffsetSec: boundary / 1000, LengthMs: 100000 - boundary},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		boundary int
+		silences []Silence
+		window   int
+		want     int
+		snapped  bool
+	}{
+		{"middle of a short silence", 50000, []Silence{{StartMs: 50500, EndMs: 51500}}, 2000, 51000, true},
+		{"no silence in the window", 50000, []Silence{{StartMs: 53000, EndMs: 54000}}, 2000, 50000, false},
+		{"long silence clamped to the window", 50000, []Silence{{StartMs: 49000, EndMs: 70000}}, 2000, 52000, true},
+		{"long silence before the boundary", 50000, []Silence{{StartMs: 30000, EndMs: 49500}}, 2000, 48000, true},
+		{"nearest of two silences", 50000, []Silence{{StartMs: 47000, EndMs: 47500}, {StartMs: 50800, EndMs: 51000}}, 5000, 50900, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, report := SnapChapters(chapters(test.boundary), test.silences, test.window)
+			if got[1].StartOffsetMs != test.want || report[0].Snapped != test.snapped {
+				t.Errorf("boundary = %d (snapped %v), want %d (snapped %v)", got[1].StartOffsetMs, report[0].Snapped, test.want, test.snapped)
+			}
+			if got[0].LengthMs+got[1].LengthMs != 100000 {
+				t.Errorf("chapter lengths add up to %d, want 100000", got[0].LengthMs+got[1].LengthMs)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// This file is responsible for writing the files of an output to a staging directory, and moving them into place
+// once they are checked, so a failed run never leaves partial files in the output directory.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// stagingPrefix is the prefix of the staging directories, they are hidden so they are not read as outputs.
+const stagingPrefix = ".libby-chapterizer-tmp-"
+
+// OverwritePolicy is what is done when an output file already exists, and was not finished by a previous run.
+type OverwritePolicy string
+
+const (
+	OverwriteSkip    OverwritePolicy = "skip"      // Keeps the existing file, and does not write the output file
+	OverwriteReplace OverwritePolicy = "overwrite" // Replaces the existing file
+	OverwriteRename  OverwritePolicy = "rename"    // Writes the output file with a numbered suffix, e.g. "Title (1).m4b"
+	OverwriteFail    OverwritePolicy = "fail"      // Stops with an error
+)
+
+// OverwritePolicies are the names of the valid overwrite policies.
+var OverwritePolicies = []string{string(OverwriteSkip), string(OverwriteReplace), string(OverwriteRename), string(OverwriteFail)}
+
+// Validate checks the overwrite policy is one of the valid policies.
+func (p OverwritePolicy) Validate() error {
+	for _, policy := range OverwritePolicies {
+		if string(p) == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid overwrite policy '%s' (valid: %s)", p, strings.Join(OverwritePolicies, ", "))
+}
+
+// CanWrite checks if the file can be written under the policy. It returns false if an existing file is skipped,
+// and an error if an existing file fails the run.
+func (p OverwritePolicy) CanWrite(file string) (bool, error) {
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error checking output file: %w", err)
+	}
+
+	switch p {
+	case OverwriteSkip:
+		return false, nil
+	case OverwriteFail:
+		return false, fmt.Errorf("%s already exists (use --overwrite to skip, replace or rename it)", file)
+	}
+	return true, nil
+}
+
+// Staging is a temporary directory inside an output directory, the files of the output are written to it and
+// moved into the output directory once they are checked.
+type Staging struct {
+	Dir       string          // The staging directory
+	OutputDir string          // The directory the files are moved to
+	Policy    OverwritePolicy // What is done when a file already exists in the output directory
+	keep      bool            // A file failed the check, so the directory is kept
+}
+
+// NewStaging removes the staging directories left by runs that were stopped, and creates a new one in the
+// output directory.
+func NewStaging(outputDir string, policy OverwritePolicy) (*Staging, error) {
+
+	if err := CleanStaging(outputDir); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(outputDir, stagingPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	return &Staging{Dir: dir, OutputDir: outputDir, Policy: policy}, nil
+}
+
+// CleanStaging removes the staging directories and temporary files left in the output directory by runs that were
+// stopped, and the ffmetadata.txt older versions left behind.
+func CleanStaging(outputDir string) error {
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return fmt.Errorf("error reading output directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		stale := (entry.IsDir() && strings.HasPrefix(name, stagingPrefix)) ||
+			(!entry.IsDir() && (name == ManifestName+".tmp" || name == "ffmetadata.txt"))
+		if !stale {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(outputDir, name)); err != nil {
+			return fmt.Errorf("error removing stale file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Path returns the path a file is written to in the staging directory.
+func (s *Staging) Path(name string) string {
+	return path.Join(s.Dir, name)
+}
+
+// Check checks the staged file is as long as expected and, if the chapters are given, has a chapter marker for
+// each of them. If it fails, the staging directory is kept so the file can be looked at.
+func (s *Staging) Check(ctx context.Context, name string, format OutputFormat, expectedMs int, chapters []Chapter, opts VerifyOptions) error {
+
+	file := verifyFile(ctx, s.Path(name), expectedMs, opts)
+	if file.Exists && chapters != nil {
+		markers, err := readChapterMarkers(ctx, file.Path, format, file.ActualMs)
+		if err != nil {
+			file.Problems = append(file.Problems, "unable to read the chapter markers: "+err.Error())
+		} else {
+			file.Problems = append(file.Problems, compareChapters(markers, chapters, format, opts.ToleranceMs)...)
+		}
+	}
+
+	if len(file.Problems) > 0 {
+		s.keep = true
+		return fmt.Errorf("%s failed the output check: %s (the file was kept in %s until the next run, use --check-tolerance or --no-check to accept it)",
+			name, strings.Join(file.Problems, ", "), s.Path(name))
+	}
+	return nil
+}
+
+// Place moves the staged file into the output directory under the overwrite policy, and returns the name it was
+// given (empty if it was skipped). The companions are staged files that belong to it (e.g. its chapter file),
+// they are moved with it and keep the same name.
+func (s *Staging) Place(name string, companions ...string) (string, error) {
+
+	dest := name
+	ok, err := s.Policy.CanWrite(path.Join(s.OutputDir, dest))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		fmt.Println("Skipping " + name + ", it already exists")
+		return "", nil
+	}
+
+	// Finds a name that is not used yet
+	if s.Policy == OverwriteRename {
+		ext := path.Ext(name)
+		for i := 1; ; i++ {
+			if _, err := os.Stat(path.Join(s.OutputDir, dest)); os.IsNotExist(err) {
+				break
+			}
+			dest = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+		}
+	}
+
+	if err := os.Rename(s.Path(name), path.Join(s.OutputDir, dest)); err != nil {
+		return "", fmt.Errorf("error moving output file: %w", err)
+	}
+
+	// Moves the companions, renamed the same way as the file
+	base, destBase := strings.TrimSuffix(name, path.Ext(name)), strings.TrimSuffix(dest, path.Ext(dest))
+	for _, companion := range companions {
+		target := destBase + strings.TrimPrefix(companion, base)
+		if err := os.Rename(s.Path(companion), path.Join(s.OutputDir, target)); err != nil {
+			return "", fmt.Errorf("error moving output file: %w", err)
+		}
+	}
+
+	return dest, nil
+}
+
+// Remove removes the staging directory, and any files left in it. It is kept if a file failed the check, and
+// removed by the next run instead.
+func (s *Staging) Remove() error {
+	if s.keep {
+		return nil
+	}
+	if err := os.RemoveAll(s.Dir); err != nil {
+		return fmt.Errorf("error removing staging directory: %w", err)
+	}
+	return nil
+}
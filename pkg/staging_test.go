@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+// readDir returns the names in the directory, sorted.
+func readDir(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestStagingPlace(t *testing.T) {
+
+	tests := []struct {
+		policy   OverwritePolicy
+		existing bool
+		placed   string
+		content  map[string]string
+		err      bool
+	}{
+		{policy: OverwriteReplace, placed: "Book.m4b", content: map[string]string{"Book.m4b": "new", "Book.chapters.txt": "chapters"}},
+		{policy: OverwriteFail, placed: "Book.m4b", content: map[string]string{"Book.m4b": "new", "Book.chapters.txt": "chapters"}},
+		{policy: OverwriteReplace, existing: true, placed: "Book.m4b", content: map[string]string{"Book.m4b": "new", "Book.chapters.txt": "chapters"}},
+		{policy: OverwriteSkip, existing: true, placed: "", content: map[string]string{"Book.m4b": "old"}},
+		{policy: OverwriteRename, existing: true, placed: "Book (1).m4b",
+			content: map[string]string{"Book.m4b": "old", "Book (1).m4b": "new", "Book (1).chapters.txt": "chapters"}},
+		{policy: OverwriteFail, existing: true, content: map[string]string{"Book.m4b": "old"}, err: true},
+	}
+
+	for _, test := range tests {
+		name := string(test.policy)
+		if test.existing {
+			name += " existing"
+		}
+		t.Run(name, func(t *testing.T) {
+
+			dir := t.TempDir()
+			if test.existing {
+				os.WriteFile(path.Join(dir, "Book.m4b"), []byte("old"), 0644)
+			}
+			staging, err := NewStaging(dir, test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(staging.Path("Book.m4b"), []byte("new"), 0644)
+			os.WriteFile(staging.Path("Book.chapters.txt"), []byte("chapters"), 0644)
+
+			placed, err := staging.Place("Book.m4b", "Book.chapters.txt")
+			if (err != nil) != test.err {
+				t.Fatalf("error = %v, want error %v", err, test.err)
+			}
+			if placed != test.placed {
+				t.Errorf("placed = %q, want %q", placed, test.placed)
+			}
+			if err := staging.Remove(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readDir(t, dir); len(got) != len(test.content) {
+				t.Errorf("output directory = %v, want %v", got, test.content)
+			}
+			for file, want := range test.content {
+				if got, _ := os.ReadFile(path.Join(dir, file)); string(got) != want {
+					t.Errorf("%s = %q, want %q", file, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanStaging(t *testing.T) {
+
+	dir := t.TempDir()
+	os.Mkdir(path.Join(dir, stagingPrefix+"123"), 0755)
+	os.WriteFile(path.Join(dir, stagingPrefix+"123", "Book.m4b"), nil, 0644)
+	os.WriteFile(path.Join(dir, ManifestName+".tmp"), nil, 0644)
+	os.WriteFile(path.Join(dir, "ffmetadata.txt"), nil, 0644)
+	os.WriteFile(path.Join(dir, ManifestName), nil, 0644)
+	os.WriteFile(path.Join(dir, "Book.m4b"), nil, 0644)
+
+	if err := CleanStaging(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readDir(t, dir), []string{ManifestName, "Book.m4b"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("output directory = %v, want %v", got, want)
+	}
+}
+
+func TestStagingKeptAfterFailedCheck(t *testing.T) {
+
+	dir := t.TempDir()
+	staging, err := NewStaging(dir, OverwriteReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that does not exist fails the check
+	if err := staging.Check(context.Background(), "Book.m4b", OutputFormat{}, 1000, nil, VerifyOptions{ToleranceMs: 1000}); err == nil {
+		t.Fatal("expected the check to fail")
+	}
+	if err := staging.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(staging.Dir); err != nil {
+		t.Errorf("staging directory was removed after a failed check: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+// This file is responsible for cleaning up the chapter titles, and formatting them with a template.
+
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	timestampRegex  = regexp.MustCompile(`\s*[\(\[]\d{1,2}:\d{2}(:\d{2})?[\)\]]\s*$`)
+	separatorRegex  = regexp.MustCompile(`^(.+?)\s*[:\-–—.]\s+(.+)$`)
+	numberWordRegex = regexp.MustCompile(`(?i)^(chapter|part|book|section|track|volume)\s+([a-z\- ]+?)(\s*[:.–—]\s*.*|\s+-\s+.*)?$`)
+)
+
+// TitleCleaners are the built in cleaners that can be applied to the chapter titles, in the order they run.
+var TitleCleaners = []string{"timestamp", "dedupe", "numbers", "titlecase"}
+
+// smallWords are not capitalized by the titlecase cleaner, unless they start the title.
+var smallWords = map[string]bool{
+	"a": true, "an": true, "and": true, "as": true, "at": true, "but": true, "by": true, "for": true, "in": true,
+	"nor": true, "of": true, "on": true, "or": true, "the": true, "to": true, "with": true,
+}
+
+// numberWords maps the words for numbers to their values.
+var numberWords = map[string]int{
+	"zero": 0, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6, "seven": 7, "eight": 8, "nine": 9,
+	"ten": 10, "eleven": 11, "twelve": 12, "thirteen": 13, "fourteen": 14, "fifteen": 15, "sixteen": 16,
+	"seventeen": 17, "eighteen": 18, "nineteen": 19, "twenty": 20, "thirty": 30, "forty": 40, "fifty": 50,
+	"sixty": 60, "seventy": 70, "eighty": 80, "ninety": 90,
+}
+
+// TitleRewrite is a user rule that replaces a regular expression in the chapter titles.
+type TitleRewrite struct {
+	Pattern *regexp.Regexp
+	Replace string // May reference the groups of the pattern, e.g. "$1"
+}
+
+// TitleOptions describes how the chapter titles are cleaned up and formatted.
+type TitleOptions struct {
+	Cleaners []string       // Built in cleaners, see TitleCleaners
+	Rewrites []TitleRewrite // Applied in order after the cleaners
+	Template string         // Formats the final title, empty keeps the cleaned title
+}
+
+// TitleData contains the fields available to a chapter title template.
+type TitleData struct {
+	Index    int    // Position of the chapter, starting at 1
+	Total    int    // Number of chapters
+	Title    string // Title after the cleaners and rewrites
+	Original string // Title before any changes
+	Book     string
+	Author   string
+}
+
+// ParseTitleRewrite parses a rewrite rule formatted as "pattern=>replacement", e.g. "^Ch\.? (\d+)$=>Chapter $1".
+func ParseTitleRewrite(rule string) (TitleRewrite, error) {
+
+	var rewrite TitleRewrite
+
+	parts := strings.SplitN(rule, "=>", 2)
+	if len(parts) != 2 {
+		return rewrite, fmt.Errorf("invalid title rewrite '%s', expected pattern=>replacement", rule)
+	}
+
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return rewrite, fmt.Errorf("invalid title rewrite pattern '%s': %w", parts[0], err)
+	}
+
+	rewrite.Pattern = pattern
+	rewrite.Replace = parts[1]
+	return rewrite, nil
+}
+
+// Validate checks that the cleaners are known, and that the template can be parsed.
+func (o TitleOptions) Validate() error {
+
+	for _, cleaner := range o.Cleaners {
+		if !containsString(TitleCleaners, cleaner) {
+			return fmt.Errorf("invalid title cleaner '%s' (valid: %s)", cleaner, strings.Join(TitleCleaners, ", "))
+		}
+	}
+
+	if o.Template != "" {
+		if _, err := titleTemplate(o.Template); err != nil {
+			return fmt.Errorf("invalid title template '%s': %w", o.Template, err)
+		}
+	}
+
+	return nil
+}
+
+// IsEnabled checks if the options change the titles at all.
+func (o TitleOptions) IsEnabled() bool {
+	return len(o.Cleaners) > 0 || len(o.Rewrites) > 0 || o.Template != ""
+}
+
+// Apply cleans up and formats the titles of the chapters. The cleaners always run in the order of
+// TitleCleaners, then the rewrites run in order, and finally the template formats the title.
+func (o TitleOptions) Apply(chapters []Chapter, meta Metadata) ([]Chapter, error) {
+
+	// Copies the chapters so the originals are not changed
+	result := make([]Chapter, len(chapters))
+	copy(result, chapters)
+
+	var tmpl *template.Template
+	if o.Template != "" {
+		var err error
+		tmpl, err = titleTemplate(o.Template)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing title template: %w", err)
+		}
+	}
+
+	for i := range result {
+
+		title := result[i].Title
+
+		// Runs the built in cleaners
+		for _, cleaner := range TitleCleaners {
+			if !containsString(o.Cleaners, cleaner) {
+				continue
+			}
+			switch cleaner {
+			case "timestamp":
+				title = timestampRegex.ReplaceAllString(title, "")
+			case "dedupe":
+				title = dedupeTitle(title)
+			case "numbers":
+				title = numberWordsToDigits(title)
+			case "titlecase":
+				title = titleCase(title)
+			}
+		}
+
+		// Runs the user rewrites
+		for _, rewrite := range o.Rewrites {
+			title = rewrite.Pattern.ReplaceAllString(title, rewrite.Replace)
+		}
+
+		// Formats the title
+		if tmpl != nil {
+			data := TitleData{
+				Index:    i + 1,
+				Total:    len(result),
+				Title:    title,
+				Original: chapters[i].Title,
+				Book:     meta.Title,
+				Author:   meta.Author,
+			}
+			var sb strings.Builder
+			if err := tmpl.Execute(&sb, data); err != nil {
+				return nil, fmt.Errorf("error rendering title template: %w", err)
+			}
+			title = sb.String()
+		}
+
+		result[i].Title = strings.TrimSpace(title)
+	}
+
+	return result, nil
+}
+
+// titleTemplate parses a chapter title template, along with the functions available to it.
+func titleTemplate(text string) (*template.Template, error) {
+
+	funcs := template.FuncMap{
+		// Pads a number with zeros, e.g. {{.Index | pad 3}}
+		"pad": func(width, value int) string {
+			return fmt.Sprintf("%0*d", width, value)
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"trim":  strings.TrimSpace,
+	}
+
+	return template.New("title").Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+// dedupeTitle removes a prefix that is repeated by the rest of the title,
+// e.g. "Chapter 1: Chapter 1" becomes "Chapter 1" and "1. Chapter 1" stays as it is.
+func dedupeTitle(title string) string {
+
+	match := separatorRegex.FindStringSubmatch(title)
+	if match == nil {
+		return title
+	}
+
+	// The prefix has to be followed by the end of a word, so "1. 10 Things" is not changed
+	prefix, rest := match[1], match[2]
+	if end, ok := foldPrefix(rest, prefix); ok {
+		after := []rune(rest[end:])
+		if len(after) == 0 || !unicode.IsLetter(after[0]) && !unicode.IsDigit(after[0]) {
+			return rest
+		}
+	}
+
+	return title
+}
+
+// foldPrefix checks if the text starts with the prefix, ignoring case, and returns the byte offset in the text
+// where the prefix ends. The runes are compared one by one, as changing the case can change their length in bytes.
+func foldPrefix(text, prefix string) (int, bool) {
+
+	end := 0
+	for _, want := range prefix {
+		got, size := utf8.DecodeRuneInString(text[end:])
+		if size == 0 || !strings.EqualFold(string(got), string(want)) {
+			return 0, false
+		}
+		end += size
+	}
+
+	return end, true
+}
+
+// numberWordsToDigits converts a number written in words after a word like "Chapter" to digits,
+// e.g. "Chapter Twenty-One" becomes "Chapter 21". Other words are left alone, so "One Last Thing" is unchanged.
+func numberWordsToDigits(title string) string {
+
+	match := numberWordRegex.FindStringSubmatch(title)
+	if match == nil {
+		return title
+	}
+
+	number, ok := parseNumberWords(match[2])
+	if !ok {
+		return title
+	}
+
+	return match[1] + " " + strconv.Itoa(number) + match[3]
+}
+
+// parseNumberWords converts a number written in words up to 999, e.g. "one hundred and twenty-three".
+func parseNumberWords(text string) (int, bool) {
+
+	words := strings.Fields(strings.ToLower(strings.ReplaceAll(text, "-", " ")))
+	if len(words) == 0 {
+		return 0, false
+	}
+
+	total := 0
+	for _, word := range words {
+		if word == "and" {
+			continue
+		}
+		if word == "hundred" && total > 0 && total < 10 {
+			total *= 100
+			continue
+		}
+		value, ok := numberWords[word]
+		if !ok {
+			return 0, false
+		}
+		total += value
+	}
+
+	return total, true
+}
+
+// titleCase capitalizes the first letter of each word, except for small words in the middle of the title.
+// Words that already contain capitals, like "McDonald" or "USA", are left alone.
+func titleCase(title string) string {
+
+	words := strings.Fields(title)
+	for i, word := range words {
+		if strings.ToLower(word) != word {
+			continue
+		}
+		if i > 0 && i < len(words)-1 && smallWords[word] {
+			continue
+		}
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// containsString checks if the slice contains the value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
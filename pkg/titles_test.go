@@ -0,0 +1,49 @@
+package pkg
+
+import "testing"
+
+func TestDedupeTitle(t *testing.T) {
+
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Chapter 1: Chapter 1", "Chapter 1"},
+		{"Chapter 1 - chapter 1", "chapter 1"},
+		{"1. Chapter 1", "1. Chapter 1"},
+		{"1. 10 Things", "1. 10 Things"},
+		{"Prologue", "Prologue"},
+		{"Kapitel 1: Kapitel 1", "Kapitel 1"},
+		{"Époque - époque", "époque"},
+		{"Στάση - στάση", "στάση"},
+		{"KKK - kkk", "kkk"},
+		{"kkk - KKK", "KKK"},
+		{"KKK - kkkx", "KKK - kkkx"},
+		{"ß - ss", "ß - ss"},
+	}
+
+	for _, test := range tests {
+		if got := dedupeTitle(test.title); got != test.want {
+			t.Errorf("dedupeTitle(%q) = %q, want %q", test.title, got, test.want)
+		}
+	}
+}
+
+func TestNumberWordsToDigits(t *testing.T) {
+
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Chapter Twenty-One", "Chapter 21"},
+		{"Chapter One Hundred and Five", "Chapter 105"},
+		{"One Last Thing", "One Last Thing"},
+		{"Chapter 3", "Chapter 3"},
+	}
+
+	for _, test := range tests {
+		if got := numberWordsToDigits(test.title); got != test.want {
+			t.Errorf("numberWordsToDigits(%q) = %q, want %q", test.title, got, test.want)
+		}
+	}
+}
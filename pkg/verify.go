@@ -0,0 +1,205 @@
+// This file is responsible for checking the outputs of a book against the chapters they were made from.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// VerifyReport is the result of checking the outputs of a book, it is written as JSON.
+type VerifyReport struct {
+	OK        bool           `json:"ok"`
+	ASIN      string         `json:"asin,omitempty"`
+	Title     string         `json:"title"`
+	RuntimeMs int            `json:"runtimeMs"`
+	Outputs   []OutputReport `json:"outputs"`
+}
+
+// OutputReport is the result of checking one of the outputs of a book.
+type OutputReport struct {
+	Output   string       `json:"output"`
+	Dir      string       `json:"dir"`
+	OK       bool         `json:"ok"`
+	TotalMs  int          `json:"totalMs"`
+	Files    []FileReport `json:"files"`
+	Problems []string     `json:"problems,omitempty"`
+}
+
+// FileReport is the result of checking one of the files of an output.
+type FileReport struct {
+	Path       string   `json:"path"`
+	Exists     bool     `json:"exists"`
+	ExpectedMs int      `json:"expectedMs"`
+	ActualMs   int      `json:"actualMs"`
+	Chapters   int      `json:"chapters,omitempty"` // Number of chapter markers, only checked for single files
+	Problems   []string `json:"problems,omitempty"`
+}
+
+// VerifyOptions are the tolerances used when the outputs are checked.
+type VerifyOptions struct {
+	ToleranceMs        int // Largest difference between a file or chapter marker and the chapter it was made from
+	RuntimeToleranceMs int // Largest difference between the length of an output and the runtime of the book
+}
+
+// VerifyOutput checks that the files of the output exist, are as long as the chapters they were made from, and
+// (for single files) have a chapter marker for each of the chapters. If the runtime of the book is known, it is
+// checked against the length of the whole output. Files the manifest (if there is one) records under another name
+// are checked under that name.
+func VerifyOutput(ctx context.Context, target OutputTarget, meta Metadata, asin, outputDir string, runtimeMs int, manifest *Manifest, opts VerifyOptions) OutputReport {
+
+	report := OutputReport{Output: target.ToString(), Dir: outputDir}
+
+	if target.Single {
+		expected := 0
+		if len(meta.Chapters) > 0 {
+			last := meta.Chapters[len(meta.Chapters)-1]
+			expected = last.StartOffsetMs + last.LengthMs
+		}
+
+		single := manifest.WrittenPath(report.Output, target.GetSingleFilePath(meta, asin, outputDir))
+		file := verifyFile(ctx, single, expected, opts)
+		if file.Exists {
+			markers, err := readChapterMarkers(ctx, file.Path, target.Format, file.ActualMs)
+			if err != nil {
+				file.Problems = append(file.Problems, "unable to read the chapter markers: "+err.Error())
+			} else {
+				file.Chapters = len(markers)
+				file.Problems = append(file.Problems, compareChapters(markers, meta.Chapters, target.Format, opts.ToleranceMs)...)
+			}
+		}
+		report.Files = append(report.Files, file)
+	} else {
+		for i, chapter := range meta.Chapters {
+			output := manifest.WrittenPath(report.Output, path.Join(outputDir, SplitFileName(i+1, chapter.Title, target.Format.Extension)))
+			report.Files = append(report.Files, verifyFile(ctx, output, chapter.LengthMs, opts))
+		}
+	}
+
+	// Checks the whole output is as long as the book
+	report.OK = true
+	missing := 0
+	for _, file := range report.Files {
+		report.TotalMs += file.ActualMs
+		if !file.Exists {
+			missing++
+		}
+		if len(file.Problems) > 0 {
+			report.OK = false
+		}
+	}
+	if missing > 0 {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d of %d files are missing", missing, len(report.Files)))
+	} else if runtimeMs > 0 && int(math.Abs(float64(report.TotalMs-runtimeMs))) > opts.RuntimeToleranceMs {
+		report.Problems = append(report.Problems, fmt.Sprintf("the output is %s long, but the book is %s",
+			CalculateDuration(report.TotalMs).ToString(), CalculateDuration(runtimeMs).ToString()))
+	}
+	if len(report.Problems) > 0 {
+		report.OK = false
+	}
+
+	return report
+}
+
+// verifyFile checks that the file exists, and is as long as expected.
+func verifyFile(ctx context.Context, file string, expectedMs int, opts VerifyOptions) FileReport {
+
+	report := FileReport{Path: file, ExpectedMs: expectedMs}
+
+	if _, err := os.Stat(file); err != nil {
+		report.Problems = append(report.Problems, "the file is missing")
+		return report
+	}
+	report.Exists = true
+
+	durationMs, err := GetFileDurationMS(ctx, file)
+	if err != nil {
+		report.Problems = append(report.Problems, "unable to read the duration: "+err.Error())
+		return report
+	}
+	report.ActualMs = durationMs
+
+	if int(math.Abs(float64(durationMs-expectedMs))) > opts.ToleranceMs {
+		report.Problems = append(report.Problems, fmt.Sprintf("the file is %s long, expected %s",
+			CalculateDuration(durationMs).ToString(), CalculateDuration(expectedMs).ToString()))
+	}
+
+	return report
+}
+
+// readChapterMarkers reads the chapter markers of a single file. MP4 and MP3 files are read natively, the chapters
+// of formats that can't hold them are read from their chapter file, and any other format is probed with ffprobe.
+func readChapterMarkers(ctx context.Context, file string, format OutputFormat, durationMs int) ([]Chapter, error) {
+
+	switch {
+	case format.Muxer == "ipod":
+		f, err := ReadMP4(file)
+		if err != nil {
+			return nil, err
+		}
+		return f.Chapters(), nil
+
+	case format.Muxer == "mp3":
+		tag, err := ReadID3v2(file)
+		if err != nil {
+			return nil, err
+		}
+		return tag.Chapters(), nil
+
+	case format.ChapterSidecar:
+		return ImportChapters(strings.TrimSuffix(file, path.Ext(file))+".chapters.txt", durationMs)
+	}
+
+	result, err := ProbeFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	var chapters []Chapter
+	for _, item := range result.Chapters {
+		start := secondsToMs(item.StartTime)
+		chapters = append(chapters, Chapter{
+			LengthMs:       secondsToMs(item.EndTime) - start,
+			StartOffsetMs:  start,
+			StartOffsetSec: start / 1000,
+			Title:          firstTag(lowerKeys(item.Tags), "title"),
+		})
+	}
+	return chapters, nil
+}
+
+// compareChapters compares the chapter markers of a file with the chapters it was made from, and returns the
+// differences. The start of each chapter has to be within the tolerance, and the titles have to match.
+func compareChapters(markers, chapters []Chapter, format OutputFormat, toleranceMs int) []string {
+
+	// MP4 chapters are read from the chapter track, files with only Nero chapters hold at most 255 of them with
+	// titles of at most 255 bytes
+	if format.Muxer == "ipod" && len(markers) == 255 && len(chapters) > 255 {
+		chapters = chapters[:255]
+	}
+
+	var problems []string
+	if len(markers) != len(chapters) {
+		problems = append(problems, fmt.Sprintf("the file has %d chapters, expected %d", len(markers), len(chapters)))
+	}
+
+	for i := 0; i < min(len(markers), len(chapters)); i++ {
+		if int(math.Abs(float64(markers[i].StartOffsetMs-chapters[i].StartOffsetMs))) > toleranceMs {
+			problems = append(problems, fmt.Sprintf("chapter %d starts at %s, expected %s", i+1,
+				CalculateDuration(markers[i].StartOffsetMs).ToString(), CalculateDuration(chapters[i].StartOffsetMs).ToString()))
+		}
+		title, expected := strings.TrimSpace(markers[i].Title), strings.TrimSpace(chapters[i].Title)
+		if format.ChapterSidecar {
+			// The chapter file holds each title on one line
+			expected = oneLine(expected)
+		}
+		if title != expected && (format.Muxer != "ipod" || title != strings.TrimSpace(truncateUTF8(chapters[i].Title, 255))) {
+			problems = append(problems, fmt.Sprintf("chapter %d is titled '%s', expected '%s'", i+1, markers[i].Title, chapters[i].Title))
+		}
+	}
+
+	return problems
+}
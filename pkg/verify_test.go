@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCompareChapters(t *testing.T) {
+
+	mp4 := OutputFormat{Muxer: "ipod"}
+	mp3 := OutputFormat{Muxer: "mp3"}
+	long := testChapters(2, 600)
+	truncated := testChapters(2, 600)
+	for i := range truncated {
+		truncated[i].Title = truncateUTF8(truncated[i].Title, 255)
+	}
+	shifted := testChapters(2, 10)
+	shifted[1].StartOffsetMs += 1500
+
+	tests := []struct {
+		name     string
+		markers  []Chapter
+		chapters []Chapter
+		format   OutputFormat
+		problems int
+	}{
+		{"same chapters", testChapters(3, 10), testChapters(3, 10), mp4, 0},
+		{"chapter track with long titles", long, long, mp4, 0},
+		{"Nero chapters with truncated titles", truncated, long, mp4, 0},
+		{"truncated titles in mp3", truncated, long, mp3, 2},
+		{"only the Nero chapters", testChapters(255, 10), testChapters(300, 10), mp4, 0},
+		{"missing chapters", testChapters(254, 10), testChapters(300, 10), mp4, 1},
+		{"start outside the tolerance", shifted, testChapters(2, 10), mp3, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := compareChapters(test.markers, test.chapters, test.format, 1000)
+			if len(problems) != test.problems {
+				t.Errorf("problems = %s, want %d", strings.Join(problems, "; "), test.problems)
+			}
+		})
+	}
+}
+
+func TestVerifyOutputRenamedFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	target := OutputTarget{Format: OutputFormats["mp3"]}
+	chapters := []Chapter{
+		{Title: "One", StartOffsetMs: 0, LengthMs: 1044},
+		{Title: "Two", StartOffsetMs: 1044, StartOffsetSec: 1, LengthMs: 1044},
+	}
+	meta := Metadata{Title: "Book", Chapters: chapters}
+
+	// The second file was written with a numbered suffix, as another file had its name
+	writeTestMP3(t, dir, SplitFileName(1, "One", "mp3"), testMP3{frames: 40})
+	writeTestMP3(t, dir, "[2]. Two (1).mp3", testMP3{frames: 40})
+	manifest := &Manifest{Outputs: []*ManifestOutput{{Output: target.ToString(), Files: []ManifestFile{
+		{Path: SplitFileName(1, "One", "mp3"), Complete: true},
+		{Path: SplitFileName(2, "Two", "mp3"), Written: "[2]. Two (1).mp3", Complete: true},
+	}}}}
+
+	opts := VerifyOptions{ToleranceMs: 100}
+	if report := VerifyOutput(context.Background(), target, meta, "", dir, 0, manifest, opts); !report.OK {
+		t.Errorf("problems = %v %v, want the renamed file to be found", report.Problems, report.Files)
+	}
+	if report := VerifyOutput(context.Background(), target, meta, "", dir, 0, nil, opts); report.OK {
+		t.Error("the renamed file was found without the manifest")
+	}
+}
@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -22,7 +23,7 @@ type Product struct {
 }
 
 // GetBook queries the Audible API to retrieve a book's ASIN based on its title, author, and narrator.
-func GetBook(title, author, narrator string, duration int) (string, error) {
+func GetBook(ctx context.Context, title, author, narrator string, duration int) (string, error) {
 
 	// Lookup the book by title, author, narrator & duration
 	fmt.Println("Looking up Book ASIN...")
@@ -46,7 +47,7 @@ func GetBook(title, author, narrator string, duration int) (string, error) {
 	requestURL := fmt.Sprintf("https://api.audible.com/1.0/catalog/products?%s", queryString)
 
 	// Send HTTP GET request
-	response, err := http.Get(requestURL)
+	response, err := get(ctx, requestURL)
 	if err != nil {
 		return asin, fmt.Errorf("error making request: %w", err)
 	}
@@ -67,7 +68,7 @@ func GetBook(title, author, narrator string, duration int) (string, error) {
 		// Goes through each, performing an Audnexus API call for each to match the duration
 		m := make(map[string]int)
 		for _, item := range rsp.Products {
-			details, err := GetBookDetailsASIN(item.ASIN)
+			details, err := GetBookDetailsASIN(ctx, item.ASIN)
 			if err != nil {
 				return asin, fmt.Errorf("error getting book details: %w", err)
 			}
@@ -106,13 +107,13 @@ func GetBook(title, author, narrator string, duration int) (string, error) {
 }
 
 // GetBookDetailsASIN retrieves the details of a book with the given ASIN.
-func GetBookDetailsASIN(asin string) (meta.BookDetails, error) {
+func GetBookDetailsASIN(ctx context.Context, asin string) (meta.BookDetails, error) {
 
 	// Construct the request URL
 	requestURL := fmt.Sprintf("https://api.audnex.us/books/%s", asin)
 
 	// Send an HTTP GET request to the API
-	response, err := http.Get(requestURL)
+	response, err := get(ctx, requestURL)
 	if err != nil {
 		return meta.BookDetails{}, fmt.Errorf("error making request: %w", err)
 	}
@@ -130,34 +131,54 @@ func GetBookDetailsASIN(asin string) (meta.BookDetails, error) {
 // GetChapters retrieves the chapters for a given ASIN.
 // It makes an HTTP GET request to the audnex API and decodes the response into a Chapters struct.
 // The ASIN is used to construct the request URL.
-func GetAudibleChapters(asin string) ([]meta.Chapter, error) {
+func GetAudibleChapters(ctx context.Context, asin string) ([]meta.Chapter, error) {
 
-	// Generates the chapters
-	var chapters []meta.Chapter
+	// Gets the full chapter information
+	info, err := GetAudibleChapterInfo(ctx, asin)
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the chapters
+	return info.Chapters, nil
+}
+
+// GetAudibleChapterInfo retrieves the chapters for a given ASIN, along with the runtime, brand intro
+// and outro durations, and accuracy flag needed to align them to the local audio.
+func GetAudibleChapterInfo(ctx context.Context, asin string) (meta.Chapters, error) {
+
+	// Generates the chapter information
+	var info meta.Chapters
 
 	// Check if the ASIN is empty
 	if asin == "" {
-		return chapters, nil
+		return info, nil
 	}
 
 	// Construct the request URL
 	requestURL := fmt.Sprintf("https://api.audnex.us/books/%s/chapters", asin)
 
 	// Send an HTTP GET request to the API
-	response, err := http.Get(requestURL)
+	response, err := get(ctx, requestURL)
 	if err != nil {
-		return chapters, fmt.Errorf("error making request: %w", err)
+		return info, fmt.Errorf("error making request: %w", err)
 	}
 	defer response.Body.Close()
 
 	// Decode the JSON response into a Chapters struct
-	var rsp meta.Chapters
-	if err := json.NewDecoder(response.Body).Decode(&rsp); err != nil {
-		return chapters, fmt.Errorf("error decoding response: %w", err)
+	if err := json.NewDecoder(response.Body).Decode(&info); err != nil {
+		return info, fmt.Errorf("error decoding response: %w", err)
 	}
 
-	chapters = rsp.Chapters
+	// Return the chapter information
+	return info, nil
+}
 
-	// Return the chapters
-	return chapters, nil
+// get sends an HTTP GET request, which is cancelled with the context.
+func get(ctx context.Context, requestURL string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(request)
 }
@@ -0,0 +1,243 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	meta "Z0y6h0kS9X/libby-chapterizer/pkg"
+)
+
+// creatorSplitRegex splits a tag that lists several people, e.g. "Author & Narrator" or "Author/Narrator".
+var creatorSplitRegex = regexp.MustCompile(`\s*(?:[,;/&]|\sand\s)\s*`)
+
+// yearRegex finds the year in a recording date, e.g. "2021-03-04".
+var yearRegex = regexp.MustCompile(`\d{4}`)
+
+// ID3Tags are the values of the ID3v2 tags in the parts of a Libby download.
+type ID3Tags struct {
+	Title       string // TIT2, usually the title of the part
+	Album       string // TALB, the title of the book
+	Artist      string // TPE1
+	AlbumArtist string // TPE2
+	Composer    string // TCOM
+	Publisher   string // TPUB
+	Year        string // TDRC or TYER
+	Comment     string // COMM
+	Cover       []byte // APIC, the front cover if there is one
+	CoverType   string
+}
+
+// ReadID3Tags reads the ID3v2 tags of the file.
+func ReadID3Tags(filepath string) (ID3Tags, error) {
+
+	var tags ID3Tags
+
+	tag, err := meta.ReadID3v2(filepath)
+	if err != nil {
+		return tags, err
+	}
+
+	for _, frame := range tag.Frames {
+		switch frame.ID {
+		case "TIT2":
+			tags.Title = frame.Text()
+		case "TALB":
+			tags.Album = frame.Text()
+		case "TPE1":
+			tags.Artist = frame.Text()
+		case "TPE2":
+			tags.AlbumArtist = frame.Text()
+		case "TCOM":
+			tags.Composer = frame.Text()
+		case "TPUB":
+			tags.Publisher = frame.Text()
+		case "TDRC", "TYER":
+			// Only the year of the recording date is kept
+			if year := yearRegex.FindString(frame.Text()); year != "" {
+				tags.Year = year
+			}
+		case "COMM":
+			if tags.Comment == "" {
+				tags.Comment = decodeID3Comment(frame.Data)
+			}
+		case "APIC":
+			// The front cover replaces any other picture
+			mime, kind, data, ok := decodeID3Picture(frame.Data)
+			if ok && (tags.Cover == nil || kind == 3) {
+				tags.Cover, tags.CoverType = data, mime
+			}
+		}
+	}
+
+	return tags, nil
+}
+
+// ReadPartTags reads the ID3v2 tags of each of the parts. Libby tags every part the same way (except the title),
+// so the first value found for each tag is used.
+func ReadPartTags(files []string) (ID3Tags, error) {
+
+	var tags ID3Tags
+	for _, file := range files {
+		part, err := ReadID3Tags(file)
+		if err != nil {
+			return tags, fmt.Errorf("error reading tags of %s: %w", file, err)
+		}
+
+		fill(&tags.Title, part.Title)
+		fill(&tags.Album, part.Album)
+		fill(&tags.Artist, part.Artist)
+		fill(&tags.AlbumArtist, part.AlbumArtist)
+		fill(&tags.Composer, part.Composer)
+		fill(&tags.Publisher, part.Publisher)
+		fill(&tags.Year, part.Year)
+		fill(&tags.Comment, part.Comment)
+		if tags.Cover == nil {
+			tags.Cover, tags.CoverType = part.Cover, part.CoverType
+		}
+	}
+
+	return tags, nil
+}
+
+// FillMetadata fills the gaps in the metadata with the values of the tags. Values that are already set are kept.
+func FillMetadata(metadata *meta.Metadata, tags ID3Tags) {
+
+	// The album is the title of the book, the title is the title of the part
+	fill(&metadata.Title, tags.Album)
+	fill(&metadata.Author, firstCreator(tags.AlbumArtist))
+	fill(&metadata.Author, firstCreator(tags.Artist))
+	fill(&metadata.Narrator, firstCreator(tags.Composer))
+	fill(&metadata.Publisher, tags.Publisher)
+	fill(&metadata.Year, tags.Year)
+	fill(&metadata.Summary, tags.Comment)
+
+	if metadata.Cover == nil && tags.Cover != nil {
+		metadata.Cover, metadata.CoverType = tags.Cover, tags.CoverType
+	}
+}
+
+// CheckCreators compares the people in the artist tags to the creators of the openbook, and returns a warning
+// for each one that is not in it, as that can mean the parts are from a different book.
+func CheckCreators(book meta.Openbook, tags ID3Tags) []string {
+
+	if len(book.Creator) == 0 {
+		return nil
+	}
+
+	var warnings []string
+	seen := map[string]bool{}
+	for _, value := range []string{tags.Artist, tags.AlbumArtist, tags.Composer} {
+		for _, name := range splitCreators(value) {
+			if seen[strings.ToLower(name)] {
+				continue
+			}
+			seen[strings.ToLower(name)] = true
+
+			found := false
+			for _, creator := range book.Creator {
+				if strings.EqualFold(normalizeSpaces(creator.Name), name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				warnings = append(warnings, fmt.Sprintf("'%s' from the ID3 tags is not a creator in the openbook", name))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// decodeID3Comment decodes a COMM frame, which has a language and a description before the text.
+func decodeID3Comment(data []byte) string {
+
+	if len(data) < 4 {
+		return ""
+	}
+
+	text := skipID3Terminated(data[0], data[4:])
+	return strings.TrimSpace(meta.DecodeID3String(data[0], text))
+}
+
+// decodeID3Picture decodes an APIC frame, and returns the MIME type, the picture type and the image.
+func decodeID3Picture(data []byte) (string, byte, []byte, bool) {
+
+	if len(data) < 2 {
+		return "", 0, nil, false
+	}
+	encoding := data[0]
+
+	// The MIME type is always Latin-1
+	end := bytes.IndexByte(data[1:], 0)
+	if end == -1 || 1+end+2 > len(data) {
+		return "", 0, nil, false
+	}
+	mime := string(data[1 : 1+end])
+	if mime == "" || !strings.Contains(mime, "/") {
+		mime = "image/" + strings.ToLower(strings.TrimPrefix(mime, "image/"))
+	}
+	if mime == "image/" || mime == "image/jpg" {
+		mime = "image/jpeg"
+	}
+
+	kind := data[1+end+1]
+	image := skipID3Terminated(encoding, data[1+end+2:])
+	if len(image) == 0 {
+		return "", 0, nil, false
+	}
+
+	return mime, kind, image, true
+}
+
+// skipID3Terminated skips the first string of the data, up to its terminator, which is two bytes for UTF-16.
+func skipID3Terminated(encoding byte, data []byte) []byte {
+
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return data[i+2:]
+			}
+		}
+		return nil
+	}
+
+	if i := bytes.IndexByte(data, 0); i != -1 {
+		return data[i+1:]
+	}
+	return nil
+}
+
+// splitCreators splits a tag that lists several people into their names.
+func splitCreators(value string) []string {
+	var names []string
+	for _, name := range creatorSplitRegex.Split(value, -1) {
+		if name = normalizeSpaces(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// firstCreator returns the first person in a tag that lists several people.
+func firstCreator(value string) string {
+	names := splitCreators(value)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// normalizeSpaces trims the name and collapses its spaces, so names can be compared.
+func normalizeSpaces(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// fill sets the value if it is empty.
+func fill(value *string, fallback string) {
+	if *value == "" {
+		*value = fallback
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	p "Z0y6h0kS9X/libby-chapterizer/pkg"
+	prov "Z0y6h0kS9X/libby-chapterizer/provider"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var retagCmd = &cobra.Command{
+	Use:   "retag [directory]",
+	Short: "Updates the tags, chapter titles and file names of a book that was already converted",
+	Long: "Rewrites the tags, chapter titles and cover of the outputs of a book (" + strings.Join(p.RetagFormats, ", ") + "), renames " +
+		"the files and moves the book to its output directory, without touching the audio. The book is the directory given, " +
+		"or is found under --out by its ASIN with --find.",
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		retag(cmd.Context(), cmd, args)
+	},
+}
+
+var retagFind string
+var retagASIN string
+var retagTitle string
+var retagAuthor string
+var retagNarrator string
+var retagSeries string
+var retagPosition float64
+var retagYear string
+var retagCover string
+var retagNoMove bool
+var retagDryRun bool
+
+func init() {
+	retagCmd.Flags().StringVar(&retagFind, "find", "", "Finds the book under --out by the ASIN in its tags or directory name")
+	retagCmd.Flags().StringVar(&retagASIN, "asin", "", "Gets the metadata from Audible for this (corrected) ASIN")
+	retagCmd.Flags().StringVar(&retagTitle, "title", "", "Sets the title of the book")
+	retagCmd.Flags().StringVar(&retagAuthor, "author", "", "Sets the author of the book")
+	retagCmd.Flags().StringVar(&retagNarrator, "narrator", "", "Sets the narrator of the book")
+	retagCmd.Flags().StringVar(&retagSeries, "series", "", "Sets the series of the book")
+	retagCmd.Flags().Float64Var(&retagPosition, "series-position", 0, "Sets the position of the book in the series (0 for none)")
+	retagCmd.Flags().StringVar(&retagYear, "year", "", "Sets the year the book was released")
+	retagCmd.Flags().StringVar(&retagCover, "cover", "", "Sets the cover to a JPEG or PNG image")
+	retagCmd.Flags().BoolVar(&retagNoMove, "no-move", false, "Keeps the book in its directory instead of moving it to its output directory")
+	retagCmd.Flags().BoolVar(&retagDryRun, "dry-run", false, "Prints the changes without making them")
+	rootCmd.AddCommand(retagCmd)
+}
+
+// retag finds the outputs of the book, and rewrites their tags, chapter titles and file names with the corrected metadata.
+func retag(ctx context.Context, cmd *cobra.Command, args []string) {
+
+	titles, err := checkChapterFlags()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// Gets the directories of the book
+	var dirs []p.BookDir
+	switch {
+	case len(args) == 1:
+		dir, err := p.ReadBookDir(filepath.ToSlash(args[0]))
+		if err != nil {
+			fmt.Println("Error reading book:", err)
+			os.Exit(1)
+		}
+		if len(dir.Outputs) == 0 {
+			fmt.Println("Error: no outputs found in", dir.Path)
+			os.Exit(1)
+		}
+		dirs = append(dirs, dir)
+	case retagFind != "":
+		if outPath == "" {
+			fmt.Println("Error: --out is required to find a book")
+			os.Exit(1)
+		}
+		dirs, err = p.FindBookDirs(filepath.ToSlash(outPath), retagFind)
+		if err != nil {
+			fmt.Println("Error finding book:", err)
+			os.Exit(1)
+		}
+		if len(dirs) == 0 {
+			fmt.Println("Error: no outputs found for", retagFind)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("Error: the directory of the book (or --find) was not specified")
+		os.Exit(1)
+	}
+
+	for _, dir := range dirs {
+		if err := retagBook(ctx, cmd, dir, titles); err != nil {
+			fmt.Println("Error retagging "+dir.Path+":", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// retagBook retags each of the outputs in the directory, then moves the directory to the output directory of the corrected metadata.
+func retagBook(ctx context.Context, cmd *cobra.Command, dir p.BookDir, titles p.TitleOptions) error {
+
+	// Skips the outputs that can't be retagged, they are still moved with the directory
+	var outputs []p.BookOutput
+	for _, output := range dir.Outputs {
+		if containsFormat(p.RetagFormats, output.Format.Name) {
+			outputs = append(outputs, output)
+		} else {
+			fmt.Println("Warning: " + output.Format.Name + " outputs can not be retagged, " + path.Base(output.Files[0]) + " is left as it is")
+		}
+	}
+	if len(outputs) == 0 {
+		return fmt.Errorf("no outputs that can be retagged (valid: %s)", strings.Join(p.RetagFormats, ", "))
+	}
+	dir.Outputs = outputs
+
+	// Reads the current metadata from the first output
+	old, err := dir.Outputs[0].ReadMetadata()
+	if err != nil {
+		return err
+	}
+	if old.ASIN == "" {
+		old.ASIN = dir.ASIN
+	}
+
+	metadata, err := getRetagMetadata(ctx, cmd, old)
+	if err != nil {
+		return err
+	}
+
+	// Works out where the book is moved to, the output path is found from the directory if --out was not set
+	newDir := dir.Path
+	root, ok := outPath, outPath != ""
+	if !ok {
+		root, ok = p.OutputRoot(dir.Path, old)
+	}
+	if !retagNoMove && ok {
+		newDir, err = p.GetOutputDirPath(metadata, metadata.ASIN, filepath.ToSlash(root))
+		if err != nil {
+			return err
+		}
+	} else if !retagNoMove {
+		fmt.Println("Warning: " + dir.Path + " is not in the default layout, use --out to move it")
+	}
+
+	fmt.Println("==================== Retag Book =====================")
+	fmt.Println("Directory:", dir.Path)
+	printChange("Title", old.Title, metadata.Title)
+	printChange("Author", old.Author, metadata.Author)
+	printChange("Narrator", old.Narrator, metadata.Narrator)
+	printChange("Series", old.Series.Name, metadata.Series.Name)
+	printChange("Position", fmt.Sprint(old.Series.Position), fmt.Sprint(metadata.Series.Position))
+	printChange("Year", old.Year, metadata.Year)
+	printChange("ASIN", old.ASIN, metadata.ASIN)
+	printChange("Output Directory", dir.Path, newDir)
+	fmt.Println("=====================================================")
+
+	// Retags each of the outputs, with its own chapters
+	for i := range dir.Outputs {
+		output := &dir.Outputs[i]
+
+		current, err := output.ReadMetadata()
+		if err != nil {
+			return err
+		}
+		outputMeta := metadata
+		outputMeta.Chapters, err = retagChapterTitles(ctx, current.Chapters, metadata, titles)
+		if err != nil {
+			return err
+		}
+
+		// Prints the chapter titles and file names that change
+		for j, chapter := range current.Chapters {
+			if chapter.Title != outputMeta.Chapters[j].Title {
+				printChange(fmt.Sprintf("Chapter %d", j+1), chapter.Title, outputMeta.Chapters[j].Title)
+			}
+		}
+		for j, name := range output.FileNames(outputMeta) {
+			if name != output.Files[j] {
+				printChange("File", path.Base(output.Files[j]), path.Base(name))
+			}
+		}
+
+		if retagDryRun {
+			continue
+		}
+		if err := output.Retag(outputMeta); err != nil {
+			return err
+		}
+	}
+
+	if retagDryRun {
+		fmt.Println("Dry run, nothing was changed")
+		return nil
+	}
+
+	if err := dir.Move(newDir, root); err != nil {
+		return err
+	}
+	fmt.Println("Retagged", dir.Path)
+
+	return nil
+}
+
+// getRetagMetadata gets the corrected metadata, from Audible if --asin was set and from the current tags otherwise,
+// then applies the overrides.
+func getRetagMetadata(ctx context.Context, cmd *cobra.Command, old p.Metadata) (p.Metadata, error) {
+
+	metadata := old
+	metadata.Chapters = nil
+	if retagASIN != "" {
+		var err error
+		metadata, err = p.GetMetadataFromASIN(ctx, retagASIN)
+		if err != nil {
+			return metadata, fmt.Errorf("error getting metadata (ASIN): %w", err)
+		}
+		if metadata.Title == "" {
+			return metadata, fmt.Errorf("no book found for ASIN %s", retagASIN)
+		}
+		if metadata.ASIN == "" {
+			metadata.ASIN = retagASIN
+		}
+
+		// Audible does not list the narrator
+		if metadata.Narrator == "" {
+			metadata.Narrator = old.Narrator
+		}
+	}
+
+	if cmd.Flags().Changed("title") {
+		metadata.Title = retagTitle
+	}
+	if cmd.Flags().Changed("author") {
+		metadata.Author = retagAuthor
+	}
+	if cmd.Flags().Changed("narrator") {
+		metadata.Narrator = retagNarrator
+	}
+	if cmd.Flags().Changed("series") {
+		metadata.Series.Name = retagSeries
+	}
+	if cmd.Flags().Changed("series-position") {
+		metadata.Series.Position = retagPosition
+	}
+	if cmd.Flags().Changed("year") {
+		metadata.Year = retagYear
+	}
+
+	if retagCover != "" {
+		cover, err := os.ReadFile(retagCover)
+		if err != nil {
+			return metadata, fmt.Errorf("error reading cover: %w", err)
+		}
+		metadata.Cover, metadata.CoverType = cover, "image/jpeg"
+		if strings.EqualFold(path.Ext(retagCover), ".png") {
+			metadata.CoverType = "image/png"
+		}
+	}
+
+	return metadata, nil
+}
+
+// retagChapterTitles gets the new titles of the chapters, from the chapters file or Audible if they were requested,
+// then cleans them up. The timings of the chapters are never changed, as the audio is not.
+func retagChapterTitles(ctx context.Context, chapters []p.Chapter, metadata p.Metadata, titles p.TitleOptions) ([]p.Chapter, error) {
+
+	result := make([]p.Chapter, len(chapters))
+	copy(result, chapters)
+
+	totalMs := 0
+	if len(chapters) > 0 {
+		last := chapters[len(chapters)-1]
+		totalMs = last.StartOffsetMs + last.LengthMs
+	}
+
+	switch {
+	case chaptersFile != "":
+		// Only the titles are used, so the file must have a chapter for each of the chapters of the output
+		imported, err := p.ImportChapters(chaptersFile, totalMs)
+		if err != nil {
+			return nil, err
+		}
+		if !p.ApplyChapterTitles(result, imported) {
+			return nil, fmt.Errorf("the chapters file has %d chapters, but the output has %d", len(imported), len(result))
+		}
+
+	case hybridChapters || audibleChapters:
+		if metadata.ASIN == "" {
+			fmt.Println("Book does not have an ASIN, keeping the chapter titles")
+			break
+		}
+		info, err := prov.GetAudibleChapterInfo(ctx, metadata.ASIN)
+		if err != nil {
+			return nil, fmt.Errorf("error getting audible chapters: %w", err)
+		}
+		if len(info.Chapters) == 0 {
+			fmt.Println("No audible chapters found, keeping the chapter titles")
+			break
+		}
+
+		// Only the titles are used, so the chapters are still matched if they drift
+		aligned, _, err := p.AlignAudibleChapters(info, totalMs, int(audibleMaxDrift.Milliseconds()))
+		if aligned == nil {
+			return nil, err
+		}
+		var report []p.ChapterMatch
+		result, report = p.MergeChapters(result, aligned)
+		fmt.Print(p.FormatMatchReport(report))
+	}
+
+	if titles.IsEnabled() {
+		return titles.Apply(result, metadata)
+	}
+	return result, nil
+}
+
+// containsFormat checks if the format is in the list.
+func containsFormat(formats []string, format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// printChange prints a value, and what it is changed to if it is different.
+func printChange(name, old, value string) {
+	if old == value {
+		fmt.Println(name+":", old)
+		return
+	}
+	fmt.Println(name+":", old, "->", value)
+}
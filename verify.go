@@ -0,0 +1,138 @@
+package main
+
+import (
+	p "Z0y6h0kS9X/libby-chapterizer/pkg"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Checks the outputs of a book are complete",
+	Long: "Plans the outputs of a book the same way a conversion does, and checks every file exists, is as long as its chapter, " +
+		"and has the chapter markers it was made with (the chapters and file names recorded in the manifest of the output directory are used if there is one). The report is written as JSON, and the exit code is 2 if any check fails.",
+	Run: func(cmd *cobra.Command, args []string) {
+		verifyBook(cmd.Context())
+	},
+}
+
+var verifyTolerance time.Duration
+var verifyRuntimeTolerance time.Duration
+var verifyReport string
+
+func init() {
+	// The outputs are selected the same way as for a conversion
+	verifyCmd.Flags().BoolVarP(&single, "single", "s", false, "Indicates if the output is a single file, or separate files for each chapter")
+	verifyCmd.Flags().StringVarP(&format, "format", "f", "mp3", "What format the output is in (mp3|m4b|m4a|opus|flac|aac)")
+	verifyCmd.Flags().StringArrayVar(&outputs, "output", nil, "An output to check as format:layout[:template] (e.g. m4b:single), can be repeated and replaces --format/--single")
+	verifyCmd.Flags().DurationVar(&verifyTolerance, "tolerance", time.Second, "The largest difference between a file or chapter marker and its chapter")
+	verifyCmd.Flags().DurationVar(&verifyRuntimeTolerance, "runtime-tolerance", 5*time.Second, "The largest difference between the length of an output and the runtime of the book")
+	verifyCmd.Flags().StringVar(&verifyReport, "report", "", "Writes the report to a file instead of printing it")
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// verifyBook plans the outputs of the book, checks each of them, and writes the report.
+func verifyBook(ctx context.Context) {
+
+	// Progress messages are printed to stderr, so stdout only holds the report
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+
+	// Gets the directory of the openbook.json (which holds the mp3 files), or of the input file
+	inputDir := getInputDir()
+	if outPath == "" {
+		outPath = inputDir
+	}
+	outPath = filepath.ToSlash(outPath)
+
+	targets, err := getOutputTargets()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	titles, err := checkChapterFlags()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// Reads the book, and gets the chapters the outputs were made from
+	book, asin, metadata, files := loadBook(ctx, inputDir)
+	chapters, err := resolveChapters(ctx, book, files, metadata, titles)
+	if err != nil {
+		fmt.Println("Error getting chapters:", err)
+		os.Exit(1)
+	}
+	metadata.Chapters = chapters
+
+	// Gets the runtime of the book from the openbook, or from the input file
+	runtimeMs := book.RuntimeMS()
+	if inputFile != "" {
+		runtimeMs, err = p.GetTotalDurationMS(ctx, files)
+		if err != nil {
+			fmt.Println("Error getting runtime:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Checks each of the outputs
+	opts := p.VerifyOptions{
+		ToleranceMs:        int(verifyTolerance.Milliseconds()),
+		RuntimeToleranceMs: int(verifyRuntimeTolerance.Milliseconds()),
+	}
+	report := p.VerifyReport{OK: true, ASIN: asin, Title: metadata.Title, RuntimeMs: runtimeMs}
+	for _, target := range targets {
+		outputPath, err := target.GetDirPath(metadata, asin, outPath)
+		if err != nil {
+			fmt.Println("Error getting output dir path:", err)
+			os.Exit(1)
+		}
+
+		// Checks against the chapters the output was planned with, if a run left a manifest
+		planned := metadata
+		manifest, err := p.ReadManifest(outputPath)
+		if err != nil {
+			fmt.Println("Error reading manifest:", err)
+			os.Exit(1)
+		}
+		if len(manifest.Chapters) > 0 {
+			planned.Chapters = manifest.Chapters
+		}
+
+		output := p.VerifyOutput(ctx, target, planned, asin, outputPath, runtimeMs, manifest, opts)
+		if output.OK {
+			fmt.Println("Verified", target.ToString()+":", "OK")
+		} else {
+			fmt.Println("Verified", target.ToString()+":", "FAILED")
+		}
+		report.OK = report.OK && output.OK
+		report.Outputs = append(report.Outputs, output)
+	}
+
+	os.Stdout = stdout
+
+	// Writes the report
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Println("Error encoding report:", err)
+		os.Exit(1)
+	}
+	if verifyReport != "" {
+		if err := os.WriteFile(verifyReport, append(data, '\n'), 0644); err != nil {
+			fmt.Println("Error writing report:", err)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println(string(data))
+	}
+
+	if !report.OK {
+		os.Exit(2)
+	}
+}